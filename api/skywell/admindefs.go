@@ -0,0 +1,58 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.defs
+
+// AdminDefs_AuditEntry is a "auditEntry" in the dev.skywell.admin.defs schema.
+//
+// One admin action, as recorded in the audit log.
+type AdminDefs_AuditEntry struct {
+	// action: The admin procedure that was called.
+	Action string `json:"action" cborgen:"action"`
+	// admin: DID of the admin who did it.
+	Admin     string `json:"admin" cborgen:"admin"`
+	CreatedAt string `json:"createdAt" cborgen:"createdAt"`
+	// details: The procedure's input, as JSON.
+	Details *string `json:"details,omitempty" cborgen:"details,omitempty"`
+	Id      int64   `json:"id" cborgen:"id"`
+	Reason  *string `json:"reason,omitempty" cborgen:"reason,omitempty"`
+	// subject: What it was done to: an at-uri, DID or slug.
+	Subject string `json:"subject" cborgen:"subject"`
+}
+
+// AdminDefs_IngestError is a "ingestError" in the dev.skywell.admin.defs schema.
+//
+// A record the AppView failed to index.
+type AdminDefs_IngestError struct {
+	Collection *string `json:"collection,omitempty" cborgen:"collection,omitempty"`
+	CreatedAt  string  `json:"createdAt" cborgen:"createdAt"`
+	Did        string  `json:"did" cborgen:"did"`
+	Error      string  `json:"error" cborgen:"error"`
+	Id         int64   `json:"id" cborgen:"id"`
+	Operation  *string `json:"operation,omitempty" cborgen:"operation,omitempty"`
+	Uri        *string `json:"uri,omitempty" cborgen:"uri,omitempty"`
+}
+
+// AdminDefs_ReportView is a "reportView" in the dev.skywell.admin.defs schema.
+//
+// A user's report about a file, and what was done about it.
+type AdminDefs_ReportView struct {
+	CreatedAt string `json:"createdAt" cborgen:"createdAt"`
+	Id        int64  `json:"id" cborgen:"id"`
+	// note: The admin's note on the report.
+	Note       *string `json:"note,omitempty" cborgen:"note,omitempty"`
+	Reason     *string `json:"reason,omitempty" cborgen:"reason,omitempty"`
+	ReasonType *string `json:"reasonType" cborgen:"reasonType"`
+	Reporter   string  `json:"reporter" cborgen:"reporter"`
+	ResolvedAt *string `json:"resolvedAt,omitempty" cborgen:"resolvedAt,omitempty"`
+	// resolvedBy: DID of the admin who resolved or dismissed the report.
+	ResolvedBy *string `json:"resolvedBy,omitempty" cborgen:"resolvedBy,omitempty"`
+	// slug: The file's slug. Missing if the file has been deleted.
+	Slug   *string `json:"slug,omitempty" cborgen:"slug,omitempty"`
+	Status *string `json:"status" cborgen:"status"`
+	// takedown: Whether the file is currently taken down.
+	Takedown bool `json:"takedown" cborgen:"takedown"`
+	// uri: The reported file, as it was when it was reported.
+	Uri string `json:"uri" cborgen:"uri"`
+}
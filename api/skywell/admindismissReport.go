@@ -0,0 +1,28 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.dismissReport
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminDismissReport_Input is the input argument to a dev.skywell.admin.dismissReport call.
+type AdminDismissReport_Input struct {
+	Id int64 `json:"id" cborgen:"id"`
+	// note: Kept on the report, and used as the reason in the audit log.
+	Note *string `json:"note,omitempty" cborgen:"note,omitempty"`
+}
+
+// AdminDismissReport calls the XRPC method "dev.skywell.admin.dismissReport".
+func AdminDismissReport(ctx context.Context, c util.LexClient, input *AdminDismissReport_Input) (*AdminDefs_ReportView, error) {
+	var out AdminDefs_ReportView
+	if err := c.LexDo(ctx, util.Procedure, "application/json", "dev.skywell.admin.dismissReport", nil, input, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
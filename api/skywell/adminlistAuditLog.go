@@ -0,0 +1,40 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.listAuditLog
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminListAuditLog_Output is the output of a dev.skywell.admin.listAuditLog call.
+type AdminListAuditLog_Output struct {
+	Cursor  *string                 `json:"cursor,omitempty" cborgen:"cursor,omitempty"`
+	Entries []*AdminDefs_AuditEntry `json:"entries" cborgen:"entries"`
+}
+
+// AdminListAuditLog calls the XRPC method "dev.skywell.admin.listAuditLog".
+//
+// subject: Only actions on this at-uri, DID or slug.
+func AdminListAuditLog(ctx context.Context, c util.LexClient, cursor string, limit int64, subject string) (*AdminListAuditLog_Output, error) {
+	var out AdminListAuditLog_Output
+
+	params := map[string]interface{}{}
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+	if limit != 0 {
+		params["limit"] = limit
+	}
+	if subject != "" {
+		params["subject"] = subject
+	}
+	if err := c.LexDo(ctx, util.Query, "", "dev.skywell.admin.listAuditLog", params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,40 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.listIngestErrors
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminListIngestErrors_Output is the output of a dev.skywell.admin.listIngestErrors call.
+type AdminListIngestErrors_Output struct {
+	Cursor *string                  `json:"cursor,omitempty" cborgen:"cursor,omitempty"`
+	Errors []*AdminDefs_IngestError `json:"errors" cborgen:"errors"`
+}
+
+// AdminListIngestErrors calls the XRPC method "dev.skywell.admin.listIngestErrors".
+//
+// did: Only errors from this account.
+func AdminListIngestErrors(ctx context.Context, c util.LexClient, cursor string, did string, limit int64) (*AdminListIngestErrors_Output, error) {
+	var out AdminListIngestErrors_Output
+
+	params := map[string]interface{}{}
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+	if did != "" {
+		params["did"] = did
+	}
+	if limit != 0 {
+		params["limit"] = limit
+	}
+	if err := c.LexDo(ctx, util.Query, "", "dev.skywell.admin.listIngestErrors", params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
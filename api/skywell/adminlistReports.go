@@ -0,0 +1,44 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.listReports
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminListReports_Output is the output of a dev.skywell.admin.listReports call.
+type AdminListReports_Output struct {
+	Cursor  *string                 `json:"cursor,omitempty" cborgen:"cursor,omitempty"`
+	Reports []*AdminDefs_ReportView `json:"reports" cborgen:"reports"`
+}
+
+// AdminListReports calls the XRPC method "dev.skywell.admin.listReports".
+//
+// status: Only reports with this status. Defaults to open reports.
+// subject: Only reports about this file, by at-uri or slug.
+func AdminListReports(ctx context.Context, c util.LexClient, cursor string, limit int64, status string, subject string) (*AdminListReports_Output, error) {
+	var out AdminListReports_Output
+
+	params := map[string]interface{}{}
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+	if limit != 0 {
+		params["limit"] = limit
+	}
+	if status != "" {
+		params["status"] = status
+	}
+	if subject != "" {
+		params["subject"] = subject
+	}
+	if err := c.LexDo(ctx, util.Query, "", "dev.skywell.admin.listReports", params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,41 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.reassignSlug
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminReassignSlug_Input is the input argument to a dev.skywell.admin.reassignSlug call.
+type AdminReassignSlug_Input struct {
+	// reason: Why, for the audit log.
+	Reason *string `json:"reason,omitempty" cborgen:"reason,omitempty"`
+	// slug: Letters, digits, '-' and '_'.
+	Slug string `json:"slug" cborgen:"slug"`
+	// uri: The file to point the slug at.
+	Uri string `json:"uri" cborgen:"uri"`
+}
+
+// AdminReassignSlug_Output is the output of a dev.skywell.admin.reassignSlug call.
+type AdminReassignSlug_Output struct {
+	// previousUri: The file the slug pointed at before, if any.
+	PreviousUri *string `json:"previousUri,omitempty" cborgen:"previousUri,omitempty"`
+	// retiredSlug: The file's old slug, now reserved.
+	RetiredSlug *string `json:"retiredSlug,omitempty" cborgen:"retiredSlug,omitempty"`
+	Slug        string  `json:"slug" cborgen:"slug"`
+	Uri         string  `json:"uri" cborgen:"uri"`
+}
+
+// AdminReassignSlug calls the XRPC method "dev.skywell.admin.reassignSlug".
+func AdminReassignSlug(ctx context.Context, c util.LexClient, input *AdminReassignSlug_Input) (*AdminReassignSlug_Output, error) {
+	var out AdminReassignSlug_Output
+	if err := c.LexDo(ctx, util.Procedure, "application/json", "dev.skywell.admin.reassignSlug", nil, input, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
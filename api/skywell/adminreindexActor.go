@@ -0,0 +1,38 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.reindexActor
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminReindexActor_Input is the input argument to a dev.skywell.admin.reindexActor call.
+type AdminReindexActor_Input struct {
+	// actor: Handle or DID of the account to reindex.
+	Actor string `json:"actor" cborgen:"actor"`
+	// reason: Why, for the audit log.
+	Reason *string `json:"reason,omitempty" cborgen:"reason,omitempty"`
+}
+
+// AdminReindexActor_Output is the output of a dev.skywell.admin.reindexActor call.
+type AdminReindexActor_Output struct {
+	Did string `json:"did" cborgen:"did"`
+	// records: How many file and collection records from the repo were indexed (records that failed to index aren't counted).
+	Records int64 `json:"records" cborgen:"records"`
+	// removed: How many indexed files and collections were gone from the repo, and were removed.
+	Removed int64 `json:"removed" cborgen:"removed"`
+}
+
+// AdminReindexActor calls the XRPC method "dev.skywell.admin.reindexActor".
+func AdminReindexActor(ctx context.Context, c util.LexClient, input *AdminReindexActor_Input) (*AdminReindexActor_Output, error) {
+	var out AdminReindexActor_Output
+	if err := c.LexDo(ctx, util.Procedure, "application/json", "dev.skywell.admin.reindexActor", nil, input, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,37 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.reserveSlug
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminReserveSlug_Input is the input argument to a dev.skywell.admin.reserveSlug call.
+type AdminReserveSlug_Input struct {
+	// reason: Why, for the audit log.
+	Reason *string `json:"reason,omitempty" cborgen:"reason,omitempty"`
+	// release: Release the reservation instead.
+	Release *bool `json:"release,omitempty" cborgen:"release,omitempty"`
+	// slug: Letters, digits, '-' and '_'.
+	Slug string `json:"slug" cborgen:"slug"`
+}
+
+// AdminReserveSlug_Output is the output of a dev.skywell.admin.reserveSlug call.
+type AdminReserveSlug_Output struct {
+	Reserved bool   `json:"reserved" cborgen:"reserved"`
+	Slug     string `json:"slug" cborgen:"slug"`
+}
+
+// AdminReserveSlug calls the XRPC method "dev.skywell.admin.reserveSlug".
+func AdminReserveSlug(ctx context.Context, c util.LexClient, input *AdminReserveSlug_Input) (*AdminReserveSlug_Output, error) {
+	var out AdminReserveSlug_Output
+	if err := c.LexDo(ctx, util.Procedure, "application/json", "dev.skywell.admin.reserveSlug", nil, input, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
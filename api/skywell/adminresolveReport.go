@@ -0,0 +1,30 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.resolveReport
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminResolveReport_Input is the input argument to a dev.skywell.admin.resolveReport call.
+type AdminResolveReport_Input struct {
+	Id int64 `json:"id" cborgen:"id"`
+	// note: Kept on the report, and used as the reason in the audit log.
+	Note *string `json:"note,omitempty" cborgen:"note,omitempty"`
+	// takedown: Also take the reported file down.
+	Takedown *bool `json:"takedown,omitempty" cborgen:"takedown,omitempty"`
+}
+
+// AdminResolveReport calls the XRPC method "dev.skywell.admin.resolveReport".
+func AdminResolveReport(ctx context.Context, c util.LexClient, input *AdminResolveReport_Input) (*AdminDefs_ReportView, error) {
+	var out AdminDefs_ReportView
+	if err := c.LexDo(ctx, util.Procedure, "application/json", "dev.skywell.admin.resolveReport", nil, input, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
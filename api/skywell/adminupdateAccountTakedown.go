@@ -0,0 +1,36 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.updateAccountTakedown
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminUpdateAccountTakedown_Input is the input argument to a dev.skywell.admin.updateAccountTakedown call.
+type AdminUpdateAccountTakedown_Input struct {
+	Did string `json:"did" cborgen:"did"`
+	// reason: Why, for the audit log.
+	Reason *string `json:"reason,omitempty" cborgen:"reason,omitempty"`
+	// takedown: True to take the account down, false to restore it.
+	Takedown bool `json:"takedown" cborgen:"takedown"`
+}
+
+// AdminUpdateAccountTakedown_Output is the output of a dev.skywell.admin.updateAccountTakedown call.
+type AdminUpdateAccountTakedown_Output struct {
+	Did      string `json:"did" cborgen:"did"`
+	Takedown bool   `json:"takedown" cborgen:"takedown"`
+}
+
+// AdminUpdateAccountTakedown calls the XRPC method "dev.skywell.admin.updateAccountTakedown".
+func AdminUpdateAccountTakedown(ctx context.Context, c util.LexClient, input *AdminUpdateAccountTakedown_Input) (*AdminUpdateAccountTakedown_Output, error) {
+	var out AdminUpdateAccountTakedown_Output
+	if err := c.LexDo(ctx, util.Procedure, "application/json", "dev.skywell.admin.updateAccountTakedown", nil, input, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
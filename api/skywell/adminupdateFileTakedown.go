@@ -0,0 +1,38 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.admin.updateFileTakedown
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// AdminUpdateFileTakedown_Input is the input argument to a dev.skywell.admin.updateFileTakedown call.
+type AdminUpdateFileTakedown_Input struct {
+	// reason: Why, for the audit log.
+	Reason *string `json:"reason,omitempty" cborgen:"reason,omitempty"`
+	// subject: The file's at-uri or slug.
+	Subject string `json:"subject" cborgen:"subject"`
+	// takedown: True to take the file down, false to restore it.
+	Takedown bool `json:"takedown" cborgen:"takedown"`
+}
+
+// AdminUpdateFileTakedown_Output is the output of a dev.skywell.admin.updateFileTakedown call.
+type AdminUpdateFileTakedown_Output struct {
+	Slug     string `json:"slug" cborgen:"slug"`
+	Takedown bool   `json:"takedown" cborgen:"takedown"`
+	Uri      string `json:"uri" cborgen:"uri"`
+}
+
+// AdminUpdateFileTakedown calls the XRPC method "dev.skywell.admin.updateFileTakedown".
+func AdminUpdateFileTakedown(ctx context.Context, c util.LexClient, input *AdminUpdateFileTakedown_Input) (*AdminUpdateFileTakedown_Output, error) {
+	var out AdminUpdateFileTakedown_Output
+	if err := c.LexDo(ctx, util.Procedure, "application/json", "dev.skywell.admin.updateFileTakedown", nil, input, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
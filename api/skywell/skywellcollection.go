@@ -0,0 +1,23 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.collection
+
+import (
+	comatprototypes "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+func init() {
+	util.RegisterType("dev.skywell.collection", &Collection{})
+} //
+// RECORDTYPE: Collection
+type Collection struct {
+	LexiconTypeID string  `json:"$type,const=dev.skywell.collection" cborgen:"$type,const=dev.skywell.collection"`
+	CreatedAt     string  `json:"createdAt" cborgen:"createdAt"`
+	Description   *string `json:"description,omitempty" cborgen:"description,omitempty"`
+	// files: The dev.skywell.file records in the collection, in order. They don't have to be the collection owner's.
+	Files []*comatprototypes.RepoStrongRef `json:"files" cborgen:"files"`
+	Name  string                           `json:"name" cborgen:"name"`
+}
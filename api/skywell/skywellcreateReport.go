@@ -0,0 +1,37 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.createReport
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// CreateReport_Input is the input argument to a dev.skywell.createReport call.
+type CreateReport_Input struct {
+	// reason: More about what's wrong with the file.
+	Reason     *string `json:"reason,omitempty" cborgen:"reason,omitempty"`
+	ReasonType *string `json:"reasonType" cborgen:"reasonType"`
+	// subject: The file's at-uri or slug.
+	Subject string `json:"subject" cborgen:"subject"`
+}
+
+// CreateReport_Output is the output of a dev.skywell.createReport call.
+type CreateReport_Output struct {
+	CreatedAt string `json:"createdAt" cborgen:"createdAt"`
+	Id        int64  `json:"id" cborgen:"id"`
+	Uri       string `json:"uri" cborgen:"uri"`
+}
+
+// CreateReport calls the XRPC method "dev.skywell.createReport".
+func CreateReport(ctx context.Context, c util.LexClient, input *CreateReport_Input) (*CreateReport_Output, error) {
+	var out CreateReport_Output
+	if err := c.LexDo(ctx, util.Procedure, "application/json", "dev.skywell.createReport", nil, input, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -5,18 +5,48 @@ package skywell
 // schema: dev.skywell.defs
 
 import (
+	comatprototypes "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/lex/util"
 )
 
+// Defs_CollectionView is a "collectionView" in the dev.skywell.defs schema.
+type Defs_CollectionView struct {
+	Cid         string  `json:"cid" cborgen:"cid"`
+	CreatedAt   string  `json:"createdAt" cborgen:"createdAt"`
+	Description *string `json:"description,omitempty" cborgen:"description,omitempty"`
+	// fileCount: How many files the record lists, including ones left out of 'files'.
+	FileCount *int64 `json:"fileCount,omitempty" cborgen:"fileCount,omitempty"`
+	// files: The collection's files, in the record's order. Files that aren't indexed or can't be shown to the viewer are left out. Each one is the current version of the file record, even if it changed after it was added.
+	Files []*Defs_FileView `json:"files" cborgen:"files"`
+	Name  string           `json:"name" cborgen:"name"`
+	Slug  string           `json:"slug" cborgen:"slug"`
+	Uri   string           `json:"uri" cborgen:"uri"`
+}
+
 // Defs_FileView is a "fileView" in the dev.skywell.defs schema.
 type Defs_FileView struct {
-	Blob        *util.LexBlob `json:"blob" cborgen:"blob"`
-	Cid         string        `json:"cid" cborgen:"cid"`
-	CreatedAt   string        `json:"createdAt" cborgen:"createdAt"`
-	Description *string       `json:"description,omitempty" cborgen:"description,omitempty"`
-	Name        string        `json:"name" cborgen:"name"`
-	Slug        string        `json:"slug" cborgen:"slug"`
-	Uri         string        `json:"uri" cborgen:"uri"`
+	Blob *util.LexBlob `json:"blob" cborgen:"blob"`
+	// chunks: The blobs that make up a chunked file, in order, starting with blob. Missing for files that are a single blob.
+	Chunks      []*util.LexBlob `json:"chunks,omitempty" cborgen:"chunks,omitempty"`
+	Cid         string          `json:"cid" cborgen:"cid"`
+	CreatedAt   string          `json:"createdAt" cborgen:"createdAt"`
+	Description *string         `json:"description,omitempty" cborgen:"description,omitempty"`
+	// detectedMimeType: MIME type sniffed from the start of the blob, if it has been fetched.
+	DetectedMimeType *string `json:"detectedMimeType,omitempty" cborgen:"detectedMimeType,omitempty"`
+	// hash: SHA-256 of the whole file, in lowercase hex, for chunked files.
+	Hash *string `json:"hash,omitempty" cborgen:"hash,omitempty"`
+	// labels: Labels on the file from labelers this AppView trusts (including its own).
+	Labels     []*comatprototypes.LabelDefs_Label `json:"labels,omitempty" cborgen:"labels,omitempty"`
+	Moderation *string                            `json:"moderation,omitempty" cborgen:"moderation,omitempty"`
+	Name       string                             `json:"name" cborgen:"name"`
+	// scanResult: What the scanner found, for flagged files.
+	ScanResult *string `json:"scanResult,omitempty" cborgen:"scanResult,omitempty"`
+	// scanStatus: What the AppView's malware scanners made of the blob. 'flagged' files are only shown to their owner, unless the AppView is configured to mark them instead. 'unscanned': too big, or it couldn't be fetched. Absent when the AppView doesn't scan blobs (unless the file was flagged before it stopped).
+	ScanStatus *string `json:"scanStatus,omitempty" cborgen:"scanStatus,omitempty"`
+	Slug       string  `json:"slug" cborgen:"slug"`
+	Uri        string  `json:"uri" cborgen:"uri"`
+	// verification: Whether the AppView has checked the blob against what the record claims. 'verified': the contents match the CID, size and MIME type. 'invalid': they don't. 'unverified': it couldn't be fully checked (e.g. too big, or the PDS didn't serve it). 'pending': not checked yet. Absent when the AppView doesn't verify blobs.
+	Verification *string `json:"verification,omitempty" cborgen:"verification,omitempty"`
 }
 
 // Defs_ProfileView is a "profileView" in the dev.skywell.defs schema.
@@ -26,4 +56,7 @@ type Defs_ProfileView struct {
 	DisplayName *string `json:"displayName,omitempty" cborgen:"displayName,omitempty"`
 	FileCount   *int64  `json:"fileCount,omitempty" cborgen:"fileCount,omitempty"`
 	Handle      string  `json:"handle" cborgen:"handle"`
+	// labels: Labels on the account from labelers this AppView trusts (including its own).
+	Labels     []*comatprototypes.LabelDefs_Label `json:"labels,omitempty" cborgen:"labels,omitempty"`
+	Moderation *string                            `json:"moderation,omitempty" cborgen:"moderation,omitempty"`
 }
@@ -0,0 +1,36 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.describeServer
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// DescribeServer_Method is a "method" in the dev.skywell.describeServer schema.
+type DescribeServer_Method struct {
+	// auth: What the method needs from the caller: 'none', 'optional' (a service auth JWT if they have one), 'required', or 'admin' (required, from one of the AppView's admins).
+	Auth string `json:"auth" cborgen:"auth"`
+	Nsid string `json:"nsid" cborgen:"nsid"`
+	Type string `json:"type" cborgen:"type"`
+}
+
+// DescribeServer_Output is the output of a dev.skywell.describeServer call.
+type DescribeServer_Output struct {
+	// did: The AppView's DID, which service auth tokens are addressed to.
+	Did     string                   `json:"did" cborgen:"did"`
+	Methods []*DescribeServer_Method `json:"methods" cborgen:"methods"`
+}
+
+// DescribeServer calls the XRPC method "dev.skywell.describeServer".
+func DescribeServer(ctx context.Context, c util.LexClient) (*DescribeServer_Output, error) {
+	var out DescribeServer_Output
+	if err := c.LexDo(ctx, util.Query, "", "dev.skywell.describeServer", nil, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -13,9 +13,14 @@ func init() {
 } //
 // RECORDTYPE: File
 type File struct {
-	LexiconTypeID string        `json:"$type,const=dev.skywell.file" cborgen:"$type,const=dev.skywell.file"`
-	BlobRef       *util.LexBlob `json:"blobRef" cborgen:"blobRef"`
-	CreatedAt     string        `json:"createdAt" cborgen:"createdAt"`
-	Description   *string       `json:"description,omitempty" cborgen:"description,omitempty"`
-	Name          string        `json:"name" cborgen:"name"`
+	LexiconTypeID string `json:"$type,const=dev.skywell.file" cborgen:"$type,const=dev.skywell.file"`
+	// blobRef: The file's contents. For a chunked file, the first chunk.
+	BlobRef *util.LexBlob `json:"blobRef" cborgen:"blobRef"`
+	// chunks: For files too big for one blob: the blobs that make up the file, in order, starting with blobRef. The file is their contents put together.
+	Chunks      []*util.LexBlob `json:"chunks,omitempty" cborgen:"chunks,omitempty"`
+	CreatedAt   string          `json:"createdAt" cborgen:"createdAt"`
+	Description *string         `json:"description,omitempty" cborgen:"description,omitempty"`
+	// hash: SHA-256 of the whole file, in lowercase hex. Required with chunks, so the reassembled file can be checked.
+	Hash *string `json:"hash,omitempty" cborgen:"hash,omitempty"`
+	Name string  `json:"name" cborgen:"name"`
 }
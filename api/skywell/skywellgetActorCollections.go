@@ -0,0 +1,39 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.getActorCollections
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// GetActorCollections_Output is the output of a dev.skywell.getActorCollections call.
+type GetActorCollections_Output struct {
+	Actor       *Defs_ProfileView      `json:"actor" cborgen:"actor"`
+	Collections []*Defs_CollectionView `json:"collections" cborgen:"collections"`
+	Cursor      *string                `json:"cursor,omitempty" cborgen:"cursor,omitempty"`
+}
+
+// GetActorCollections calls the XRPC method "dev.skywell.getActorCollections".
+//
+// actor: Handle or DID of account to get collections from.
+func GetActorCollections(ctx context.Context, c util.LexClient, actor string, cursor string, limit int64) (*GetActorCollections_Output, error) {
+	var out GetActorCollections_Output
+
+	params := map[string]interface{}{}
+	params["actor"] = actor
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+	if limit != 0 {
+		params["limit"] = limit
+	}
+	if err := c.LexDo(ctx, util.Query, "", "dev.skywell.getActorCollections", params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,36 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.getCollection
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// GetCollection_Output is the output of a dev.skywell.getCollection call.
+type GetCollection_Output struct {
+	Actor *Defs_ProfileView `json:"actor" cborgen:"actor"`
+	// cid: CID of the collection record.
+	Cid        string               `json:"cid" cborgen:"cid"`
+	Collection *Defs_CollectionView `json:"collection" cborgen:"collection"`
+	// uri: Link to the collection record.
+	Uri string `json:"uri" cborgen:"uri"`
+}
+
+// GetCollection calls the XRPC method "dev.skywell.getCollection".
+//
+// slug: Slug of the collection.
+func GetCollection(ctx context.Context, c util.LexClient, slug string) (*GetCollection_Output, error) {
+	var out GetCollection_Output
+
+	params := map[string]interface{}{}
+	params["slug"] = slug
+	if err := c.LexDo(ctx, util.Query, "", "dev.skywell.getCollection", params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
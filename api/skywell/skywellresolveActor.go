@@ -0,0 +1,33 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.resolveActor
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// ResolveActor_Output is the output of a dev.skywell.resolveActor call.
+type ResolveActor_Output struct {
+	Did string `json:"did" cborgen:"did"`
+	// handle: The account's verified handle, or 'handle.invalid' if it doesn't resolve back to the DID.
+	Handle string `json:"handle" cborgen:"handle"`
+}
+
+// ResolveActor calls the XRPC method "dev.skywell.resolveActor".
+//
+// actor: Handle or DID to resolve.
+func ResolveActor(ctx context.Context, c util.LexClient, actor string) (*ResolveActor_Output, error) {
+	var out ResolveActor_Output
+
+	params := map[string]interface{}{}
+	params["actor"] = actor
+	if err := c.LexDo(ctx, util.Query, "", "dev.skywell.resolveActor", params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
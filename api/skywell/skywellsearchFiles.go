@@ -0,0 +1,46 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package skywell
+
+// schema: dev.skywell.searchFiles
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// SearchFiles_Output is the output of a dev.skywell.searchFiles call.
+type SearchFiles_Output struct {
+	Cursor *string          `json:"cursor,omitempty" cborgen:"cursor,omitempty"`
+	Files  []*Defs_FileView `json:"files" cborgen:"files"`
+}
+
+// SearchFiles calls the XRPC method "dev.skywell.searchFiles".
+//
+// actor: Only return files created by this account.
+// mimeType: Only return files whose MIME type starts with this, e.g. 'image/' or 'application/pdf'.
+// q: Search query. Every word has to appear in the file's name or description.
+func SearchFiles(ctx context.Context, c util.LexClient, actor string, cursor string, limit int64, mimeType string, q string) (*SearchFiles_Output, error) {
+	var out SearchFiles_Output
+
+	params := map[string]interface{}{}
+	if actor != "" {
+		params["actor"] = actor
+	}
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+	if limit != 0 {
+		params["limit"] = limit
+	}
+	if mimeType != "" {
+		params["mimeType"] = mimeType
+	}
+	params["q"] = q
+	if err := c.LexDo(ctx, util.Query, "", "dev.skywell.searchFiles", params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -1,6 +1,24 @@
+export * as DevSkywellAdminDefs from "./types/dev/skywell/admin/defs.js";
+export * as DevSkywellAdminDismissReport from "./types/dev/skywell/admin/dismissReport.js";
+export * as DevSkywellAdminListAuditLog from "./types/dev/skywell/admin/listAuditLog.js";
+export * as DevSkywellAdminListIngestErrors from "./types/dev/skywell/admin/listIngestErrors.js";
+export * as DevSkywellAdminListReports from "./types/dev/skywell/admin/listReports.js";
+export * as DevSkywellAdminReassignSlug from "./types/dev/skywell/admin/reassignSlug.js";
+export * as DevSkywellAdminReindexActor from "./types/dev/skywell/admin/reindexActor.js";
+export * as DevSkywellAdminReserveSlug from "./types/dev/skywell/admin/reserveSlug.js";
+export * as DevSkywellAdminResolveReport from "./types/dev/skywell/admin/resolveReport.js";
+export * as DevSkywellAdminUpdateAccountTakedown from "./types/dev/skywell/admin/updateAccountTakedown.js";
+export * as DevSkywellAdminUpdateFileTakedown from "./types/dev/skywell/admin/updateFileTakedown.js";
+export * as DevSkywellCollection from "./types/dev/skywell/collection.js";
+export * as DevSkywellCreateReport from "./types/dev/skywell/createReport.js";
 export * as DevSkywellDefs from "./types/dev/skywell/defs.js";
+export * as DevSkywellDescribeServer from "./types/dev/skywell/describeServer.js";
 export * as DevSkywellFile from "./types/dev/skywell/file.js";
+export * as DevSkywellGetActorCollections from "./types/dev/skywell/getActorCollections.js";
 export * as DevSkywellGetActorFiles from "./types/dev/skywell/getActorFiles.js";
 export * as DevSkywellGetActorProfile from "./types/dev/skywell/getActorProfile.js";
+export * as DevSkywellGetCollection from "./types/dev/skywell/getCollection.js";
 export * as DevSkywellGetFileFromSlug from "./types/dev/skywell/getFileFromSlug.js";
 export * as DevSkywellIndexActorProfile from "./types/dev/skywell/indexActorProfile.js";
+export * as DevSkywellResolveActor from "./types/dev/skywell/resolveActor.js";
+export * as DevSkywellSearchFiles from "./types/dev/skywell/searchFiles.js";
@@ -0,0 +1,101 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import * as DevSkywellDefs from "../defs.js";
+
+const _auditEntrySchema = /*#__PURE__*/ v.object({
+  $type: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.literal("dev.skywell.admin.defs#auditEntry"),
+  ),
+  /**
+   * The admin procedure that was called.
+   */
+  action: /*#__PURE__*/ v.nsidString(),
+  /**
+   * DID of the admin who did it.
+   */
+  admin: /*#__PURE__*/ v.didString(),
+  createdAt: /*#__PURE__*/ v.datetimeString(),
+  /**
+   * The procedure's input, as JSON.
+   */
+  details: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  id: /*#__PURE__*/ v.integer(),
+  reason: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  /**
+   * What it was done to: an at-uri, DID or slug.
+   */
+  subject: /*#__PURE__*/ v.string(),
+});
+const _ingestErrorSchema = /*#__PURE__*/ v.object({
+  $type: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.literal("dev.skywell.admin.defs#ingestError"),
+  ),
+  collection: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.nsidString()),
+  createdAt: /*#__PURE__*/ v.datetimeString(),
+  did: /*#__PURE__*/ v.didString(),
+  error: /*#__PURE__*/ v.string(),
+  id: /*#__PURE__*/ v.integer(),
+  operation: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.string<"create" | "delete" | "update" | (string & {})>(),
+  ),
+  uri: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.resourceUriString()),
+});
+const _reportStatusSchema = /*#__PURE__*/ v.string<
+  "dismissed" | "open" | "resolved" | (string & {})
+>();
+const _reportViewSchema = /*#__PURE__*/ v.object({
+  $type: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.literal("dev.skywell.admin.defs#reportView"),
+  ),
+  createdAt: /*#__PURE__*/ v.datetimeString(),
+  id: /*#__PURE__*/ v.integer(),
+  /**
+   * The admin's note on the report.
+   */
+  note: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  reason: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  get reasonType() {
+    return DevSkywellDefs.reasonTypeSchema;
+  },
+  reporter: /*#__PURE__*/ v.didString(),
+  resolvedAt: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.datetimeString()),
+  /**
+   * DID of the admin who resolved or dismissed the report.
+   */
+  resolvedBy: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.didString()),
+  /**
+   * The file's slug. Missing if the file has been deleted.
+   */
+  slug: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  get status() {
+    return reportStatusSchema;
+  },
+  /**
+   * Whether the file is currently taken down.
+   */
+  takedown: /*#__PURE__*/ v.boolean(),
+  /**
+   * The reported file, as it was when it was reported.
+   */
+  uri: /*#__PURE__*/ v.resourceUriString(),
+});
+
+type auditEntry$schematype = typeof _auditEntrySchema;
+type ingestError$schematype = typeof _ingestErrorSchema;
+type reportStatus$schematype = typeof _reportStatusSchema;
+type reportView$schematype = typeof _reportViewSchema;
+
+export interface auditEntrySchema extends auditEntry$schematype {}
+export interface ingestErrorSchema extends ingestError$schematype {}
+export interface reportStatusSchema extends reportStatus$schematype {}
+export interface reportViewSchema extends reportView$schematype {}
+
+export const auditEntrySchema = _auditEntrySchema as auditEntrySchema;
+export const ingestErrorSchema = _ingestErrorSchema as ingestErrorSchema;
+export const reportStatusSchema = _reportStatusSchema as reportStatusSchema;
+export const reportViewSchema = _reportViewSchema as reportViewSchema;
+
+export interface AuditEntry extends v.InferInput<typeof auditEntrySchema> {}
+export interface IngestError extends v.InferInput<typeof ingestErrorSchema> {}
+export type ReportStatus = v.InferInput<typeof reportStatusSchema>;
+export interface ReportView extends v.InferInput<typeof reportViewSchema> {}
@@ -0,0 +1,44 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+import * as DevSkywellAdminDefs from "./defs.js";
+
+const _mainSchema = /*#__PURE__*/ v.query("dev.skywell.admin.listIngestErrors", {
+  params: /*#__PURE__*/ v.object({
+    cursor: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+    /**
+     * Only errors from this account.
+     */
+    did: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.didString()),
+    limit: /*#__PURE__*/ v.optional(
+      /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.integer(), [
+        /*#__PURE__*/ v.integerRange(1, 100),
+      ]),
+      50,
+    ),
+  }),
+  output: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      cursor: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+      get errors() {
+        return /*#__PURE__*/ v.array(DevSkywellAdminDefs.ingestErrorSchema);
+      },
+    }),
+  },
+});
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params extends v.InferInput<mainSchema["params"]> {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCQueries {
+    "dev.skywell.admin.listIngestErrors": mainSchema;
+  }
+}
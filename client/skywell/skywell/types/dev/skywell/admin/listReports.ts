@@ -0,0 +1,52 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+import * as DevSkywellAdminDefs from "./defs.js";
+
+const _mainSchema = /*#__PURE__*/ v.query("dev.skywell.admin.listReports", {
+  params: /*#__PURE__*/ v.object({
+    cursor: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+    limit: /*#__PURE__*/ v.optional(
+      /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.integer(), [
+        /*#__PURE__*/ v.integerRange(1, 100),
+      ]),
+      50,
+    ),
+    /**
+     * Only reports with this status. Defaults to open reports.
+     */
+    status: /*#__PURE__*/ v.optional(
+      /*#__PURE__*/ v.string<
+        "dismissed" | "open" | "resolved" | (string & {})
+      >(),
+    ),
+    /**
+     * Only reports about this file, by at-uri or slug.
+     */
+    subject: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  }),
+  output: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      cursor: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+      get reports() {
+        return /*#__PURE__*/ v.array(DevSkywellAdminDefs.reportViewSchema);
+      },
+    }),
+  },
+});
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params extends v.InferInput<mainSchema["params"]> {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCQueries {
+    "dev.skywell.admin.listReports": mainSchema;
+  }
+}
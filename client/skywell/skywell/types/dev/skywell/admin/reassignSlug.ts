@@ -0,0 +1,57 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+
+const _mainSchema = /*#__PURE__*/ v.procedure("dev.skywell.admin.reassignSlug", {
+  params: null,
+  input: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      /**
+       * Why, for the audit log.
+       */
+      reason: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+      /**
+       * Letters, digits, '-' and '_'.
+       */
+      slug: /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
+        /*#__PURE__*/ v.stringLength(1, 64),
+      ]),
+      /**
+       * The file to point the slug at.
+       */
+      uri: /*#__PURE__*/ v.resourceUriString(),
+    }),
+  },
+  output: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      /**
+       * The file the slug pointed at before, if any.
+       */
+      previousUri: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.resourceUriString()),
+      /**
+       * The file's old slug, now reserved.
+       */
+      retiredSlug: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+      slug: /*#__PURE__*/ v.string(),
+      uri: /*#__PURE__*/ v.resourceUriString(),
+    }),
+  },
+});
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params {}
+export interface $input extends v.InferXRPCBodyInput<mainSchema["input"]> {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCProcedures {
+    "dev.skywell.admin.reassignSlug": mainSchema;
+  }
+}
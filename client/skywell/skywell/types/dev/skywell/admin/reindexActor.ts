@@ -0,0 +1,50 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+
+const _mainSchema = /*#__PURE__*/ v.procedure("dev.skywell.admin.reindexActor", {
+  params: null,
+  input: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      /**
+       * Handle or DID of the account to reindex.
+       */
+      actor: /*#__PURE__*/ v.actorIdentifierString(),
+      /**
+       * Why, for the audit log.
+       */
+      reason: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+    }),
+  },
+  output: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      did: /*#__PURE__*/ v.didString(),
+      /**
+       * How many file and collection records from the repo were indexed (records that failed to index aren't counted).
+       */
+      records: /*#__PURE__*/ v.integer(),
+      /**
+       * How many indexed files and collections were gone from the repo, and were removed.
+       */
+      removed: /*#__PURE__*/ v.integer(),
+    }),
+  },
+});
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params {}
+export interface $input extends v.InferXRPCBodyInput<mainSchema["input"]> {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCProcedures {
+    "dev.skywell.admin.reindexActor": mainSchema;
+  }
+}
@@ -0,0 +1,50 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+
+const _mainSchema = /*#__PURE__*/ v.procedure("dev.skywell.admin.reserveSlug", {
+  params: null,
+  input: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      /**
+       * Why, for the audit log.
+       */
+      reason: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+      /**
+       * Release the reservation instead.
+       * @default false
+       */
+      release: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.boolean(), false),
+      /**
+       * Letters, digits, '-' and '_'.
+       */
+      slug: /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
+        /*#__PURE__*/ v.stringLength(1, 64),
+      ]),
+    }),
+  },
+  output: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      reserved: /*#__PURE__*/ v.boolean(),
+      slug: /*#__PURE__*/ v.string(),
+    }),
+  },
+});
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params {}
+export interface $input extends v.InferXRPCBodyInput<mainSchema["input"]> {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCProcedures {
+    "dev.skywell.admin.reserveSlug": mainSchema;
+  }
+}
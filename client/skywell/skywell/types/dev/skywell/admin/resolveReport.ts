@@ -0,0 +1,44 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+import * as DevSkywellAdminDefs from "./defs.js";
+
+const _mainSchema = /*#__PURE__*/ v.procedure("dev.skywell.admin.resolveReport", {
+  params: null,
+  input: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      id: /*#__PURE__*/ v.integer(),
+      /**
+       * Kept on the report, and used as the reason in the audit log.
+       */
+      note: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+      /**
+       * Also take the reported file down.
+       */
+      takedown: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.boolean(), false),
+    }),
+  },
+  output: {
+    type: "lex",
+    get schema() {
+      return DevSkywellAdminDefs.reportViewSchema;
+    },
+  },
+});
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params {}
+export interface $input extends v.InferXRPCBodyInput<mainSchema["input"]> {}
+export type $output = v.InferXRPCBodyInput<mainSchema["output"]>;
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCProcedures {
+    "dev.skywell.admin.resolveReport": mainSchema;
+  }
+}
@@ -0,0 +1,47 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+
+const _mainSchema = /*#__PURE__*/ v.procedure(
+  "dev.skywell.admin.updateAccountTakedown",
+  {
+    params: null,
+    input: {
+      type: "lex",
+      schema: /*#__PURE__*/ v.object({
+        did: /*#__PURE__*/ v.didString(),
+        /**
+         * Why, for the audit log.
+         */
+        reason: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+        /**
+         * True to take the account down, false to restore it.
+         */
+        takedown: /*#__PURE__*/ v.boolean(),
+      }),
+    },
+    output: {
+      type: "lex",
+      schema: /*#__PURE__*/ v.object({
+        did: /*#__PURE__*/ v.didString(),
+        takedown: /*#__PURE__*/ v.boolean(),
+      }),
+    },
+  },
+);
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params {}
+export interface $input extends v.InferXRPCBodyInput<mainSchema["input"]> {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCProcedures {
+    "dev.skywell.admin.updateAccountTakedown": mainSchema;
+  }
+}
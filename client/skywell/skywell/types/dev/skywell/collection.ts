@@ -0,0 +1,45 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+import * as ComAtprotoRepoStrongRef from "@atcute/atproto/types/repo/strongRef";
+
+const _mainSchema = /*#__PURE__*/ v.record(
+  /*#__PURE__*/ v.tidString(),
+  /*#__PURE__*/ v.object({
+    $type: /*#__PURE__*/ v.literal("dev.skywell.collection"),
+    createdAt: /*#__PURE__*/ v.datetimeString(),
+    description: /*#__PURE__*/ v.optional(
+      /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
+        /*#__PURE__*/ v.stringLength(1),
+        /*#__PURE__*/ v.stringGraphemes(0, 500),
+      ]),
+    ),
+    /**
+     * The dev.skywell.file records in the collection, in order. They don't have to be the collection owner's.
+     * @maxLength 500
+     */
+    get files() {
+      return /*#__PURE__*/ v.constrain(
+        /*#__PURE__*/ v.array(ComAtprotoRepoStrongRef.mainSchema),
+        [/*#__PURE__*/ v.arrayLength(0, 500)],
+      );
+    },
+    name: /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
+      /*#__PURE__*/ v.stringGraphemes(1, 80),
+    ]),
+  }),
+);
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface Main extends v.InferInput<typeof mainSchema> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface Records {
+    "dev.skywell.collection": mainSchema;
+  }
+}
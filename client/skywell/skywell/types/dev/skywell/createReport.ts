@@ -0,0 +1,53 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+import * as DevSkywellDefs from "./defs.js";
+
+const _mainSchema = /*#__PURE__*/ v.procedure("dev.skywell.createReport", {
+  params: null,
+  input: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      /**
+       * More about what's wrong with the file.
+       */
+      reason: /*#__PURE__*/ v.optional(
+        /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
+          /*#__PURE__*/ v.stringLength(0, 20000),
+          /*#__PURE__*/ v.stringGraphemes(0, 2000),
+        ]),
+      ),
+      get reasonType() {
+        return DevSkywellDefs.reasonTypeSchema;
+      },
+      /**
+       * The file's at-uri or slug.
+       */
+      subject: /*#__PURE__*/ v.string(),
+    }),
+  },
+  output: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      createdAt: /*#__PURE__*/ v.datetimeString(),
+      id: /*#__PURE__*/ v.integer(),
+      uri: /*#__PURE__*/ v.resourceUriString(),
+    }),
+  },
+});
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params {}
+export interface $input extends v.InferXRPCBodyInput<mainSchema["input"]> {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCProcedures {
+    "dev.skywell.createReport": mainSchema;
+  }
+}
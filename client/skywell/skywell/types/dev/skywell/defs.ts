@@ -1,11 +1,43 @@
 import type {} from "@atcute/lexicons";
 import * as v from "@atcute/lexicons/validations";
+import * as ComAtprotoLabelDefs from "@atcute/atproto/types/label/defs";
 
+const _collectionViewSchema = /*#__PURE__*/ v.object({
+  $type: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.literal("dev.skywell.defs#collectionView"),
+  ),
+  cid: /*#__PURE__*/ v.cidString(),
+  createdAt: /*#__PURE__*/ v.datetimeString(),
+  description: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
+      /*#__PURE__*/ v.stringLength(1),
+      /*#__PURE__*/ v.stringGraphemes(0, 500),
+    ]),
+  ),
+  /**
+   * How many files the record lists, including ones left out of 'files'.
+   */
+  fileCount: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.integer()),
+  /**
+   * The collection's files, in the record's order. Files that aren't indexed or can't be shown to the viewer are left out. Each one is the current version of the file record, even if it changed after it was added.
+   */
+  get files() {
+    return /*#__PURE__*/ v.array(fileViewSchema);
+  },
+  name: /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
+    /*#__PURE__*/ v.stringGraphemes(1, 80),
+  ]),
+  slug: /*#__PURE__*/ v.string(),
+  uri: /*#__PURE__*/ v.resourceUriString(),
+});
 const _fileViewSchema = /*#__PURE__*/ v.object({
   $type: /*#__PURE__*/ v.optional(
     /*#__PURE__*/ v.literal("dev.skywell.defs#fileView"),
   ),
   blob: /*#__PURE__*/ v.blob(),
+  chunks: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.array(/*#__PURE__*/ v.blob()),
+  ),
   cid: /*#__PURE__*/ v.cidString(),
   createdAt: /*#__PURE__*/ v.datetimeString(),
   description: /*#__PURE__*/ v.optional(
@@ -14,11 +46,32 @@ const _fileViewSchema = /*#__PURE__*/ v.object({
       /*#__PURE__*/ v.stringGraphemes(0, 500),
     ]),
   ),
+  detectedMimeType: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  hash: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  get labels() {
+    return /*#__PURE__*/ v.optional(
+      /*#__PURE__*/ v.array(ComAtprotoLabelDefs.labelSchema),
+    );
+  },
+  get moderation() {
+    return /*#__PURE__*/ v.optional(moderationSchema);
+  },
   name: /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
     /*#__PURE__*/ v.stringGraphemes(1, 80),
   ]),
+  scanResult: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.string()),
+  scanStatus: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.string<
+      "clean" | "flagged" | "pending" | "unscanned" | (string & {})
+    >(),
+  ),
   slug: /*#__PURE__*/ v.string(),
   uri: /*#__PURE__*/ v.resourceUriString(),
+  verification: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.string<
+      "invalid" | "pending" | "unverified" | "verified" | (string & {})
+    >(),
+  ),
 });
 const _profileViewSchema = /*#__PURE__*/ v.object({
   $type: /*#__PURE__*/ v.optional(
@@ -34,16 +87,51 @@ const _profileViewSchema = /*#__PURE__*/ v.object({
   ),
   fileCount: /*#__PURE__*/ v.optional(/*#__PURE__*/ v.integer()),
   handle: /*#__PURE__*/ v.handleString(),
+  get labels() {
+    return /*#__PURE__*/ v.optional(
+      /*#__PURE__*/ v.array(ComAtprotoLabelDefs.labelSchema),
+    );
+  },
+  get moderation() {
+    return /*#__PURE__*/ v.optional(moderationSchema);
+  },
 });
+const _moderationSchema = /*#__PURE__*/ v.string<
+  "blur" | "hide" | "warn" | (string & {})
+>();
+const _reasonTypeSchema = /*#__PURE__*/ v.string<
+  | "copyright"
+  | "harassment"
+  | "illegal"
+  | "malware"
+  | "other"
+  | "sexual"
+  | "spam"
+  | (string & {})
+>();
 
+type collectionView$schematype = typeof _collectionViewSchema;
 type fileView$schematype = typeof _fileViewSchema;
+type moderation$schematype = typeof _moderationSchema;
 type profileView$schematype = typeof _profileViewSchema;
+type reasonType$schematype = typeof _reasonTypeSchema;
 
+export interface collectionViewSchema extends collectionView$schematype {}
 export interface fileViewSchema extends fileView$schematype {}
+export interface moderationSchema extends moderation$schematype {}
 export interface profileViewSchema extends profileView$schematype {}
+export interface reasonTypeSchema extends reasonType$schematype {}
 
+export const collectionViewSchema =
+  _collectionViewSchema as collectionViewSchema;
 export const fileViewSchema = _fileViewSchema as fileViewSchema;
+export const moderationSchema = _moderationSchema as moderationSchema;
 export const profileViewSchema = _profileViewSchema as profileViewSchema;
+export const reasonTypeSchema = _reasonTypeSchema as reasonTypeSchema;
 
+export interface CollectionView
+  extends v.InferInput<typeof collectionViewSchema> {}
 export interface FileView extends v.InferInput<typeof fileViewSchema> {}
+export type Moderation = v.InferInput<typeof moderationSchema>;
 export interface ProfileView extends v.InferInput<typeof profileViewSchema> {}
+export type ReasonType = v.InferInput<typeof reasonTypeSchema>;
@@ -0,0 +1,54 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+
+const _mainSchema = /*#__PURE__*/ v.query("dev.skywell.describeServer", {
+  params: null,
+  output: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      /**
+       * The AppView's DID, which service auth tokens are addressed to.
+       */
+      did: /*#__PURE__*/ v.didString(),
+      get methods() {
+        return /*#__PURE__*/ v.array(methodSchema);
+      },
+    }),
+  },
+});
+const _methodSchema = /*#__PURE__*/ v.object({
+  $type: /*#__PURE__*/ v.optional(
+    /*#__PURE__*/ v.literal("dev.skywell.describeServer#method"),
+  ),
+  /**
+   * What the method needs from the caller: 'none', 'optional' (a service auth JWT if they have one), 'required', or 'admin' (required, from one of the AppView's admins).
+   */
+  auth: /*#__PURE__*/ v.string<
+    "admin" | "none" | "optional" | "required" | (string & {})
+  >(),
+  nsid: /*#__PURE__*/ v.nsidString(),
+  type: /*#__PURE__*/ v.string<
+    "procedure" | "query" | "subscription" | (string & {})
+  >(),
+});
+
+type main$schematype = typeof _mainSchema;
+type method$schematype = typeof _methodSchema;
+
+export interface mainSchema extends main$schematype {}
+export interface methodSchema extends method$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+export const methodSchema = _methodSchema as methodSchema;
+
+export interface Method extends v.InferInput<typeof methodSchema> {}
+
+export interface $params {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCQueries {
+    "dev.skywell.describeServer": mainSchema;
+  }
+}
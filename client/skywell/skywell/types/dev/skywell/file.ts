@@ -7,6 +7,12 @@ const _mainSchema = /*#__PURE__*/ v.record(
   /*#__PURE__*/ v.object({
     $type: /*#__PURE__*/ v.literal("dev.skywell.file"),
     blobRef: /*#__PURE__*/ v.blob(),
+    chunks: /*#__PURE__*/ v.optional(
+      /*#__PURE__*/ v.constrain(
+        /*#__PURE__*/ v.array(/*#__PURE__*/ v.blob()),
+        [/*#__PURE__*/ v.arrayLength(2, 1000)],
+      ),
+    ),
     createdAt: /*#__PURE__*/ v.datetimeString(),
     description: /*#__PURE__*/ v.optional(
       /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
@@ -14,6 +20,11 @@ const _mainSchema = /*#__PURE__*/ v.record(
         /*#__PURE__*/ v.stringGraphemes(0, 500),
       ]),
     ),
+    hash: /*#__PURE__*/ v.optional(
+      /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
+        /*#__PURE__*/ v.stringLength(64, 64),
+      ]),
+    ),
     name: /*#__PURE__*/ v.constrain(/*#__PURE__*/ v.string(), [
       /*#__PURE__*/ v.stringGraphemes(1, 80),
     ]),
@@ -0,0 +1,34 @@
+import type {} from "@atcute/lexicons";
+import * as v from "@atcute/lexicons/validations";
+import type {} from "@atcute/lexicons/ambient";
+
+const _mainSchema = /*#__PURE__*/ v.query("dev.skywell.resolveActor", {
+  params: /*#__PURE__*/ v.object({
+    actor: /*#__PURE__*/ v.actorIdentifierString(),
+  }),
+  output: {
+    type: "lex",
+    schema: /*#__PURE__*/ v.object({
+      did: /*#__PURE__*/ v.didString(),
+      /**
+       * The account's verified handle, or 'handle.invalid' if it doesn't resolve back to the DID.
+       */
+      handle: /*#__PURE__*/ v.handleString(),
+    }),
+  },
+});
+
+type main$schematype = typeof _mainSchema;
+
+export interface mainSchema extends main$schematype {}
+
+export const mainSchema = _mainSchema as mainSchema;
+
+export interface $params extends v.InferInput<mainSchema["params"]> {}
+export interface $output extends v.InferXRPCBodyInput<mainSchema["output"]> {}
+
+declare module "@atcute/lexicons/ambient" {
+  interface XRPCQueries {
+    "dev.skywell.resolveActor": mainSchema;
+  }
+}
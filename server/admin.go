@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+	jetstream "github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/saturn-vi/skywell/api/skywell"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+// admin endpoints (dev.skywell.admin.*), so operators can act on the index without editing the database.
+// callers need a service auth JWT from one of admin.dids. every action goes in the audit log,
+// in the same transaction as the change itself where there is one
+
+var adminLogger = slog.With("component", "admin")
+
+// AuditLog is one admin action
+type AuditLog struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+	Admin     string    `gorm:"index"`
+	Action    string    // the procedure's NSID
+	Subject   string    `gorm:"index"`
+	Reason    string
+	Details   string // the procedure's input, as JSON
+}
+
+// ReservedSlug is a slug generateSlug never hands out, e.g. one that used to point at a file
+type ReservedSlug struct {
+	Key       string `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+// slugs in urls, so nothing that needs escaping
+var slugPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var errSlugInUse = errors.New("slug is in use")
+
+const (
+	adminDefaultLimit = 50
+	adminMaxLimit     = 100
+)
+
+func slugReserved(slug string, db *gorm.DB) (reserved bool, err error) {
+	var n int64
+	if err := db.Model(&ReservedSlug{}).Where("key = ?", slug).Count(&n).Error; err != nil {
+		return false, fmt.Errorf("failed to check reserved slugs: %w", err)
+	}
+	return n > 0, nil
+}
+
+// audit records an admin action
+func audit(admin syntax.DID, action string, subject string, reason *string, input any, db *gorm.DB) error {
+	details, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit details: %w", err)
+	}
+	entry := AuditLog{
+		Admin:   admin.String(),
+		Action:  action,
+		Subject: subject,
+		Details: string(details),
+	}
+	if reason != nil {
+		entry.Reason = *reason
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// the admin methods are only for admin.dids, and log as the admin component
+var adminOpts = xrpcserver.Opts{Auth: xrpcserver.AuthAdmin, Logger: adminLogger}
+
+// adminPage checks the limit and cursor parameters of the list endpoints. cursors are row ids
+func adminPage(l int, c string) (limit int, cursor uint, err error) {
+	limit = adminDefaultLimit
+	if l != 0 {
+		if l < 1 || l > adminMaxLimit {
+			return 0, 0, fmt.Errorf("parameter 'limit' must be between 1 and %d", adminMaxLimit)
+		}
+		limit = l
+	}
+	if c != "" {
+		n, err := strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid 'cursor' parameter")
+		}
+		cursor = uint(n)
+	}
+	return limit, cursor, nil
+}
+
+// adminFindFile finds a live file by at-uri or slug, taken down or not
+func adminFindFile(subject string, db *gorm.DB) (file File, slug string, httpResponse int, err error) {
+	if strings.HasPrefix(subject, "at://") {
+		if err := db.Where("uri = ?", subject).First(&file).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return file, "", 404, xrpcserver.Errorf("FileNotFound", "file not found")
+		} else if err != nil {
+			return file, "", 500, fmt.Errorf("failed to find file: %w", err)
+		}
+		fk := FileKey{}
+		if err := db.Where("file = ?", file.ID).First(&fk).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return file, "", 500, fmt.Errorf("failed to find file key: %w", err)
+		}
+		return file, fk.Key, 200, nil
+	}
+
+	fk := FileKey{}
+	if err := db.Where("key = ?", subject).First(&fk).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return file, "", 404, xrpcserver.Errorf("FileNotFound", "file not found")
+	} else if err != nil {
+		return file, "", 500, fmt.Errorf("failed to find file key: %w", err)
+	}
+	if err := db.Where("id = ?", fk.File).First(&file).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return file, "", 404, xrpcserver.Errorf("FileNotFound", "file not found")
+	} else if err != nil {
+		return file, "", 500, fmt.Errorf("failed to find file: %w", err)
+	}
+	return file, fk.Key, 200, nil
+}
+
+// setFileTakedown takes file down or restores it. taking it down also resolves its open reports,
+// since there's nothing left to do about them
+func setFileTakedown(file File, takedown bool, admin syntax.DID, tx *gorm.DB) error {
+	if err := tx.Model(&File{}).Where("id = ?", file.ID).Update("taken_down", takedown).Error; err != nil {
+		return err
+	}
+	if takedown {
+		return resolveFileReports(file.ID, admin, tx)
+	}
+	return nil
+}
+
+func initializeAdminRoutes(s *xrpcserver.Server, db *gorm.DB, client *xrpc.Client, cfg *Config, ctx context.Context) {
+	if len(cfg.Admin.DIDs) == 0 {
+		return
+	}
+
+	// returns AdminUpdateFileTakedown_Output
+	xrpcserver.Procedure(s, "dev.skywell.admin.updateFileTakedown", adminOpts, func(req *xrpcserver.Request, in skywell.AdminUpdateFileTakedown_Input) (*skywell.AdminUpdateFileTakedown_Output, int, error) {
+		if in.Subject == "" {
+			return nil, 400, fmt.Errorf("required parameter 'subject' missing")
+		}
+		file, slug, stat, err := adminFindFile(in.Subject, db)
+		if err != nil {
+			return nil, stat, err
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := setFileTakedown(file, in.Takedown, req.Caller, tx); err != nil {
+				return err
+			}
+			return audit(req.Caller, "dev.skywell.admin.updateFileTakedown", file.Uri.String(), in.Reason, in, tx)
+		})
+		if err != nil {
+			return nil, 500, fmt.Errorf("failed to update file: %w", err)
+		}
+		if in.Takedown {
+			// other files with the same blob can fetch it again
+			uncacheFile(file, db)
+		}
+		req.Logger.Info("Updated file takedown", "uri", file.Uri.String(), "slug", slug, "takedown", in.Takedown)
+		return &skywell.AdminUpdateFileTakedown_Output{Uri: file.Uri.String(), Slug: slug, Takedown: in.Takedown}, 200, nil
+	})
+
+	// returns AdminUpdateAccountTakedown_Output
+	xrpcserver.Procedure(s, "dev.skywell.admin.updateAccountTakedown", adminOpts, func(req *xrpcserver.Request, in skywell.AdminUpdateAccountTakedown_Input) (*skywell.AdminUpdateAccountTakedown_Output, int, error) {
+		did, err := syntax.ParseDID(in.Did)
+		if err != nil {
+			return nil, 400, fmt.Errorf("invalid 'did' parameter: %w", err)
+		}
+		user := User{}
+		if err := db.Where("did = ?", did.String()).First(&user).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, 404, xrpcserver.Errorf("ActorNotFound", "actor not found")
+		} else if err != nil {
+			return nil, 500, fmt.Errorf("failed to find actor: %w", err)
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("taken_down", in.Takedown).Error; err != nil {
+				return err
+			}
+			return audit(req.Caller, "dev.skywell.admin.updateAccountTakedown", did.String(), in.Reason, in, tx)
+		})
+		if err != nil {
+			return nil, 500, fmt.Errorf("failed to update actor: %w", err)
+		}
+		if in.Takedown {
+			blobRefs := []string{}
+			if err := db.Model(&File{}).Where("user_id = ?", user.ID).Distinct().Pluck("blob_ref", &blobRefs).Error; err != nil {
+				req.Logger.Error("Failed to find blobs to uncache", "did", did.String(), "error", err)
+			}
+			chunkRefs := []string{}
+			fileIDs := db.Model(&File{}).Select("id").Where("user_id = ?", user.ID)
+			if err := db.Model(&FileChunk{}).Where("file_id IN (?)", fileIDs).Distinct().Pluck("blob_ref", &chunkRefs).Error; err != nil {
+				req.Logger.Error("Failed to find chunks to uncache", "did", did.String(), "error", err)
+			}
+			blobRefs = append(blobRefs, chunkRefs...)
+			for _, c := range blobRefs {
+				blobCache.remove(c)
+			}
+		}
+		req.Logger.Info("Updated account takedown", "did", did.String(), "takedown", in.Takedown)
+		return &skywell.AdminUpdateAccountTakedown_Output{Did: did.String(), Takedown: in.Takedown}, 200, nil
+	})
+
+	// returns AdminReindexActor_Output
+	xrpcserver.Procedure(s, "dev.skywell.admin.reindexActor", adminOpts, func(req *xrpcserver.Request, in skywell.AdminReindexActor_Input) (*skywell.AdminReindexActor_Output, int, error) {
+		did, stat, err := resolveActor(in.Actor, ctx)
+		if err != nil {
+			return nil, stat, fmt.Errorf("failed to resolve 'actor' parameter: %w", err)
+		}
+		if err := updateUserProfile(did, true, db, client, ctx); err != nil {
+			return nil, 502, fmt.Errorf("failed to update profile: %w", err)
+		}
+		uris, records, err := backfillRepo(did, "", cfg, db, client, ctx)
+		if err != nil {
+			return nil, 502, fmt.Errorf("failed to backfill repo: %w", err)
+		}
+
+		// anything we have that the repo doesn't was deleted while we weren't looking
+		seen := map[string]bool{}
+		for _, u := range uris {
+			seen[u.String()] = true
+		}
+		indexed := []string{}
+		err = db.Model(&File{}).
+			Joins("JOIN users ON users.id = files.user_id").
+			Where("users.did = ?", did.String()).
+			Pluck("files.uri", &indexed).Error
+		if err != nil {
+			return nil, 500, fmt.Errorf("failed to list indexed files: %w", err)
+		}
+		collections := []string{}
+		err = db.Model(&Collection{}).
+			Joins("JOIN users ON users.id = collections.user_id").
+			Where("users.did = ?", did.String()).
+			Pluck("collections.uri", &collections).Error
+		if err != nil {
+			return nil, 500, fmt.Errorf("failed to list indexed collections: %w", err)
+		}
+		indexed = append(indexed, collections...)
+		removed := 0
+		for _, u := range indexed {
+			if seen[u] {
+				continue
+			}
+			aturi, err := syntax.ParseATURI(u)
+			if err != nil {
+				continue
+			}
+			err = updateRecord(jetstream.Event{
+				Did:  did.String(),
+				Kind: jetstream.EventKindCommit,
+				Commit: &jetstream.Commit{
+					Operation:  jetstream.CommitOperationDelete,
+					Collection: aturi.Collection().String(),
+					RKey:       aturi.RecordKey().String(),
+				},
+			}, db, client, ctx)
+			if err == nil {
+				removed++
+			}
+		}
+
+		if err := audit(req.Caller, "dev.skywell.admin.reindexActor", did.String(), in.Reason, in, db); err != nil {
+			return nil, 500, err
+		}
+		req.Logger.Info("Reindexed actor", "did", did.String(), "records", records, "failed_records", len(uris)-records, "removed", removed)
+		return &skywell.AdminReindexActor_Output{Did: did.String(), Records: int64(records), Removed: int64(removed)}, 200, nil
+	})
+
+	// returns AdminReassignSlug_Output
+	xrpcserver.Procedure(s, "dev.skywell.admin.reassignSlug", adminOpts, func(req *xrpcserver.Request, in skywell.AdminReassignSlug_Input) (*skywell.AdminReassignSlug_Output, int, error) {
+		if !slugPattern.MatchString(in.Slug) {
+			return nil, 400, xrpcserver.Errorf("InvalidSlug", "invalid slug %q", in.Slug)
+		}
+		file := File{}
+		if err := db.Where("uri = ?", in.Uri).First(&file).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, 404, xrpcserver.Errorf("FileNotFound", "file not found")
+		} else if err != nil {
+			return nil, 500, fmt.Errorf("failed to find file: %w", err)
+		}
+
+		out := skywell.AdminReassignSlug_Output{Slug: in.Slug, Uri: file.Uri.String()}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			current := FileKey{}
+			err := tx.Unscoped().Where("file = ?", file.ID).First(&current).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err == nil && current.Key != in.Slug {
+				// the old slug might be linked from somewhere, so it can't go to anyone else
+				if err := tx.Unscoped().Delete(&current).Error; err != nil {
+					return err
+				}
+				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ReservedSlug{Key: current.Key}).Error; err != nil {
+					return err
+				}
+				out.RetiredSlug = &current.Key
+			}
+
+			if taken, err := collectionHasSlug(in.Slug, tx); err != nil {
+				return err
+			} else if taken {
+				return errSlugInUse
+			}
+
+			existing := FileKey{}
+			err = tx.Unscoped().Where("key = ?", in.Slug).First(&existing).Error
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				if err := tx.Create(&FileKey{Key: in.Slug, File: file.ID}).Error; err != nil {
+					return err
+				}
+			case err != nil:
+				return err
+			case existing.File != file.ID:
+				prevID := existing.File
+				if err := tx.Unscoped().Model(&existing).Updates(map[string]any{"file": file.ID, "deleted_at": nil}).Error; err != nil {
+					return err
+				}
+				// whatever had the slug before needs a new one
+				prev := File{}
+				if err := tx.Where("id = ?", prevID).First(&prev).Error; err == nil {
+					prevUri := prev.Uri.String()
+					out.PreviousUri = &prevUri
+					if _, err := ensureFileKey(tx, prev); err != nil {
+						return err
+					}
+				} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+					return err
+				}
+			case existing.DeletedAt.Valid:
+				if err := tx.Unscoped().Model(&existing).Update("deleted_at", nil).Error; err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Where("key = ?", in.Slug).Delete(&ReservedSlug{}).Error; err != nil {
+				return err
+			}
+			return audit(req.Caller, "dev.skywell.admin.reassignSlug", in.Slug, in.Reason, in, tx)
+		})
+		if errors.Is(err, errSlugInUse) {
+			return nil, 400, xrpcserver.Errorf("SlugInUse", "slug %q belongs to a collection", in.Slug)
+		} else if err != nil {
+			return nil, 500, fmt.Errorf("failed to reassign slug: %w", err)
+		}
+		req.Logger.Info("Reassigned slug", "slug", in.Slug, "uri", out.Uri, "previous_uri", out.PreviousUri, "retired_slug", out.RetiredSlug)
+		return &out, 200, nil
+	})
+
+	// returns AdminReserveSlug_Output
+	xrpcserver.Procedure(s, "dev.skywell.admin.reserveSlug", adminOpts, func(req *xrpcserver.Request, in skywell.AdminReserveSlug_Input) (*skywell.AdminReserveSlug_Output, int, error) {
+		if !slugPattern.MatchString(in.Slug) {
+			return nil, 400, xrpcserver.Errorf("InvalidSlug", "invalid slug %q", in.Slug)
+		}
+		release := in.Release != nil && *in.Release
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if release {
+				if err := tx.Where("key = ?", in.Slug).Delete(&ReservedSlug{}).Error; err != nil {
+					return err
+				}
+			} else {
+				// deleted files get their slug back if they return, so those count as in use too
+				var n int64
+				if err := tx.Unscoped().Model(&FileKey{}).Where("key = ?", in.Slug).Count(&n).Error; err != nil {
+					return err
+				}
+				if n > 0 {
+					return errSlugInUse
+				}
+				if taken, err := collectionHasSlug(in.Slug, tx); err != nil {
+					return err
+				} else if taken {
+					return errSlugInUse
+				}
+				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ReservedSlug{Key: in.Slug}).Error; err != nil {
+					return err
+				}
+			}
+			return audit(req.Caller, "dev.skywell.admin.reserveSlug", in.Slug, in.Reason, in, tx)
+		})
+		if errors.Is(err, errSlugInUse) {
+			return nil, 400, xrpcserver.Errorf("SlugInUse", "slug %q belongs to a file (reassign it first) or a collection", in.Slug)
+		} else if err != nil {
+			return nil, 500, fmt.Errorf("failed to update slug reservation: %w", err)
+		}
+		req.Logger.Info("Updated slug reservation", "slug", in.Slug, "reserved", !release)
+		return &skywell.AdminReserveSlug_Output{Slug: in.Slug, Reserved: !release}, 200, nil
+	})
+
+	type listIngestErrorsParams struct {
+		Did    string `query:"did"`
+		Limit  int    `query:"limit"`
+		Cursor string `query:"cursor"`
+	}
+
+	// returns AdminListIngestErrors_Output
+	xrpcserver.Query(s, "dev.skywell.admin.listIngestErrors", adminOpts, func(req *xrpcserver.Request, p listIngestErrorsParams) (*skywell.AdminListIngestErrors_Output, int, error) {
+		limit, cursor, err := adminPage(p.Limit, p.Cursor)
+		if err != nil {
+			return nil, 400, err
+		}
+		query := db.Order("id DESC").Limit(limit)
+		if cursor > 0 {
+			query = query.Where("id < ?", cursor)
+		}
+		if p.Did != "" {
+			query = query.Where("did = ?", p.Did)
+		}
+		rows := []IngestError{}
+		if err := query.Find(&rows).Error; err != nil {
+			return nil, 500, fmt.Errorf("failed to list ingest errors: %w", err)
+		}
+
+		out := skywell.AdminListIngestErrors_Output{Errors: []*skywell.AdminDefs_IngestError{}}
+		for _, ie := range rows {
+			e := &skywell.AdminDefs_IngestError{
+				Id:        int64(ie.ID),
+				CreatedAt: ie.CreatedAt.UTC().Format(syntax.AtprotoDatetimeLayout),
+				Did:       ie.DID,
+				Error:     ie.Error,
+			}
+			if ie.Uri != "" {
+				e.Uri = &ie.Uri
+			}
+			if ie.Collection != "" {
+				e.Collection = &ie.Collection
+			}
+			if ie.Operation != "" {
+				e.Operation = &ie.Operation
+			}
+			out.Errors = append(out.Errors, e)
+		}
+		if len(rows) == limit {
+			c := strconv.FormatUint(uint64(rows[len(rows)-1].ID), 10)
+			out.Cursor = &c
+		}
+		return &out, 200, nil
+	})
+
+	type listAuditLogParams struct {
+		Subject string `query:"subject"`
+		Limit   int    `query:"limit"`
+		Cursor  string `query:"cursor"`
+	}
+
+	// returns AdminListAuditLog_Output
+	xrpcserver.Query(s, "dev.skywell.admin.listAuditLog", adminOpts, func(req *xrpcserver.Request, p listAuditLogParams) (*skywell.AdminListAuditLog_Output, int, error) {
+		limit, cursor, err := adminPage(p.Limit, p.Cursor)
+		if err != nil {
+			return nil, 400, err
+		}
+		query := db.Order("id DESC").Limit(limit)
+		if cursor > 0 {
+			query = query.Where("id < ?", cursor)
+		}
+		if p.Subject != "" {
+			query = query.Where("subject = ?", p.Subject)
+		}
+		rows := []AuditLog{}
+		if err := query.Find(&rows).Error; err != nil {
+			return nil, 500, fmt.Errorf("failed to list audit log: %w", err)
+		}
+
+		out := skywell.AdminListAuditLog_Output{Entries: []*skywell.AdminDefs_AuditEntry{}}
+		for _, a := range rows {
+			e := &skywell.AdminDefs_AuditEntry{
+				Id:        int64(a.ID),
+				CreatedAt: a.CreatedAt.UTC().Format(syntax.AtprotoDatetimeLayout),
+				Admin:     a.Admin,
+				Action:    a.Action,
+				Subject:   a.Subject,
+			}
+			if a.Reason != "" {
+				e.Reason = &a.Reason
+			}
+			if a.Details != "" {
+				e.Details = &a.Details
+			}
+			out.Entries = append(out.Entries, e)
+		}
+		if len(rows) == limit {
+			c := strconv.FormatUint(uint64(rows[len(rows)-1].ID), 10)
+			out.Cursor = &c
+		}
+		return &out, 200, nil
+	})
+
+	initializeReportAdminRoutes(s, db, cfg, ctx)
+
+	adminLogger.Info("Admin API enabled", "admins", len(cfg.Admin.DIDs))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/saturn-vi/skywell/api/skywell"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+const testAdminDID = "did:plc:adminadminadminadminadmi"
+
+// newTestAdminServer serves the admin methods, with every caller authenticated as testAdminDID
+func newTestAdminServer(db *gorm.DB, cfg *Config) *xrpcserver.Server {
+	cfg.Admin.DIDs = []string{testAdminDID}
+	s := xrpcserver.New(adminLogger)
+	s.Authenticate = func(r *http.Request) (syntax.DID, error) { return testAdminDID, nil }
+	s.IsAdmin = func(did syntax.DID) bool { return did == testAdminDID }
+	initializeAdminRoutes(s, db, nil, cfg, context.Background())
+	return s
+}
+
+// testAdminCall calls a procedure, decoding the output into out. xerr is the XRPC error name, if it failed
+func testAdminCall(t *testing.T, s http.Handler, nsid string, in any, out any) (status int, xerr string) {
+	t.Helper()
+	b, _ := json.Marshal(in)
+	r := httptest.NewRequest(http.MethodPost, "/xrpc/"+nsid, bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		e := struct{ Error string }{}
+		json.Unmarshal(w.Body.Bytes(), &e)
+		return w.Code, e.Error
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+		t.Fatalf("failed to decode %s output: %v", nsid, err)
+	}
+	return w.Code, ""
+}
+
+func testFileURI(rkey string) string {
+	return "at://" + testDID + "/dev.skywell.file/" + rkey
+}
+
+// testFileSlug is the file's slug, deleted or not. empty if it has none
+func testFileSlug(t *testing.T, db *gorm.DB, uri string) string {
+	t.Helper()
+	f := File{}
+	if err := db.Unscoped().Where("uri = ?", uri).First(&f).Error; err != nil {
+		t.Fatalf("failed to find %s: %v", uri, err)
+	}
+	fk := FileKey{}
+	db.Unscoped().Where("file = ?", f.ID).Limit(1).Find(&fk)
+	return fk.Key
+}
+
+func testSlugReserved(t *testing.T, db *gorm.DB, slug string) bool {
+	t.Helper()
+	reserved, err := slugReserved(slug, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reserved
+}
+
+func TestReassignSlug(t *testing.T) {
+	db, cfg := newTestDB(t)
+	useTestLexicons(t)
+	createTestUser(t, db, testDID)
+	s := newTestAdminServer(db, cfg)
+	for _, rkey := range []string{"3kaaaaaaaa000", "3kaaaaaaaa001", "3kaaaaaaaa002", "3kaaaaaaaa003"} {
+		if err := ingestTestRecord(db, "dev.skywell.file", rkey, testFileRecord(rkey)); err != nil {
+			t.Fatalf("failed to index: %v", err)
+		}
+	}
+	first, second, third, fourth := testFileURI("3kaaaaaaaa000"), testFileURI("3kaaaaaaaa001"), testFileURI("3kaaaaaaaa002"), testFileURI("3kaaaaaaaa003")
+	reassign := func(uri string, slug string) (out skywell.AdminReassignSlug_Output, status int, xerr string) {
+		t.Helper()
+		status, xerr = testAdminCall(t, s, "dev.skywell.admin.reassignSlug", skywell.AdminReassignSlug_Input{Uri: uri, Slug: slug}, &out)
+		return out, status, xerr
+	}
+
+	t.Run("new slug", func(t *testing.T) {
+		old := testFileSlug(t, db, first)
+		out, status, xerr := reassign(first, "brand-new")
+		if status != 200 {
+			t.Fatalf("gave %d %s", status, xerr)
+		}
+		if out.RetiredSlug == nil || *out.RetiredSlug != old || out.PreviousUri != nil {
+			t.Errorf("retired %v, previous %v, want retired %q and no previous file", out.RetiredSlug, out.PreviousUri, old)
+		}
+		if got := testFileSlug(t, db, first); got != "brand-new" {
+			t.Errorf("file's slug is %q", got)
+		}
+		// the old one might be linked from somewhere
+		if !testSlugReserved(t, db, old) {
+			t.Errorf("old slug %q isn't reserved", old)
+		}
+	})
+
+	t.Run("slug taken by another file", func(t *testing.T) {
+		taken := testFileSlug(t, db, second)
+		out, status, xerr := reassign(first, taken)
+		if status != 200 {
+			t.Fatalf("gave %d %s", status, xerr)
+		}
+		if out.PreviousUri == nil || *out.PreviousUri != second {
+			t.Errorf("previous file is %v, want %s", out.PreviousUri, second)
+		}
+		if got := testFileSlug(t, db, first); got != taken {
+			t.Errorf("file's slug is %q, want %q", got, taken)
+		}
+		if got := testFileSlug(t, db, second); got == "" || got == taken {
+			t.Errorf("file that lost its slug has %q, want a new one", got)
+		}
+	})
+
+	t.Run("soft-deleted key", func(t *testing.T) {
+		// the file's own slug, deleted out from under it
+		slug := testFileSlug(t, db, third)
+		if err := db.Where("key = ?", slug).Delete(&FileKey{}).Error; err != nil {
+			t.Fatal(err)
+		}
+		out, status, xerr := reassign(third, slug)
+		if status != 200 {
+			t.Fatalf("gave %d %s", status, xerr)
+		}
+		if out.RetiredSlug != nil || out.PreviousUri != nil {
+			t.Errorf("retired %v, previous %v, want neither", out.RetiredSlug, out.PreviousUri)
+		}
+		var n int64
+		db.Model(&FileKey{}).Where("key = ?", slug).Count(&n)
+		if n != 1 {
+			t.Errorf("slug %q wasn't restored", slug)
+		}
+	})
+
+	t.Run("slug of a deleted file", func(t *testing.T) {
+		slug := testFileSlug(t, db, fourth)
+		if err := deleteTestRecord(db, "dev.skywell.file", "3kaaaaaaaa003"); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+		out, status, xerr := reassign(third, slug)
+		if status != 200 {
+			t.Fatalf("gave %d %s", status, xerr)
+		}
+		// there's no file left to give a new slug to
+		if out.PreviousUri != nil {
+			t.Errorf("previous file is %s, want none", *out.PreviousUri)
+		}
+		if got := testFileSlug(t, db, third); got != slug {
+			t.Errorf("file's slug is %q, want %q", got, slug)
+		}
+	})
+
+	t.Run("reserved slug", func(t *testing.T) {
+		if err := db.Create(&ReservedSlug{Key: "held-back"}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if _, status, xerr := reassign(second, "held-back"); status != 200 {
+			t.Fatalf("gave %d %s", status, xerr)
+		}
+		if testSlugReserved(t, db, "held-back") {
+			t.Error("slug is still reserved once it's been given out")
+		}
+	})
+
+	t.Run("slug in use by a collection", func(t *testing.T) {
+		if err := db.Create(&Collection{Uri: "at://" + testDID + "/dev.skywell.collection/3kaaaaaaaa000", Slug: "a-collection"}).Error; err != nil {
+			t.Fatal(err)
+		}
+		before := testFileSlug(t, db, second)
+		if _, status, xerr := reassign(second, "a-collection"); status != 400 || xerr != "SlugInUse" {
+			t.Errorf("gave %d %s, want 400 SlugInUse", status, xerr)
+		}
+		// retiring the old slug was rolled back with the rest
+		if got := testFileSlug(t, db, second); got != before {
+			t.Errorf("file's slug is %q, want it left at %q", got, before)
+		}
+		if testSlugReserved(t, db, before) {
+			t.Errorf("old slug %q was reserved anyway", before)
+		}
+	})
+
+	t.Run("invalid slug", func(t *testing.T) {
+		if _, status, xerr := reassign(first, "not/a/slug"); status != 400 || xerr != "InvalidSlug" {
+			t.Errorf("gave %d %s, want 400 InvalidSlug", status, xerr)
+		}
+	})
+
+	t.Run("unknown file", func(t *testing.T) {
+		if _, status, xerr := reassign(testFileURI("3kaaaaaaaa999"), "whatever"); status != 404 || xerr != "FileNotFound" {
+			t.Errorf("gave %d %s, want 404 FileNotFound", status, xerr)
+		}
+	})
+
+	var n int64
+	db.Model(&AuditLog{}).Where("action = ?", "dev.skywell.admin.reassignSlug").Count(&n)
+	if n != 5 {
+		t.Errorf("%d reassignments in the audit log, want 5", n)
+	}
+}
+
+func TestReserveSlug(t *testing.T) {
+	db, cfg := newTestDB(t)
+	useTestLexicons(t)
+	createTestUser(t, db, testDID)
+	s := newTestAdminServer(db, cfg)
+	for _, rkey := range []string{"3kaaaaaaaa000", "3kaaaaaaaa001"} {
+		if err := ingestTestRecord(db, "dev.skywell.file", rkey, testFileRecord(rkey)); err != nil {
+			t.Fatalf("failed to index: %v", err)
+		}
+	}
+	live := testFileSlug(t, db, testFileURI("3kaaaaaaaa000"))
+	deleted := testFileSlug(t, db, testFileURI("3kaaaaaaaa001"))
+	if err := deleteTestRecord(db, "dev.skywell.file", "3kaaaaaaaa001"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := db.Create(&Collection{Uri: "at://" + testDID + "/dev.skywell.collection/3kaaaaaaaa000", Slug: "a-collection"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	release := true
+
+	for _, tc := range []struct {
+		name     string
+		in       skywell.AdminReserveSlug_Input
+		status   int
+		xerr     string
+		reserved bool
+	}{
+		{"free slug", skywell.AdminReserveSlug_Input{Slug: "held-back"}, 200, "", true},
+		{"reserved twice", skywell.AdminReserveSlug_Input{Slug: "held-back"}, 200, "", true},
+		{"released", skywell.AdminReserveSlug_Input{Slug: "held-back", Release: &release}, 200, "", false},
+		{"released twice", skywell.AdminReserveSlug_Input{Slug: "held-back", Release: &release}, 200, "", false},
+		{"live file's slug", skywell.AdminReserveSlug_Input{Slug: live}, 400, "SlugInUse", false},
+		// they get it back if the file comes back
+		{"deleted file's slug", skywell.AdminReserveSlug_Input{Slug: deleted}, 400, "SlugInUse", false},
+		{"collection's slug", skywell.AdminReserveSlug_Input{Slug: "a-collection"}, 400, "SlugInUse", false},
+		{"invalid slug", skywell.AdminReserveSlug_Input{Slug: "not a slug"}, 400, "InvalidSlug", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := skywell.AdminReserveSlug_Output{}
+			status, xerr := testAdminCall(t, s, "dev.skywell.admin.reserveSlug", tc.in, &out)
+			if status != tc.status || xerr != tc.xerr {
+				t.Fatalf("gave %d %q, want %d %q", status, xerr, tc.status, tc.xerr)
+			}
+			if status == 200 && (out.Slug != tc.in.Slug || out.Reserved != tc.reserved) {
+				t.Errorf("output is %+v", out)
+			}
+			if got := testSlugReserved(t, db, tc.in.Slug); got != tc.reserved {
+				t.Errorf("reserved is %v, want %v", got, tc.reserved)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/xrpc"
+	jetstream "github.com/bluesky-social/jetstream/pkg/models"
+)
+
+const defaultRelayHost = "https://relay1.us-east.bsky.network"
+
+// listRecords output, but with the record left as raw JSON
+// so it can go through updateRecord exactly like a jetstream commit
+type backfillListRecordsOutput struct {
+	Cursor  *string `json:"cursor,omitempty"`
+	Records []struct {
+		Uri   string          `json:"uri"`
+		Cid   string          `json:"cid"`
+		Value json.RawMessage `json:"value"`
+	} `json:"records"`
+}
+
+// runBackfill implements the `backfill` subcommand, which indexes
+// dev.skywell.file and dev.skywell.collection records that are already in people's repos
+func runBackfill(args []string, cfg *Config, ctx context.Context) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	all := fs.Bool("all", false, "backfill every repo the relay knows has dev.skywell.file records")
+	relay := fs.String("relay", defaultRelayHost, "relay to ask for com.atproto.sync.listReposByCollection when using -all")
+	pds := fs.String("pds", "", "fetch records from this host instead of resolving each DID's PDS (for testing against a local PDS)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: skywell [-config path] backfill [flags] [did ...]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	dids := []syntax.DID{}
+	for _, a := range fs.Args() {
+		did, err := syntax.ParseDID(a)
+		if err != nil {
+			return fmt.Errorf("invalid DID %q: %w", a, err)
+		}
+		dids = append(dids, did)
+	}
+	if !*all && len(dids) == 0 {
+		fs.Usage()
+		return fmt.Errorf("no DIDs given (pass some, or use -all)")
+	}
+
+	db, client, err := initializeDB(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	if *all {
+		listed, err := listReposWithFiles(*relay, cfg, ctx)
+		if err != nil {
+			return err
+		}
+		backfillLogger.Info("Found repos with files", "relay", *relay, "count", len(listed))
+		dids = append(dids, listed...)
+	}
+
+	failed := 0
+	total := 0
+	skipped := 0
+	for _, did := range dids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		uris, indexed, err := backfillRepo(did, *pds, cfg, db, client, ctx)
+		total += indexed
+		skipped += len(uris) - indexed
+		if err != nil {
+			backfillLogger.Error("Failed to backfill repo", "did", did.String(), "records", indexed, "failed_records", len(uris)-indexed, "error", err)
+			failed++
+			continue
+		}
+		backfillLogger.Info("Backfilled repo", "did", did.String(), "records", indexed, "failed_records", len(uris)-indexed)
+	}
+
+	backfillLogger.Info("Backfill finished", "repos", len(dids), "failed_repos", failed, "records", total, "failed_records", skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repos failed to backfill", failed, len(dids))
+	}
+	return nil
+}
+
+func listReposWithFiles(relay string, cfg *Config, ctx context.Context) (dids []syntax.DID, err error) {
+	rc := &xrpc.Client{
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		Host:      relay,
+		UserAgent: userAgent(cfg),
+	}
+	cursor := ""
+	for {
+		out, err := atproto.SyncListReposByCollection(ctx, rc, "dev.skywell.file", cursor, 1000)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list repos by collection: %w", err)
+		}
+		for _, r := range out.Repos {
+			did, err := syntax.ParseDID(r.Did)
+			if err != nil {
+				backfillLogger.Warn("Relay returned invalid DID", "did", r.Did, "error", err)
+				continue
+			}
+			dids = append(dids, did)
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Repos) == 0 {
+			return dids, nil
+		}
+		cursor = *out.Cursor
+	}
+}
+
+// the collections backfillRepo indexes. files first, so collections can show them straight away
+var backfillCollections = []string{"dev.skywell.file", "dev.skywell.collection"}
+
+// backfillRepo pages through every dev.skywell.file and dev.skywell.collection record in a repo and indexes it.
+// uris is every record the repo has (indexed or not), indexed is how many of them made it in.
+// pdsHost overrides DID resolution when set
+func backfillRepo(did syntax.DID, pdsHost string, cfg *Config, db *gorm.DB, client *xrpc.Client, ctx context.Context) (uris []syntax.ATURI, indexed int, err error) {
+	if pdsHost == "" {
+		id, err := cacheDir.LookupDID(ctx, did)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to resolve DID: %w", err)
+		}
+		pdsHost = id.PDSEndpoint()
+		if pdsHost == "" {
+			return nil, 0, fmt.Errorf("DID document has no PDS endpoint")
+		}
+	}
+	pc := &xrpc.Client{
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		Host:      pdsHost,
+		UserAgent: userAgent(cfg),
+	}
+
+	for _, collection := range backfillCollections {
+		listed, n, err := backfillCollection(did, collection, pc, db, client, ctx)
+		uris = append(uris, listed...)
+		indexed += n
+		if err != nil {
+			return uris, indexed, fmt.Errorf("failed to list records from %s: %w", pdsHost, err)
+		}
+	}
+	return uris, indexed, nil
+}
+
+// backfillCollection indexes every record in one of a repo's collections
+func backfillCollection(did syntax.DID, collection string, pc *xrpc.Client, db *gorm.DB, client *xrpc.Client, ctx context.Context) (uris []syntax.ATURI, indexed int, err error) {
+	cursor := ""
+	for {
+		params := map[string]any{
+			"repo":       did.String(),
+			"collection": collection,
+			"limit":      100,
+		}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var out backfillListRecordsOutput
+		if err := pc.LexDo(ctx, util.Query, "", "com.atproto.repo.listRecords", params, nil, &out); err != nil {
+			return uris, indexed, err
+		}
+
+		for _, rec := range out.Records {
+			uri, err := syntax.ParseATURI(rec.Uri)
+			if err != nil {
+				backfillLogger.Warn("PDS returned invalid record URI", "uri", rec.Uri, "did", did.String(), "error", err)
+				continue
+			}
+			if uri.Authority().String() != did.String() {
+				backfillLogger.Warn("PDS returned record from another repo", "uri", rec.Uri, "did", did.String())
+				continue
+			}
+			// same path as a jetstream create, so slugs and users are handled identically.
+			// a record that fails is still listed, it's in the repo even if we couldn't index it
+			uris = append(uris, uri)
+			err = updateRecord(jetstream.Event{
+				Did:  did.String(),
+				Kind: jetstream.EventKindCommit,
+				Commit: &jetstream.Commit{
+					Operation:  jetstream.CommitOperationCreate,
+					Collection: uri.Collection().String(),
+					RKey:       uri.RecordKey().String(),
+					CID:        rec.Cid,
+					Record:     rec.Value,
+				},
+			}, db, client, ctx)
+			if err == nil {
+				indexed++
+			}
+		}
+
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Records) == 0 {
+			return uris, indexed, nil
+		}
+		cursor = *out.Cursor
+	}
+}
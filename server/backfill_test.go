@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// testPDS stands in for a PDS's com.atproto.repo.listRecords, handing out records a page at a time
+type testPDS struct {
+	records  map[string][]json.RawMessage // by collection
+	pageSize int
+	// extra records from another repo, which backfill should ignore
+	foreign  int
+	requests int
+}
+
+func (p *testPDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/xrpc/com.atproto.repo.listRecords" {
+		http.NotFound(w, r)
+		return
+	}
+	p.requests++
+	q := r.URL.Query()
+	collection := q.Get("collection")
+	start := 0
+	if c := q.Get("cursor"); c != "" {
+		start, _ = strconv.Atoi(c)
+	}
+	recs := p.records[collection]
+	end := min(start+p.pageSize, len(recs))
+
+	out := backfillListRecordsOutput{}
+	for i := start; i < end; i++ {
+		out.Records = append(out.Records, struct {
+			Uri   string          `json:"uri"`
+			Cid   string          `json:"cid"`
+			Value json.RawMessage `json:"value"`
+		}{
+			Uri:   fmt.Sprintf("at://%s/%s/3kaaaaaaaa%03d", q.Get("repo"), collection, i),
+			Cid:   testCID,
+			Value: recs[i],
+		})
+	}
+	if start == 0 && collection == "dev.skywell.file" {
+		for i := 0; i < p.foreign; i++ {
+			out.Records = append(out.Records, struct {
+				Uri   string          `json:"uri"`
+				Cid   string          `json:"cid"`
+				Value json.RawMessage `json:"value"`
+			}{
+				Uri:   fmt.Sprintf("at://did:plc:someoneelse/%s/3kbbbbbbbb%03d", collection, i),
+				Cid:   testCID,
+				Value: testFileRecord("foreign"),
+			})
+		}
+	}
+	if end < len(recs) {
+		c := strconv.Itoa(end)
+		out.Cursor = &c
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func TestBackfillRepo(t *testing.T) {
+	db, cfg := newTestDB(t)
+	useTestLexicons(t)
+	createTestUser(t, db, testDID)
+
+	files := []json.RawMessage{}
+	for i := range 5 {
+		files = append(files, testFileRecord(fmt.Sprintf("file %d", i)))
+	}
+	// doesn't match the lexicon, so it's listed but not indexed
+	files = append(files, json.RawMessage(`{"$type":"dev.skywell.file","name":"","createdAt":"2026-01-01T00:00:00Z"}`))
+	collection, _ := json.Marshal(map[string]any{
+		"$type":     "dev.skywell.collection",
+		"name":      "some files",
+		"createdAt": "2026-01-01T00:00:00Z",
+		"files":     []any{},
+	})
+
+	pds := &testPDS{
+		records: map[string][]json.RawMessage{
+			"dev.skywell.file":       files,
+			"dev.skywell.collection": {collection},
+		},
+		pageSize: 2,
+		foreign:  1,
+	}
+	srv := httptest.NewServer(pds)
+	defer srv.Close()
+
+	uris, indexed, err := backfillRepo(syntax.DID(testDID), srv.URL, cfg, db, nil, context.Background())
+	if err != nil {
+		t.Fatalf("backfillRepo: %v", err)
+	}
+	if len(uris) != 7 {
+		t.Errorf("listed %d records, want 7 (6 files and a collection)", len(uris))
+	}
+	if indexed != 6 {
+		t.Errorf("indexed %d records, want 6", indexed)
+	}
+	// 3 pages of files and 1 of collections
+	if pds.requests != 4 {
+		t.Errorf("made %d listRecords requests, want 4", pds.requests)
+	}
+
+	var n int64
+	db.Model(&File{}).Count(&n)
+	if n != 5 {
+		t.Errorf("%d files in the database, want 5", n)
+	}
+	db.Model(&Collection{}).Count(&n)
+	if n != 1 {
+		t.Errorf("%d collections in the database, want 1", n)
+	}
+	db.Model(&IngestError{}).Count(&n)
+	if n != 1 {
+		t.Errorf("%d ingest errors, want 1", n)
+	}
+
+	// running it again finds the same records, which are already indexed
+	_, indexed, err = backfillRepo(syntax.DID(testDID), srv.URL, cfg, db, nil, context.Background())
+	if err != nil {
+		t.Fatalf("backfillRepo again: %v", err)
+	}
+	if indexed != 6 {
+		t.Errorf("indexed %d records the second time, want 6", indexed)
+	}
+	db.Model(&File{}).Count(&n)
+	if n != 5 {
+		t.Errorf("%d files in the database after the second backfill, want 5", n)
+	}
+}
+
+func TestBackfillRepoPDSError(t *testing.T) {
+	db, cfg := newTestDB(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		w.Write([]byte(`{"error":"RepoNotFound","message":"Could not find repo"}`))
+	}))
+	defer srv.Close()
+
+	if _, _, err := backfillRepo(syntax.DID(testDID), srv.URL, cfg, db, nil, context.Background()); err == nil {
+		t.Fatal("backfillRepo succeeded against a PDS that doesn't have the repo")
+	}
+}
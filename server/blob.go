@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// blobs can be big, so there's no overall timeout, only one for the PDS to start answering
+var blobClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = 30 * time.Second
+		return t
+	}(),
+}
+
+// the slug can be pointed at a new version of the file, so don't let it be cached for too long
+const blobCacheControl = "public, max-age=300"
+
+// byteRange is an inclusive range of bytes, like in a Range header
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+// parseRange handles single range requests. ok is false when the header should be ignored
+// (missing, malformed, or more than one range), and err is set when the range can't be satisfied
+func parseRange(header string, size int64) (br byteRange, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return br, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return br, false, nil
+	}
+
+	if first == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return br, false, nil
+		}
+		if n == 0 || size == 0 {
+			return br, true, errors.New("unsatisfiable range")
+		}
+		return byteRange{max(size-n, 0), size - 1}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return br, false, nil
+	}
+	if start >= size {
+		return br, true, errors.New("unsatisfiable range")
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return br, false, nil
+		}
+		end = min(end, size-1)
+	}
+	return byteRange{start, end}, true, nil
+}
+
+// etagMatches checks an If-None-Match or If-Range value against etag
+func etagMatches(header string, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func initializeBlobRoutes(db *gorm.DB, cfg *Config, ctx context.Context) {
+	// returns the file's blob (or its chunks put back together), from the cache or straight from the owner's PDS
+	http.HandleFunc("GET /blob/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Context().Value(requestIDKey).(string)
+		logger := httpLogger.With("request_id", requestID)
+
+		slug := r.PathValue("slug")
+		logger.Debug("Received request", "endpoint", "/blob", "slug", slug, "remote_addr", remoteAddr(r))
+		fi, u, stat, err := fileBySlug(slug, db, cfg)
+		if err != nil {
+			if stat == 404 {
+				logger.Debug("File not found", "slug", slug, "error", err)
+				http.Error(w, "No matching file found", 404)
+				return
+			}
+			logger.Error("Failed to find file", "slug", slug, "error", err)
+			http.Error(w, "Internal Server Error (file lookup)", stat)
+			return
+		}
+		if fi.ScanStatus == scanFlagged {
+			// even when flagged files are only marked, we're not handing out malware from our own origin
+			logger.Info("Refused to serve flagged file", "slug", slug, "file_id", fi.ID, "scan_result", fi.ScanResult)
+			http.Error(w, "File was flagged by the malware scanner", 403)
+			return
+		}
+
+		etag := `"` + fi.BlobRef.String() + `"`
+		if fi.Hash != "" {
+			// chunked files go by what they are as a whole
+			etag = `"` + fi.Hash + `"`
+		}
+		mimeType := fi.MimeType
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		h := w.Header()
+		// only set once we know we're sending the blob, so errors don't look like downloads
+		setBlobHeaders := func() {
+			h.Set("ETag", etag)
+			h.Set("Cache-Control", blobCacheControl)
+			h.Set("Accept-Ranges", "bytes")
+			h.Set("Content-Type", mimeType)
+			h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name}))
+			// it's someone else's content on our origin, so browsers shouldn't run or reinterpret it
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("Content-Security-Policy", "sandbox")
+		}
+
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+			h.Set("ETag", etag)
+			h.Set("Cache-Control", blobCacheControl)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if fi.Hash != "" {
+			serveChunkedFile(w, r, fi, u, etag, setBlobHeaders, logger, db, cfg, ctx)
+			return
+		}
+
+		if f := blobCache.open(fi.BlobRef.String()); f != nil {
+			defer f.Close()
+			setBlobHeaders()
+			// ServeContent does ranges, If-Range and HEAD for us
+			http.ServeContent(w, r, "", time.Time{}, f)
+			logger.Debug("Served blob from cache", "cid", fi.BlobRef.String(), "slug", slug)
+			return
+		}
+
+		br, partial, err := parseRange(r.Header.Get("Range"), fi.Size)
+		if ir := r.Header.Get("If-Range"); ir != "" && !etagMatches(ir, etag) {
+			partial, err = false, nil // the client's copy is stale, send the whole thing
+		}
+		if err != nil {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size))
+			http.Error(w, "Requested range not satisfiable", 416)
+			return
+		}
+
+		if r.Method == http.MethodHead {
+			setBlobHeaders()
+			if partial {
+				h.Set("Content-Range", br.contentRange(fi.Size))
+				h.Set("Content-Length", strconv.FormatInt(br.length(), 10))
+				w.WriteHeader(http.StatusPartialContent)
+				return
+			}
+			h.Set("Content-Length", strconv.FormatInt(fi.Size, 10))
+			return
+		}
+
+		id, err := cacheDir.LookupDID(ctx, u.DID)
+		if err != nil {
+			logger.Error("Failed to resolve DID", "did", u.DID.String(), "slug", slug, "error", err)
+			http.Error(w, "Failed to find the file's PDS", 502)
+			return
+		}
+		pds := id.PDSEndpoint()
+		if pds == "" {
+			logger.Warn("DID document has no PDS endpoint", "did", u.DID.String(), "slug", slug)
+			http.Error(w, "Failed to find the file's PDS", 502)
+			return
+		}
+
+		res, err := fetchBlob(pds, u.DID.String(), fi.BlobRef.String(), br, partial, cfg, r.Context())
+		if err != nil {
+			logger.Error("Failed to fetch blob", "pds", pds, "did", u.DID.String(), "cid", fi.BlobRef.String(), "slug", slug, "error", err)
+			http.Error(w, "Failed to fetch blob from PDS", 502)
+			return
+		}
+		defer res.Body.Close()
+
+		switch res.StatusCode {
+		case http.StatusOK, http.StatusPartialContent:
+		case http.StatusNotFound, http.StatusBadRequest:
+			// PDSes answer 400 BlobNotFound for blobs they don't have
+			logger.Debug("PDS doesn't have blob", "pds", pds, "cid", fi.BlobRef.String(), "slug", slug, "status_code", res.StatusCode)
+			http.Error(w, "Blob not found on PDS", 404)
+			return
+		default:
+			logger.Error("PDS returned an error for blob", "pds", pds, "cid", fi.BlobRef.String(), "slug", slug, "status_code", res.StatusCode)
+			http.Error(w, "Failed to fetch blob from PDS", 502)
+			return
+		}
+
+		body := io.Reader(res.Body)
+		if partial && (res.StatusCode != http.StatusPartialContent || res.Header.Get("Content-Range") != br.contentRange(fi.Size)) {
+			// the PDS ignored the range (or answered a different one), so cut it out ourselves
+			if res.StatusCode == http.StatusPartialContent {
+				logger.Error("PDS answered a different range", "pds", pds, "cid", fi.BlobRef.String(), "requested", br.contentRange(fi.Size), "content_range", res.Header.Get("Content-Range"))
+				http.Error(w, "Failed to fetch blob from PDS", 502)
+				return
+			}
+			if _, err := io.CopyN(io.Discard, res.Body, br.start); err != nil {
+				logger.Error("Failed to skip to range start", "cid", fi.BlobRef.String(), "start", br.start, "error", err)
+				http.Error(w, "Failed to fetch blob from PDS", 502)
+				return
+			}
+			body = io.LimitReader(res.Body, br.length())
+		}
+
+		// whole blobs get cached on the way through, ranges get fetched again in the background
+		var cw *blobCacheWriter
+		if partial {
+			fillBlobCache(pds, u.DID.String(), fi.BlobRef.String(), fi.Size, cfg, ctx)
+		} else if blobCache.fits(fi.Size) {
+			if cw, err = blobCache.create(fi.BlobRef.String()); err != nil {
+				logger.Warn("Failed to start caching blob", "cid", fi.BlobRef.String(), "error", err)
+			} else {
+				body = io.TeeReader(body, cw)
+			}
+		}
+
+		setBlobHeaders()
+		if partial {
+			h.Set("Content-Range", br.contentRange(fi.Size))
+			h.Set("Content-Length", strconv.FormatInt(br.length(), 10))
+			w.WriteHeader(http.StatusPartialContent)
+		} else if res.ContentLength >= 0 {
+			h.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+		}
+
+		n, err := io.Copy(w, body)
+		if err != nil {
+			if cw != nil {
+				cw.abort()
+			}
+			// headers are already out, all we can do is cut the response short
+			logger.Warn("Failed to stream blob", "cid", fi.BlobRef.String(), "slug", slug, "bytes_written", n, "error", err)
+			return
+		}
+		if cw != nil {
+			if err := cw.commit(); err != nil {
+				logger.Warn("Failed to cache blob", "cid", fi.BlobRef.String(), "slug", slug, "error", err)
+			}
+		}
+		logger.Debug("Streamed blob", "cid", fi.BlobRef.String(), "slug", slug, "bytes_written", n, "partial", partial)
+	})
+}
+
+// fetchBlob asks the PDS for a blob, passing the range along in case it supports them
+func fetchBlob(pds string, did string, cid string, br byteRange, partial bool, cfg *Config, ctx context.Context) (*http.Response, error) {
+	u := strings.TrimRight(pds, "/") + "/xrpc/com.atproto.sync.getBlob?" + url.Values{
+		"did": {did},
+		"cid": {cid},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	if partial {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", br.start, br.end))
+	}
+	return blobClient.Do(req)
+}
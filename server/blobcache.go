@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+var blobCacheLogger = slog.With("component", "blobcache")
+
+// blobCache is nil when the cache is disabled, every method is fine to call on nil
+var blobCache *diskBlobCache
+
+// diskBlobCache keeps blobs on disk as <dir>/<cid>.
+// blobs are only added once their contents hash to their CID,
+// and the least recently used ones go once the total passes maxBytes.
+// file mtimes double as the last use time, so the order survives restarts
+type diskBlobCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List // of *blobCacheEntry, most recently used at the front
+	entries map[string]*list.Element
+	size    int64
+}
+
+type blobCacheEntry struct {
+	cid  string
+	size int64
+}
+
+const blobCacheTempPrefix = "tmp-"
+
+func openBlobCache(dir string, maxBytes int64) (*diskBlobCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	bc := &diskBlobCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		cid   string
+		size  int64
+		mtime time.Time
+	}
+	found := []existing{}
+	for _, de := range des {
+		if strings.HasPrefix(de.Name(), blobCacheTempPrefix) {
+			// left over from a write that never finished
+			os.Remove(filepath.Join(dir, de.Name()))
+			continue
+		}
+		info, err := de.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if _, err := cid.Decode(de.Name()); err != nil {
+			continue
+		}
+		found = append(found, existing{de.Name(), info.Size(), info.ModTime()})
+	}
+	slices.SortFunc(found, func(a, b existing) int { return b.mtime.Compare(a.mtime) })
+	for _, e := range found {
+		bc.entries[e.cid] = bc.lru.PushBack(&blobCacheEntry{e.cid, e.size})
+		bc.size += e.size
+	}
+	bc.evict()
+
+	blobCacheLogger.Info("Opened blob cache", "dir", dir, "blobs", bc.lru.Len(), "bytes", bc.size, "max_bytes", maxBytes)
+	return bc, nil
+}
+
+func (bc *diskBlobCache) path(c string) string {
+	return filepath.Join(bc.dir, c)
+}
+
+// open returns the cached blob, or nil if it isn't cached
+func (bc *diskBlobCache) open(c string) *os.File {
+	if bc == nil {
+		return nil
+	}
+	bc.mu.Lock()
+	el, ok := bc.entries[c]
+	if ok {
+		bc.lru.MoveToFront(el)
+	}
+	bc.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	f, err := os.Open(bc.path(c))
+	if err != nil {
+		// someone deleted it behind our back
+		blobCacheLogger.Warn("Failed to open cached blob", "cid", c, "error", err)
+		bc.remove(c)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(bc.path(c), now, now)
+	return f
+}
+
+// fits reports whether a blob of size bytes is worth caching at all
+func (bc *diskBlobCache) fits(size int64) bool {
+	return bc != nil && size <= bc.maxBytes
+}
+
+// create starts writing a blob into the cache. nothing is visible until commit
+func (bc *diskBlobCache) create(c string) (*blobCacheWriter, error) {
+	if bc == nil {
+		return nil, errors.New("blob cache is disabled")
+	}
+	parsed, digest, err := blobDigest(c)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(bc.dir, blobCacheTempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &blobCacheWriter{
+		bc:     bc,
+		cid:    parsed.String(),
+		digest: digest,
+		f:      f,
+		h:      sha256.New(),
+	}, nil
+}
+
+// blobDigest returns the sha256 digest a blob's contents should have
+func blobDigest(c string) (parsed cid.Cid, digest []byte, err error) {
+	parsed, err = cid.Decode(c)
+	if err != nil {
+		return parsed, nil, fmt.Errorf("invalid CID: %w", err)
+	}
+	mh, err := multihash.Decode(parsed.Hash())
+	if err != nil {
+		return parsed, nil, fmt.Errorf("invalid multihash: %w", err)
+	}
+	// atproto blobs are always sha2-256, anything else we can't check
+	if mh.Code != multihash.SHA2_256 {
+		return parsed, nil, fmt.Errorf("unsupported hash function %s", multihash.Codes[mh.Code])
+	}
+	return parsed, mh.Digest, nil
+}
+
+// remove drops a blob from the cache
+func (bc *diskBlobCache) remove(c string) {
+	if bc == nil {
+		return
+	}
+	bc.mu.Lock()
+	if el, ok := bc.entries[c]; ok {
+		bc.size -= el.Value.(*blobCacheEntry).size
+		bc.lru.Remove(el)
+		delete(bc.entries, c)
+	}
+	bc.mu.Unlock()
+	if err := os.Remove(bc.path(c)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		blobCacheLogger.Error("Failed to remove cached blob", "cid", c, "error", err)
+	}
+}
+
+// evict removes least recently used blobs until we're under budget
+func (bc *diskBlobCache) evict() {
+	bc.mu.Lock()
+	victims := []string{}
+	for bc.size > bc.maxBytes && bc.lru.Len() > 0 {
+		el := bc.lru.Back()
+		e := el.Value.(*blobCacheEntry)
+		bc.size -= e.size
+		bc.lru.Remove(el)
+		delete(bc.entries, e.cid)
+		victims = append(victims, e.cid)
+	}
+	bc.mu.Unlock()
+
+	for _, c := range victims {
+		if err := os.Remove(bc.path(c)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			blobCacheLogger.Error("Failed to evict cached blob", "cid", c, "error", err)
+			continue
+		}
+		blobCacheLogger.Debug("Evicted cached blob", "cid", c)
+	}
+}
+
+type blobCacheWriter struct {
+	bc     *diskBlobCache
+	cid    string
+	digest []byte
+	f      *os.File
+	h      hash.Hash
+	n      int64
+	err    error
+}
+
+// Write never fails, so that a full disk doesn't break whatever is being teed into the cache.
+// the first error is kept and returned by commit instead
+func (w *blobCacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	n, err := w.f.Write(p)
+	w.h.Write(p[:n])
+	w.n += int64(n)
+	w.err = err
+	return len(p), nil
+}
+
+// commit adds the blob to the cache if its contents match the CID
+func (w *blobCacheWriter) commit() error {
+	if w.err != nil {
+		w.abort()
+		return w.err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if !bytes.Equal(w.h.Sum(nil), w.digest) {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("contents don't match CID %s", w.cid)
+	}
+	if !w.bc.fits(w.n) {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("blob is bigger than the whole cache (%d bytes)", w.n)
+	}
+	if err := os.Rename(w.f.Name(), w.bc.path(w.cid)); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+
+	w.bc.mu.Lock()
+	if el, ok := w.bc.entries[w.cid]; ok {
+		// someone else cached it at the same time, same bytes either way
+		w.bc.size -= el.Value.(*blobCacheEntry).size
+		w.bc.lru.Remove(el)
+	}
+	w.bc.entries[w.cid] = w.bc.lru.PushFront(&blobCacheEntry{w.cid, w.n})
+	w.bc.size += w.n
+	w.bc.mu.Unlock()
+
+	w.bc.evict()
+	blobCacheLogger.Debug("Cached blob", "cid", w.cid, "size", w.n)
+	return nil
+}
+
+// abort throws away whatever was written
+func (w *blobCacheWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// fillBlobCache downloads a whole blob into the cache in the background,
+// for when a request we answered didn't give us the whole thing (e.g. a range)
+var blobCacheFills sync.Map
+
+func fillBlobCache(pds string, did string, c string, size int64, cfg *Config, ctx context.Context) {
+	if !blobCache.fits(size) {
+		return
+	}
+	if _, loaded := blobCacheFills.LoadOrStore(c, true); loaded {
+		return
+	}
+	go func() {
+		defer blobCacheFills.Delete(c)
+
+		w, err := blobCache.create(c)
+		if err != nil {
+			blobCacheLogger.Warn("Failed to start caching blob", "cid", c, "error", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+		defer cancel()
+		res, err := fetchBlob(pds, did, c, byteRange{}, false, cfg, ctx)
+		if err != nil {
+			w.abort()
+			blobCacheLogger.Warn("Failed to fetch blob for cache", "pds", pds, "cid", c, "error", err)
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			w.abort()
+			blobCacheLogger.Warn("PDS returned an error for blob", "pds", pds, "cid", c, "status_code", res.StatusCode)
+			return
+		}
+		if _, err := io.Copy(w, io.LimitReader(res.Body, blobCache.maxBytes+1)); err != nil {
+			w.abort()
+			blobCacheLogger.Warn("Failed to download blob for cache", "pds", pds, "cid", c, "error", err)
+			return
+		}
+		if err := w.commit(); err != nil {
+			blobCacheLogger.Warn("Failed to cache blob", "pds", pds, "cid", c, "error", err)
+		}
+	}()
+}
+
+// releaseBlob drops a blob from the cache once no live file (or chunk of one) points at it anymore.
+// the same blob can be shared by several records, even across accounts
+func releaseBlob(c string, db *gorm.DB) {
+	if blobCache == nil || c == "" {
+		return
+	}
+	var n int64
+	if err := db.Model(&File{}).Where("blob_ref = ?", c).Count(&n).Error; err != nil {
+		blobCacheLogger.Error("Failed to count blob references", "cid", c, "error", err)
+		return
+	}
+	if n > 0 {
+		return
+	}
+	if err := db.Model(&FileChunk{}).Where("blob_ref = ?", c).Count(&n).Error; err != nil {
+		blobCacheLogger.Error("Failed to count blob references", "cid", c, "error", err)
+		return
+	}
+	if n > 0 {
+		return
+	}
+	blobCache.remove(c)
+}
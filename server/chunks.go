@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/ipfs/go-cid"
+	"github.com/saturn-vi/skywell/api/skywell"
+)
+
+// files too big for one blob are split across several, listed in order in the record's chunks.
+// the first chunk is also the record's blobRef, so clients that don't know about chunks still get
+// something, and the record's hash covers the whole thing so we can tell when it's put back together right
+
+// FileChunk is one of the blobs a chunked file is made of, in the record's order
+type FileChunk struct {
+	FileID   uint       `gorm:"primaryKey;autoIncrement:false"`
+	Position int        `gorm:"primaryKey;autoIncrement:false"`
+	BlobRef  syntax.CID `gorm:"index"`
+	MimeType string
+	Size     int64
+}
+
+var (
+	errChunkNotFound = errors.New("PDS doesn't have chunk")
+	errHashMismatch  = errors.New("file doesn't match its hash")
+)
+
+// parseChunks checks a file record's chunks against the rest of it.
+// hash is empty when the file is a single blob
+func parseChunks(r *skywell.File) (chunks []FileChunk, hash string, err error) {
+	if len(r.Chunks) == 0 {
+		// a hash on its own doesn't mean anything, the blob's CID already covers it
+		return nil, "", nil
+	}
+	if r.Hash == nil {
+		return nil, "", errors.New("chunked file has no hash")
+	}
+	hash = *r.Hash
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size || hex.EncodeToString(b) != hash {
+		return nil, "", errors.New("hash isn't a lowercase hex sha256")
+	}
+	for i, b := range r.Chunks {
+		if b == nil {
+			return nil, "", fmt.Errorf("chunk %d has no blob", i)
+		}
+		c, err := syntax.ParseCID(b.Ref.String())
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid CID for chunk %d: %w", i, err)
+		}
+		if b.Size < 0 {
+			return nil, "", fmt.Errorf("chunk %d has a negative size", i)
+		}
+		chunks = append(chunks, FileChunk{Position: i, BlobRef: c, MimeType: b.MimeType, Size: b.Size})
+	}
+	if r.BlobRef == nil || chunks[0].BlobRef.String() != r.BlobRef.Ref.String() {
+		return nil, "", errors.New("first chunk isn't the file's blobRef")
+	}
+	return chunks, hash, nil
+}
+
+// replaceFileChunks swaps a file's chunks for new ones, returning the blobs it used to have
+func replaceFileChunks(fileID uint, chunks []FileChunk, db *gorm.DB) (old []string, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&FileChunk{}).Where("file_id = ?", fileID).Pluck("blob_ref", &old).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", fileID).Delete(&FileChunk{}).Error; err != nil {
+			return err
+		}
+		if len(chunks) == 0 {
+			return nil
+		}
+		for i := range chunks {
+			chunks[i].FileID = fileID
+		}
+		return tx.Create(&chunks).Error
+	})
+	return old, err
+}
+
+// fileChunks gets a file's chunks in order
+func fileChunks(fileID uint, db *gorm.DB) (chunks []FileChunk, err error) {
+	err = db.Where("file_id = ?", fileID).Order("position").Find(&chunks).Error
+	return chunks, err
+}
+
+// sameChunks is whether a and b are the same blobs in the same order
+func sameChunks(a, b []FileChunk) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].BlobRef != b[i].BlobRef || a[i].Size != b[i].Size {
+			return false
+		}
+	}
+	return true
+}
+
+// markHashVerified records that f's chunks put back together into its hash,
+// unless the record has changed since f was read
+func markHashVerified(f File, db *gorm.DB) error {
+	return db.Model(&File{}).Where("id = ? AND cid = ?", f.ID, f.Cid.String()).Update("hash_verified", true).Error
+}
+
+// chunksSize is the size of the file the chunks make up
+func chunksSize(chunks []FileChunk) (size int64) {
+	for _, c := range chunks {
+		size += c.Size
+	}
+	return size
+}
+
+// uncacheFile drops every blob of f from the cache, for when it shouldn't be served anymore
+func uncacheFile(f File, db *gorm.DB) {
+	blobCache.remove(f.BlobRef.String())
+	if f.Hash == "" || blobCache == nil {
+		return
+	}
+	blobRefs := []string{}
+	if err := db.Model(&FileChunk{}).Where("file_id = ?", f.ID).Pluck("blob_ref", &blobRefs).Error; err != nil {
+		blobCacheLogger.Error("Failed to find chunks to uncache", "file_id", f.ID, "error", err)
+		return
+	}
+	for _, c := range blobRefs {
+		blobCache.remove(c)
+	}
+}
+
+// chunkFileViews fills in chunks on the fileviews of chunked files
+func chunkFileViews(fileviews []*skywell.Defs_FileView, db *gorm.DB) error {
+	byUri := map[string][]*skywell.Defs_FileView{}
+	for _, fv := range fileviews {
+		if fv.Hash != nil {
+			byUri[fv.Uri] = append(byUri[fv.Uri], fv)
+		}
+	}
+	if len(byUri) == 0 {
+		return nil
+	}
+	uris := make([]string, 0, len(byUri))
+	for u := range byUri {
+		uris = append(uris, u)
+	}
+
+	rows := []struct {
+		Uri      string
+		BlobRef  string
+		MimeType string
+		Size     int64
+	}{}
+	err := db.Model(&FileChunk{}).
+		Select("files.uri, file_chunks.blob_ref, file_chunks.mime_type, file_chunks.size").
+		Joins("JOIN files ON files.id = file_chunks.file_id").
+		Where("files.uri IN ? AND files.deleted_at IS NULL", uris).
+		Order("file_chunks.file_id, file_chunks.position").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		c, err := cid.Decode(row.BlobRef)
+		if err != nil {
+			return fmt.Errorf("failed to decode chunk CID: %w", err)
+		}
+		for _, fv := range byUri[row.Uri] {
+			fv.Chunks = append(fv.Chunks, &util.LexBlob{
+				Ref:      util.LexLink(c),
+				MimeType: row.MimeType,
+				Size:     row.Size,
+			})
+		}
+	}
+	return nil
+}
+
+// chunkSource fetches a chunked file's blobs from the cache, or the owner's PDS when they aren't there.
+// the PDS is only looked up once something needs it
+type chunkSource struct {
+	did syntax.DID
+	pds string
+	cfg *Config
+	// ctx is for the background cache fills, fetchCtx for what we're streaming right now
+	ctx      context.Context
+	fetchCtx context.Context
+}
+
+func (s *chunkSource) resolvePDS() (string, error) {
+	if s.pds != "" {
+		return s.pds, nil
+	}
+	id, err := cacheDir.LookupDID(s.ctx, s.did)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve DID: %w", err)
+	}
+	if id.PDSEndpoint() == "" {
+		return "", errors.New("DID document has no PDS endpoint")
+	}
+	s.pds = id.PDSEndpoint()
+	return s.pds, nil
+}
+
+// copyChunk writes br of chunk c to w. whole chunks are cached on the way through,
+// like whole blobs are in the blob route, and parts get fetched again in the background
+func (s *chunkSource) copyChunk(w io.Writer, c FileChunk, br byteRange) (n int64, err error) {
+	if f := blobCache.open(c.BlobRef.String()); f != nil {
+		defer f.Close()
+		if _, err := f.Seek(br.start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return io.CopyN(w, f, br.length())
+	}
+
+	pds, err := s.resolvePDS()
+	if err != nil {
+		return 0, err
+	}
+	whole := br.start == 0 && br.end == c.Size-1
+	res, err := fetchBlob(pds, s.did.String(), c.BlobRef.String(), br, !whole, s.cfg, s.fetchCtx)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound, http.StatusBadRequest:
+		return 0, fmt.Errorf("%w %s", errChunkNotFound, c.BlobRef.String())
+	default:
+		return 0, fmt.Errorf("PDS returned status %d for %s", res.StatusCode, c.BlobRef.String())
+	}
+
+	if !whole {
+		fillBlobCache(pds, s.did.String(), c.BlobRef.String(), c.Size, s.cfg, s.ctx)
+		if res.StatusCode != http.StatusPartialContent || res.Header.Get("Content-Range") != br.contentRange(c.Size) {
+			if res.StatusCode == http.StatusPartialContent {
+				return 0, fmt.Errorf("PDS answered a different range (%s) for %s", res.Header.Get("Content-Range"), c.BlobRef.String())
+			}
+			if _, err := io.CopyN(io.Discard, res.Body, br.start); err != nil {
+				return 0, fmt.Errorf("failed to skip to range start: %w", err)
+			}
+		}
+		return io.CopyN(w, res.Body, br.length())
+	}
+
+	body := io.Reader(res.Body)
+	var cw *blobCacheWriter
+	if blobCache.fits(c.Size) {
+		if cw, err = blobCache.create(c.BlobRef.String()); err != nil {
+			blobCacheLogger.Warn("Failed to start caching blob", "cid", c.BlobRef.String(), "error", err)
+			cw = nil
+		} else {
+			body = io.TeeReader(body, cw)
+		}
+	}
+	n, err = io.CopyN(w, body, c.Size)
+	if cw != nil {
+		if err != nil {
+			cw.abort()
+		} else if err := cw.commit(); err != nil {
+			blobCacheLogger.Warn("Failed to cache blob", "cid", c.BlobRef.String(), "error", err)
+		}
+	}
+	return n, err
+}
+
+// copyChunks writes br of the file made up of chunks to w
+func copyChunks(w io.Writer, chunks []FileChunk, br byteRange, src *chunkSource) (n int64, err error) {
+	var off int64
+	for _, c := range chunks {
+		// the part of br inside this chunk, relative to the chunk
+		cr := byteRange{max(br.start, off) - off, min(br.end, off+c.Size-1) - off}
+		off += c.Size
+		if cr.end < cr.start {
+			continue
+		}
+		m, err := src.copyChunk(w, c, cr)
+		n += m
+		if err != nil {
+			return n, fmt.Errorf("chunk %d: %w", c.Position, err)
+		}
+		if off > br.end {
+			break
+		}
+	}
+	return n, nil
+}
+
+// copyChunkedFile writes all of f to w, holding back the last byte until it's matched the record's hash,
+// so a file that doesn't put back together right never arrives complete
+func copyChunkedFile(w io.Writer, f File, chunks []FileChunk, src *chunkSource) (n int64, err error) {
+	h := sha256.New()
+	hb := &holdBackWriter{w: w}
+	n, err = copyChunks(io.MultiWriter(h, hb), chunks, byteRange{0, chunksSize(chunks) - 1}, src)
+	if err != nil {
+		return n, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != f.Hash {
+		return n, fmt.Errorf("%w (got %s)", errHashMismatch, got)
+	}
+	return n, hb.flush()
+}
+
+// holdBackWriter passes everything on to w except the last byte, which waits for flush
+type holdBackWriter struct {
+	w    io.Writer
+	last []byte
+}
+
+func (hb *holdBackWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := hb.flush(); err != nil {
+		return 0, err
+	}
+	if len(p) > 1 {
+		if _, err := hb.w.Write(p[:len(p)-1]); err != nil {
+			return 0, err
+		}
+	}
+	hb.last = append(hb.last, p[len(p)-1])
+	return len(p), nil
+}
+
+func (hb *holdBackWriter) flush() error {
+	if len(hb.last) == 0 {
+		return nil
+	}
+	_, err := hb.w.Write(hb.last)
+	hb.last = hb.last[:0]
+	return err
+}
+
+// lazyHeaderWriter only sends the headers once there's a body to go with them,
+// so a chunk that can't be fetched up front still gets a proper error response
+type lazyHeaderWriter struct {
+	w           http.ResponseWriter
+	writeHeader func()
+	wrote       bool
+}
+
+func (lw *lazyHeaderWriter) Write(p []byte) (int, error) {
+	lw.sendHeader()
+	return lw.w.Write(p)
+}
+
+func (lw *lazyHeaderWriter) sendHeader() {
+	if !lw.wrote {
+		lw.wrote = true
+		lw.writeHeader()
+	}
+}
+
+// serveChunkedFile is the blob route for chunked files, streaming the chunks as one file
+func serveChunkedFile(w http.ResponseWriter, r *http.Request, fi File, u User, etag string, setBlobHeaders func(), logger *slog.Logger, db *gorm.DB, cfg *Config, ctx context.Context) {
+	slug := r.PathValue("slug")
+	chunks, err := fileChunks(fi.ID, db)
+	if err != nil {
+		logger.Error("Failed to get file chunks", "file_id", fi.ID, "slug", slug, "error", err)
+		http.Error(w, "Internal Server Error (chunk lookup)", 500)
+		return
+	}
+	size := chunksSize(chunks)
+
+	h := w.Header()
+	br, partial, err := parseRange(r.Header.Get("Range"), size)
+	if ir := r.Header.Get("If-Range"); ir != "" && !etagMatches(ir, etag) {
+		partial, err = false, nil
+	}
+	if !fi.HashVerified {
+		// part of a file can't be checked against the hash, so until all of it has been
+		// everyone gets the whole thing, which checks it on the way out
+		partial, err = false, nil
+	}
+	if err != nil {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "Requested range not satisfiable", 416)
+		return
+	}
+
+	writeHeader := func() {
+		setBlobHeaders()
+		if !fi.HashVerified {
+			h.Set("Accept-Ranges", "none")
+		}
+		if partial {
+			h.Set("Content-Range", br.contentRange(size))
+			h.Set("Content-Length", strconv.FormatInt(br.length(), 10))
+			w.WriteHeader(http.StatusPartialContent)
+			return
+		}
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if r.Method == http.MethodHead {
+		writeHeader()
+		return
+	}
+
+	lw := &lazyHeaderWriter{w: w, writeHeader: writeHeader}
+	src := &chunkSource{did: u.DID, cfg: cfg, ctx: ctx, fetchCtx: r.Context()}
+	var n int64
+	if partial {
+		// the file's been checked against the hash before, and whole chunks are still
+		// checked against their CIDs before they go in the cache
+		n, err = copyChunks(lw, chunks, br, src)
+	} else {
+		n, err = copyChunkedFile(lw, fi, chunks, src)
+	}
+	if err != nil {
+		if errors.Is(err, errHashMismatch) {
+			logger.Error("Chunked file doesn't match its hash", "file_id", fi.ID, "slug", slug, "hash", fi.Hash, "error", err)
+		} else {
+			logger.Warn("Failed to stream chunked file", "file_id", fi.ID, "slug", slug, "bytes_written", n, "error", err)
+		}
+		if lw.wrote {
+			// headers are already out, all we can do is cut the response short
+			return
+		}
+		switch {
+		case errors.Is(err, errChunkNotFound):
+			http.Error(w, "Blob not found on PDS", 404)
+		case errors.Is(err, errHashMismatch):
+			http.Error(w, "File doesn't match its hash", 502)
+		default:
+			http.Error(w, "Failed to fetch blob from PDS", 502)
+		}
+		return
+	}
+	// an empty file never wrote anything
+	lw.sendHeader()
+	if !partial && !fi.HashVerified {
+		if err := markHashVerified(fi, db); err != nil {
+			logger.Error("Failed to mark chunked file verified", "file_id", fi.ID, "slug", slug, "error", err)
+		}
+	}
+	logger.Debug("Streamed chunked file", "file_id", fi.ID, "slug", slug, "chunks", len(chunks), "bytes_written", n, "partial", partial)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/ipfs/go-cid"
+	"github.com/saturn-vi/skywell/api/skywell"
+)
+
+// three chunks, 0-5, 6-13 and 14-18 of "hello chunked world"
+var testChunks = [][]byte{[]byte("hello "), []byte("chunked "), []byte("world")}
+
+func testLexBlob(blob []byte) *util.LexBlob {
+	c, _ := cid.Decode(testBlobCID(blob))
+	return &util.LexBlob{Ref: util.LexLink(c), MimeType: "text/plain", Size: int64(len(blob))}
+}
+
+func testFileChunks(chunks ...[]byte) (fcs []FileChunk) {
+	for i, c := range chunks {
+		fcs = append(fcs, FileChunk{Position: i, BlobRef: syntax.CID(testBlobCID(c)), MimeType: "text/plain", Size: int64(len(c))})
+	}
+	return fcs
+}
+
+// testFileNamed gets the file with this name, however it's been hidden
+func testFileNamed(t *testing.T, db *gorm.DB, name string) File {
+	t.Helper()
+	f := File{}
+	if err := db.Where("name = ?", name).First(&f).Error; err != nil {
+		t.Fatalf("failed to find %q: %v", name, err)
+	}
+	return f
+}
+
+// testBlobPDS serves com.atproto.sync.getBlob out of a map, whether or not the contents match the CID
+type testBlobPDS map[string][]byte
+
+func (p testBlobPDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, ok := p[r.URL.Query().Get("cid")]
+	if r.URL.Path != "/xrpc/com.atproto.sync.getBlob" || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(b)
+}
+
+// useTestPDS makes pds testDID's PDS for the length of the test
+func useTestPDS(t *testing.T, pds http.Handler) {
+	t.Helper()
+	srv := httptest.NewServer(pds)
+	t.Cleanup(srv.Close)
+	useTestDirectory(t, identity.Identity{
+		DID:    testDID,
+		Handle: syntax.HandleInvalid,
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: srv.URL},
+		},
+	})
+}
+
+// countingScanner passes everything, counting how many blobs it was shown
+type countingScanner struct {
+	scans atomic.Int64
+}
+
+func (s *countingScanner) String() string {
+	return "counting"
+}
+
+func (s *countingScanner) scan(r io.Reader, ctx context.Context) (found string, err error) {
+	s.scans.Add(1)
+	return "", nil
+}
+
+func TestParseChunks(t *testing.T) {
+	hash := testChunksHash(testChunks...)
+	chunks := []*util.LexBlob{}
+	for _, c := range testChunks {
+		chunks = append(chunks, testLexBlob(c))
+	}
+	record := func(edit func(r *skywell.File)) *skywell.File {
+		h := hash
+		r := &skywell.File{BlobRef: testLexBlob(testChunks[0]), Chunks: append([]*util.LexBlob{}, chunks...), Hash: &h}
+		if edit != nil {
+			edit(r)
+		}
+		return r
+	}
+
+	got, gotHash, err := parseChunks(record(nil))
+	if err != nil {
+		t.Fatalf("valid chunks failed: %v", err)
+	}
+	if gotHash != hash {
+		t.Errorf("hash is %q, want %q", gotHash, hash)
+	}
+	if want := testFileChunks(testChunks...); !sameChunks(got, want) {
+		t.Errorf("got chunks %+v, want %+v", got, want)
+	}
+	for i, c := range got {
+		if c.Position != i {
+			t.Errorf("chunk %d has position %d", i, c.Position)
+		}
+	}
+
+	// a single blob has no chunks, whatever hash it claims
+	got, gotHash, err = parseChunks(record(func(r *skywell.File) { r.Chunks = nil }))
+	if err != nil || got != nil || gotHash != "" {
+		t.Errorf("single blob gave chunks %v, hash %q, error %v", got, gotHash, err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		edit func(r *skywell.File)
+	}{
+		{"no hash", func(r *skywell.File) { r.Hash = nil }},
+		{"uppercase hash", func(r *skywell.File) { h := strings.ToUpper(hash); r.Hash = &h }},
+		{"short hash", func(r *skywell.File) { h := hash[:62]; r.Hash = &h }},
+		{"hash isn't hex", func(r *skywell.File) { h := strings.Repeat("z", 64); r.Hash = &h }},
+		{"missing chunk", func(r *skywell.File) { r.Chunks[1] = nil }},
+		{"negative size", func(r *skywell.File) { r.Chunks[1] = &util.LexBlob{Ref: r.Chunks[1].Ref, Size: -1} }},
+		{"first chunk isn't the blobRef", func(r *skywell.File) { r.BlobRef = testLexBlob([]byte("something else")) }},
+		{"no blobRef", func(r *skywell.File) { r.BlobRef = nil }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := parseChunks(record(tc.edit)); err == nil {
+				t.Error("invalid chunks passed")
+			}
+		})
+	}
+}
+
+func TestCopyChunks(t *testing.T) {
+	useTestBlobCache(t)
+	for _, c := range testChunks {
+		cacheTestBlob(t, c)
+	}
+	whole := bytes.Join(testChunks, nil)
+	src := &chunkSource{did: testDID, cfg: defaultConfig(), ctx: context.Background(), fetchCtx: context.Background()}
+
+	for _, br := range []byteRange{
+		{0, 18},
+		{0, 0},
+		{2, 4},
+		{4, 8},   // across the first boundary
+		{5, 6},   // the last byte of one chunk and the first of the next
+		{6, 13},  // exactly the middle chunk
+		{13, 14}, // across the second boundary
+		{3, 16},  // into all three
+		{18, 18},
+	} {
+		buf := &bytes.Buffer{}
+		n, err := copyChunks(buf, testFileChunks(testChunks...), br, src)
+		if err != nil {
+			t.Errorf("%d-%d: %v", br.start, br.end, err)
+			continue
+		}
+		if want := whole[br.start : br.end+1]; buf.String() != string(want) || n != int64(len(want)) {
+			t.Errorf("%d-%d is %q (%d bytes), want %q", br.start, br.end, buf.String(), n, want)
+		}
+	}
+}
+
+func TestCopyChunkedFile(t *testing.T) {
+	useTestBlobCache(t)
+	for _, c := range testChunks {
+		cacheTestBlob(t, c)
+	}
+	whole := bytes.Join(testChunks, nil)
+	src := &chunkSource{did: testDID, cfg: defaultConfig(), ctx: context.Background(), fetchCtx: context.Background()}
+	chunks := testFileChunks(testChunks...)
+
+	buf := &bytes.Buffer{}
+	if _, err := copyChunkedFile(buf, File{Hash: testChunksHash(testChunks...)}, chunks, src); err != nil {
+		t.Fatalf("copyChunkedFile: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), whole) {
+		t.Errorf("got %q, want %q", buf.String(), whole)
+	}
+
+	// the last byte is held back, so a file that doesn't match never arrives whole
+	buf.Reset()
+	_, err := copyChunkedFile(buf, File{Hash: testChunksHash([]byte("something else"))}, chunks, src)
+	if !errors.Is(err, errHashMismatch) {
+		t.Errorf("wrong hash gave error %v, want errHashMismatch", err)
+	}
+	if !bytes.Equal(buf.Bytes(), whole[:len(whole)-1]) {
+		t.Errorf("wrong hash wrote %q, want all but the last byte", buf.String())
+	}
+}
+
+func TestChunkedFileScanReuse(t *testing.T) {
+	db, cfg := newTestDB(t)
+	useTestLexicons(t)
+	useTestBlobCache(t)
+	createTestUser(t, db, testDID)
+	a, b, c := testChunks[0], testChunks[1], testChunks[2]
+	evil := []byte("w0rld")
+	for _, blob := range [][]byte{a, b, c, evil} {
+		cacheTestBlob(t, blob)
+	}
+	hash := testChunksHash(a, b, c)
+	s := &countingScanner{}
+	scan := func() {
+		t.Helper()
+		scanPendingFiles([]scanner{s}, db, cfg, context.Background())
+	}
+
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa000", testChunkedFileRecord("original", hash, a, b, c)); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	scan()
+	if f := testFileNamed(t, db, "original"); f.ScanStatus != scanClean || !f.HashVerified {
+		t.Errorf("original is %s, hash verified %v, want clean and verified", f.ScanStatus, f.HashVerified)
+	}
+	if n := s.scans.Load(); n != 1 {
+		t.Fatalf("scanned %d times, want 1", n)
+	}
+
+	// another record made of the same blobs is the same file
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa001", testChunkedFileRecord("copy", hash, a, b, c)); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	scan()
+	if f := testFileNamed(t, db, "copy"); f.ScanStatus != scanClean {
+		t.Errorf("copy is %s, want clean", f.ScanStatus)
+	}
+	if n := s.scans.Load(); n != 1 {
+		t.Errorf("scanned %d times, the copy should have reused the original's verdict", n)
+	}
+
+	// copying the hash isn't enough, it never gets as far as the scanners
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa002", testChunkedFileRecord("forged", hash, a, b, evil)); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	scan()
+	if f := testFileNamed(t, db, "forged"); f.ScanStatus != scanPending || f.ScanAttempts != 1 || f.HashVerified {
+		t.Errorf("forged is %s after %d attempts, hash verified %v, want pending after 1", f.ScanStatus, f.ScanAttempts, f.HashVerified)
+	}
+	if n := s.scans.Load(); n != 1 {
+		t.Errorf("scanned %d times, the forged file should have failed its hash", n)
+	}
+
+	// and neither is keeping the blobRef and the hash when a later chunk changes
+	if err := ingestTestRecordCID(db, "dev.skywell.file", "3kaaaaaaaa000", testBlobCID([]byte("v2")), testChunkedFileRecord("original", hash, a, b, evil)); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	if f := testFileNamed(t, db, "original"); f.ScanStatus != scanPending || f.HashVerified {
+		t.Errorf("original with a swapped chunk is %s, hash verified %v, want pending and unverified", f.ScanStatus, f.HashVerified)
+	}
+}
+
+func TestServeChunkedFileRanges(t *testing.T) {
+	db, cfg := newTestDB(t)
+	useTestLexicons(t)
+	useTestBlobCache(t)
+	user := createTestUser(t, db, testDID)
+	evil := []byte("w0rld")
+	for _, blob := range append([][]byte{evil}, testChunks...) {
+		cacheTestBlob(t, blob)
+	}
+	whole := bytes.Join(testChunks, nil)
+	hash := testChunksHash(testChunks...)
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa000", testChunkedFileRecord("file", hash, testChunks...)); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa001", testChunkedFileRecord("forged", hash, testChunks[0], testChunks[1], evil)); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	serve := func(fi File, rangeHeader string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/blob/abc", nil)
+		r.Header.Set("Range", rangeHeader)
+		w := httptest.NewRecorder()
+		serveChunkedFile(w, r, fi, user, `"etag"`, func() {}, slog.Default(), db, cfg, context.Background())
+		return w
+	}
+
+	// until the whole file has been checked against the hash, ranges get all of it
+	w := serve(testFileNamed(t, db, "file"), "bytes=4-8")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), whole) {
+		t.Errorf("range of an unchecked file gave %d %q, want 200 and the whole file", w.Code, w.Body.String())
+	}
+	if ar := w.Header().Get("Accept-Ranges"); ar != "none" {
+		t.Errorf("unchecked file has Accept-Ranges %q, want none", ar)
+	}
+	fi := testFileNamed(t, db, "file")
+	if !fi.HashVerified {
+		t.Fatal("serving the whole file didn't mark it verified")
+	}
+	w = serve(fi, "bytes=4-8")
+	if w.Code != http.StatusPartialContent || w.Body.String() != string(whole[4:9]) {
+		t.Errorf("range of a checked file gave %d %q, want 206 %q", w.Code, w.Body.String(), whole[4:9])
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 4-8/19" {
+		t.Errorf("Content-Range is %q", cr)
+	}
+
+	// a forged file is cut short before the last byte, and stays unverified
+	w = serve(testFileNamed(t, db, "forged"), "bytes=0-2")
+	if want := "hello chunked w0rl"; w.Body.String() != want {
+		t.Errorf("forged file gave %q, want %q", w.Body.String(), want)
+	}
+	if testFileNamed(t, db, "forged").HashVerified {
+		t.Error("forged file was marked verified")
+	}
+}
+
+func TestVerifyChunkedFile(t *testing.T) {
+	db, cfg := newTestDB(t)
+	useTestLexicons(t)
+	useTestBlobCache(t)
+	createTestUser(t, db, testDID)
+	cfg.Verify.MaxBytes = 64
+	a, b, c := testChunks[0], testChunks[1], testChunks[2]
+	wrong, short, missing := []byte("earth"), []byte("planet"), []byte("nowhere")
+	big := bytes.Repeat([]byte("a"), 70)
+	pds := testBlobPDS{}
+	for _, blob := range [][]byte{a, b, c, big} {
+		pds[testBlobCID(blob)] = blob
+	}
+	// same length, different contents
+	pds[testBlobCID(wrong)] = []byte("EARTH")
+	pds[testBlobCID(short)] = []byte("pla")
+	useTestPDS(t, pds)
+
+	records := []struct {
+		name   string
+		hash   string
+		chunks [][]byte
+	}{
+		{"valid", testChunksHash(a, b, c), [][]byte{a, b, c}},
+		{"forged hash", testChunksHash(a, b, wrong), [][]byte{a, b, c}},
+		{"chunk doesn't match its CID", testChunksHash(a, b, wrong), [][]byte{a, b, wrong}},
+		{"chunk smaller than claimed", testChunksHash(a, b, short), [][]byte{a, b, short}},
+		{"chunk not on the PDS", testChunksHash(a, b, missing), [][]byte{a, b, missing}},
+		{"too big", testChunksHash(a, big), [][]byte{a, big}},
+	}
+	for i, r := range records {
+		rkey := "3kaaaaaaaa00" + string(rune('0'+i))
+		if err := ingestTestRecord(db, "dev.skywell.file", rkey, testChunkedFileRecord(r.name, r.hash, r.chunks...)); err != nil {
+			t.Fatalf("failed to index %s: %v", r.name, err)
+		}
+	}
+	verifyPendingFiles(db, cfg, context.Background())
+
+	for _, tc := range []struct {
+		name         string
+		status       string
+		reason       string
+		hashVerified bool
+	}{
+		{"valid", verifyVerified, "", true},
+		{"forged hash", verifyInvalid, "chunks don't match the file's hash", false},
+		{"chunk doesn't match its CID", verifyInvalid, "chunk 2 doesn't match its CID", false},
+		{"chunk smaller than claimed", verifyInvalid, "chunk 2 is smaller than the record claims", false},
+		// tried again later, it might just be the PDS
+		{"chunk not on the PDS", verifyPending, "", false},
+		{"too big", verifyUnverified, "too big to check against the hash", false},
+	} {
+		f := testFileNamed(t, db, tc.name)
+		if f.Verification != tc.status || f.HashVerified != tc.hashVerified {
+			t.Errorf("%s is %s (%q), hash verified %v, want %s and %v", tc.name, f.Verification, f.VerifyError, f.HashVerified, tc.status, tc.hashVerified)
+		}
+		if tc.reason != "" && f.VerifyError != tc.reason {
+			t.Errorf("%s failed with %q, want %q", tc.name, f.VerifyError, tc.reason)
+		}
+	}
+	if f := testFileNamed(t, db, "chunk not on the PDS"); f.VerifyAttempts != 1 {
+		t.Errorf("missing chunk took %d attempts, want 1", f.VerifyAttempts)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	jetstream "github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/saturn-vi/skywell/api/skywell"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+// collections (dev.skywell.collection) are named, ordered groups of files, e.g. the files in a release.
+// their members are strong refs to file records, which can be anyone's.
+// a collection gets a slug like a file does, from the same pool, so a slug never means both
+
+// Collection is an indexed dev.skywell.collection record
+type Collection struct {
+	gorm.Model
+	Uri         syntax.URI `gorm:"uniqueIndex"`
+	Cid         syntax.CID
+	UserID      uint `gorm:"index"`
+	CreatedAt   syntax.Datetime
+	IndexedAt   int64 `gorm:"index"`
+	Name        string
+	Description string
+	// how many files the record lists, indexed or not
+	FileCount int
+	// kept when the collection is deleted, so it's still theirs if it comes back
+	Slug string `gorm:"uniqueIndex"`
+}
+
+// CollectionFile is one of a collection's strong refs, in the record's order.
+// it points at the file by uri, so files indexed after the collection still show up
+type CollectionFile struct {
+	CollectionID uint   `gorm:"primaryKey;autoIncrement:false"`
+	Position     int    `gorm:"primaryKey;autoIncrement:false"`
+	Uri          string `gorm:"index"`
+	Cid          string
+}
+
+// collectionHasSlug is whether a collection (deleted or not) has slug
+func collectionHasSlug(slug string, db *gorm.DB) (taken bool, err error) {
+	var n int64
+	if err := db.Unscoped().Model(&Collection{}).Where("slug = ?", slug).Count(&n).Error; err != nil {
+		return false, fmt.Errorf("failed to check collection slugs: %w", err)
+	}
+	return n > 0, nil
+}
+
+// updateCollection indexes a created or updated collection record
+func updateCollection(evt jetstream.Event, uri syntax.URI, user User, db *gorm.DB) error {
+	// anything that doesn't match the lexicon isn't indexed, whatever was there before stays
+	if n, err := validateRecord(evt.Commit.Record, evt.Commit.Collection); err != nil {
+		jetstreamLogger.Warn("Record failed lexicon validation", "uri", uri.String(), "did", evt.Did, "failures", n, "error", err)
+		return recordIngestError(evt, uri.String(), fmt.Errorf("record doesn't match the lexicon: %w", err), db)
+	}
+
+	var r skywell.Collection
+	if err := json.Unmarshal(evt.Commit.Record, &r); err != nil {
+		jetstreamLogger.Error("Failed to unmarshal to collection", "did", evt.Did, "error", err)
+		return recordIngestError(evt, uri.String(), fmt.Errorf("invalid record: %w", err), db)
+	}
+
+	cid, err := syntax.ParseCID(evt.Commit.CID)
+	if err != nil {
+		jetstreamLogger.Error("Failed to parse CID", "cid", evt.Commit.CID, "uri", uri.String(), "did", evt.Did, "error", err)
+		return recordIngestError(evt, uri.String(), fmt.Errorf("invalid CID: %w", err), db)
+	}
+
+	pt, err := syntax.ParseDatetime(r.CreatedAt)
+	if err != nil {
+		jetstreamLogger.Error("Failed to parse createdAt", "created_at", r.CreatedAt, "uri", uri.String(), "did", evt.Did, "error", err)
+		return recordIngestError(evt, uri.String(), fmt.Errorf("invalid createdAt: %w", err), db)
+	}
+
+	// same as files, replayed events are skipped
+	existing := Collection{}
+	err = db.Unscoped().Where("uri = ?", uri.String()).First(&existing).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		dbLogger.Error("Failed to query existing collection", "uri", uri.String(), "did", evt.Did, "error", err)
+		return fmt.Errorf("failed to query existing collection: %w", err)
+	}
+	if err == nil && !existing.DeletedAt.Valid && existing.Cid == cid {
+		jetstreamLogger.Debug("Collection already indexed, skipping", "collection_id", existing.ID, "uri", uri.String(), "cid", cid.String(), "did", evt.Did)
+		return nil
+	}
+
+	col := Collection{
+		Uri:       uri,
+		Cid:       cid,
+		UserID:    user.ID,
+		CreatedAt: pt,
+		IndexedAt: syntax.DatetimeNow().Time().UnixNano(),
+		Name:      r.Name,
+		FileCount: len(r.Files),
+		Slug:      existing.Slug,
+	}
+	if r.Description != nil {
+		col.Description = *r.Description
+	}
+	members := []CollectionFile{}
+	for i, ref := range r.Files {
+		if ref == nil {
+			continue
+		}
+		members = append(members, CollectionFile{Position: i, Uri: ref.Uri, Cid: ref.Cid})
+	}
+
+	// like ensureFileKey, someone else can take the slug between generateSlug and the insert
+	for attempt := 0; attempt < 5; attempt++ {
+		if col.Slug == "" {
+			col.Slug, err = generateSlug(db, col.Cid, col.Uri)
+			if err != nil {
+				dbLogger.Error("Failed to generate slug", "uri", uri.String(), "did", evt.Did, "error", err)
+				return recordIngestError(evt, uri.String(), fmt.Errorf("failed to generate slug: %w", err), db)
+			}
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// deleted_at is reset so that a record recreated under the same rkey comes back, with its old slug
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "uri"}},
+				DoUpdates: clause.AssignmentColumns([]string{"cid", "name", "description", "file_count", "deleted_at"}),
+			}).Create(&col).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.Where("collection_id = ?", col.ID).Delete(&CollectionFile{}).Error; err != nil {
+				return err
+			}
+			for i := range members {
+				members[i].CollectionID = col.ID
+			}
+			if len(members) == 0 {
+				return nil
+			}
+			return tx.Create(&members).Error
+		})
+		if !errors.Is(err, gorm.ErrDuplicatedKey) || existing.Slug != "" {
+			break
+		}
+		dbLogger.Debug("Slug taken while creating collection, retrying", "slug", col.Slug, "uri", uri.String(), "attempt", attempt)
+		col.Slug = ""
+	}
+	if err != nil {
+		dbLogger.Error("Failed to create or update collection", "collection_name", col.Name, "user_id", user.ID, "uri", uri.String(), "did", evt.Did, "error", err)
+		return recordIngestError(evt, uri.String(), fmt.Errorf("failed to create or update collection: %w", err), db)
+	}
+	jetstreamLogger.Info("Created collection", "collection_id", col.ID, "collection_name", col.Name, "slug", col.Slug, "files", len(members), "did", evt.Did)
+	return nil
+}
+
+// deleteCollection unindexes a deleted collection record. the row stays (soft deleted) so its slug isn't handed out again
+func deleteCollection(evt jetstream.Event, uri syntax.URI, db *gorm.DB) error {
+	var col Collection
+	if err := db.Where("uri = ?", uri.String()).First(&col).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// most likely a replayed delete
+			dbLogger.Debug("Attempted to delete non-existent collection", "uri", uri.String(), "did", evt.Did)
+			return nil
+		}
+		dbLogger.Error("Failed to query collection for deletion", "uri", uri.String(), "did", evt.Did, "error", err)
+		return fmt.Errorf("failed to query collection for deletion: %w", err)
+	}
+	if err := db.Delete(&col).Error; err != nil {
+		dbLogger.Error("Failed to delete collection", "collection_id", col.ID, "collection_name", col.Name, "slug", col.Slug, "did", evt.Did, "error", err)
+		return recordIngestError(evt, uri.String(), fmt.Errorf("failed to delete collection: %w", err), db)
+	}
+	jetstreamLogger.Info("Deleted collection", "collection_id", col.ID, "collection_name", col.Name, "slug", col.Slug, "did", evt.Did)
+	return nil
+}
+
+// collectionBySlug finds the collection a slug points to and who made it.
+// collections of accounts that aren't active, or were taken down, are 404s like their files
+func collectionBySlug(slug string, db *gorm.DB) (col Collection, user User, httpResponse int, err error) {
+	if err := db.Where("slug = ?", slug).First(&col).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return col, user, 404, fmt.Errorf("no collection for slug")
+	} else if err != nil {
+		return col, user, 500, fmt.Errorf("failed to find collection: %w", err)
+	}
+	if err := db.Where("id = ?", col.UserID).First(&user).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return col, user, 404, fmt.Errorf("user %d not found", col.UserID)
+	} else if err != nil {
+		return col, user, 500, fmt.Errorf("failed to find user: %w", err)
+	}
+	if user.Status != "" {
+		return col, user, 404, fmt.Errorf("account is %s", user.Status)
+	}
+	if user.TakenDown {
+		return col, user, 404, fmt.Errorf("account was taken down by an admin")
+	}
+	return col, user, 200, nil
+}
+
+// generateCollectionViews builds views of cols as seen by viewer ("" for logged out), with their files.
+// a file is only in there if viewer could see it with getFileFromSlug, or it's one of viewer's own
+func generateCollectionViews(cols []Collection, viewer syntax.DID, db *gorm.DB, cfg *Config) (views []*skywell.Defs_CollectionView, err error) {
+	views = []*skywell.Defs_CollectionView{}
+	if len(cols) == 0 {
+		return views, nil
+	}
+
+	ids := make([]uint, len(cols))
+	for i, c := range cols {
+		ids[i] = c.ID
+	}
+	members := []CollectionFile{}
+	if err := db.Where("collection_id IN ?", ids).Order("collection_id, position").Find(&members).Error; err != nil {
+		return nil, fmt.Errorf("failed to find collection files: %w", err)
+	}
+	uris := []string{}
+	for _, m := range members {
+		uris = append(uris, m.Uri)
+	}
+
+	files := map[string]File{}
+	if len(uris) > 0 {
+		public := []File{}
+		err := db.Model(&File{}).
+			Scopes(visibleFiles(false, cfg)).
+			Joins("JOIN users ON users.id = files.user_id AND users.deleted_at IS NULL").
+			Where("users.status = '' AND users.taken_down = ?", false).
+			Where("files.uri IN ?", uris).
+			Find(&public).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to find collection files: %w", err)
+		}
+		for _, f := range public {
+			files[f.Uri.String()] = f
+		}
+		if viewer != "" {
+			// the viewer's own files, including the ones hidden from everyone else
+			own := []File{}
+			err := db.Model(&File{}).
+				Scopes(visibleFiles(true, cfg)).
+				Joins("JOIN users ON users.id = files.user_id AND users.deleted_at IS NULL").
+				Where("users.did = ? AND users.taken_down = ?", viewer.String(), false).
+				Where("files.uri IN ?", uris).
+				Find(&own).Error
+			if err != nil {
+				return nil, fmt.Errorf("failed to find viewer's collection files: %w", err)
+			}
+			for _, f := range own {
+				files[f.Uri.String()] = f
+			}
+		}
+	}
+
+	fileIDs := []uint{}
+	for _, f := range files {
+		fileIDs = append(fileIDs, f.ID)
+	}
+	slugs := map[uint]string{}
+	if len(fileIDs) > 0 {
+		keys := []FileKey{}
+		if err := db.Where("file IN ?", fileIDs).Find(&keys).Error; err != nil {
+			return nil, fmt.Errorf("failed to find file keys: %w", err)
+		}
+		for _, k := range keys {
+			slugs[k.File] = k.Key
+		}
+	}
+
+	// the same file can be in several collections (or twice in one), but each gets its own view
+	fileviews := map[uint][]*skywell.Defs_FileView{}
+	all := []*skywell.Defs_FileView{}
+	for _, m := range members {
+		f, ok := files[m.Uri]
+		if !ok {
+			continue
+		}
+		slug, ok := slugs[f.ID]
+		if !ok {
+			dbLogger.Debug("No file key found", "file_id", f.ID)
+			continue
+		}
+		fv, err := fileToView(f, slug, cfg)
+		if err != nil {
+			return nil, err
+		}
+		fileviews[m.CollectionID] = append(fileviews[m.CollectionID], fv)
+		all = append(all, fv)
+	}
+	if err := labelFileViews(all, db, cfg); err != nil {
+		return nil, err
+	}
+	if err := chunkFileViews(all, db); err != nil {
+		return nil, err
+	}
+
+	for _, c := range cols {
+		fc := int64(c.FileCount)
+		v := &skywell.Defs_CollectionView{
+			Uri:       c.Uri.String(),
+			Cid:       c.Cid.String(),
+			CreatedAt: c.CreatedAt.String(),
+			Name:      c.Name,
+			Slug:      c.Slug,
+			Files:     fileviews[c.ID],
+			FileCount: &fc,
+		}
+		if v.Files == nil {
+			v.Files = []*skywell.Defs_FileView{}
+		}
+		if c.Description != "" {
+			v.Description = &c.Description
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// generateCollectionList lists a's collections, newest first, as seen by viewer ("" for logged out)
+func generateCollectionList(c string, limit int, a syntax.DID, viewer syntax.DID, db *gorm.DB, cfg *Config) (cursor string, views []*skywell.Defs_CollectionView, httpResponse int, err error) {
+	user := User{}
+	if err := db.First(&user, "did = ?", a.String()).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil, 404, xrpcserver.Errorf("ActorNotFound", "actor not found")
+	} else if err != nil {
+		return "", nil, 500, fmt.Errorf("failed to find actor: %w", err)
+	}
+
+	query := db.Where("user_id = ?", user.ID).Order("indexed_at DESC").Limit(limit)
+	if c != "" {
+		pint, err := strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			return "", nil, 400, xrpcserver.Errorf("InvalidCursor", "invalid 'cursor' parameter")
+		}
+		// cursor is a nanosecond timestamp
+		query = query.Where("indexed_at < ?", pint)
+	}
+	cols := []Collection{}
+	if err := query.Find(&cols).Error; err != nil {
+		return "", nil, 500, fmt.Errorf("failed to query collections: %w", err)
+	}
+
+	views, err = generateCollectionViews(cols, viewer, db, cfg)
+	if err != nil {
+		return "", nil, 500, err
+	}
+	if len(cols) < limit {
+		return "", views, 200, nil
+	}
+	return strconv.FormatInt(cols[len(cols)-1].IndexedAt, 10), views, 200, nil
+}
+
+func initializeCollectionRoutes(s *xrpcserver.Server, db *gorm.DB, cfg *Config, ctx context.Context) {
+	type getCollectionParams struct {
+		Slug string `query:"slug,required"`
+	}
+
+	// the owner also sees their own files that are hidden from everyone else
+	xrpcserver.Query(s, "dev.skywell.getCollection", xrpcserver.Opts{Auth: xrpcserver.AuthOptional}, func(req *xrpcserver.Request, p getCollectionParams) (*skywell.GetCollection_Output, int, error) {
+		col, u, stat, err := collectionBySlug(p.Slug, db)
+		if stat == 404 {
+			return nil, 404, xrpcserver.Errorf("CollectionNotFound", "no matching collection found")
+		} else if err != nil {
+			return nil, stat, fmt.Errorf("failed to find collection: %w", err)
+		}
+		profile, stat, err := generateProfileView(u.DID, req.Caller, db, cfg, ctx)
+		if stat == 404 {
+			// hidden by a label
+			return nil, 404, xrpcserver.Errorf("CollectionNotFound", "no matching collection found")
+		} else if err != nil {
+			return nil, stat, fmt.Errorf("failed to generate profile view: %w", err)
+		}
+		views, err := generateCollectionViews([]Collection{col}, req.Caller, db, cfg)
+		if err != nil {
+			return nil, 500, err
+		}
+		return &skywell.GetCollection_Output{
+			Uri:        col.Uri.String(),
+			Cid:        col.Cid.String(),
+			Collection: views[0],
+			Actor:      profile,
+		}, 200, nil
+	})
+
+	type getActorCollectionsParams struct {
+		Actor  string `query:"actor,required"`
+		Limit  int    `query:"limit"`
+		Cursor string `query:"cursor"`
+	}
+
+	xrpcserver.Query(s, "dev.skywell.getActorCollections", xrpcserver.Opts{Auth: xrpcserver.AuthOptional}, func(req *xrpcserver.Request, p getActorCollectionsParams) (*skywell.GetActorCollections_Output, int, error) {
+		did, stat, err := resolveActor(p.Actor, ctx)
+		if err != nil {
+			return nil, stat, fmt.Errorf("failed to resolve 'actor' parameter: %w", err)
+		}
+		// the same checks as getActorFiles, an actor that can't be seen has no collections either
+		profile, stat, err := generateProfileView(did, req.Caller, db, cfg, ctx)
+		if err != nil {
+			return nil, stat, err
+		}
+		if p.Limit == 0 {
+			p.Limit = 25 // default limit
+		}
+		c, views, stat, err := generateCollectionList(p.Cursor, p.Limit, did, req.Caller, db, cfg)
+		if err != nil {
+			return nil, stat, err
+		}
+		out := &skywell.GetActorCollections_Output{
+			Actor:       profile,
+			Collections: views,
+		}
+		if c != "" {
+			out.Cursor = &c
+		}
+		return out, 200, nil
+	})
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const defaultConfigPath = "skywell.toml"
+
+// Config holds everything that differs between deployments (production, staging, someone's own AppView).
+// values come from defaultConfig, then the TOML file, then SKYWELL_* environment variables
+type Config struct {
+	// address to listen on, e.g. ":4999"
+	Port string `toml:"port"`
+	// DID that service auth JWTs must be addressed to
+	ServiceDID  string `toml:"service_did"`
+	UserAgent   string `toml:"user_agent"`
+	BskyAPIHost string `toml:"bsky_api_host"`
+
+	Database  DatabaseConfig  `toml:"database"`
+	Ingest    IngestConfig    `toml:"ingest"`
+	RateLimit RateLimitConfig `toml:"rate_limit"`
+	DIDWeb    DIDWebConfig    `toml:"did_web"`
+	BlobCache BlobCacheConfig `toml:"blob_cache"`
+	Verify    VerifyConfig    `toml:"verify"`
+	Scan      ScanConfig      `toml:"scan"`
+	Labels    LabelsConfig    `toml:"labels"`
+	Admin     AdminConfig     `toml:"admin"`
+	Lexicons  LexiconsConfig  `toml:"lexicons"`
+}
+
+type DatabaseConfig struct {
+	// sqlite or postgres
+	Driver string `toml:"driver"`
+	DSN    string `toml:"dsn"`
+}
+
+type IngestConfig struct {
+	// jetstream or firehose
+	Backend        string   `toml:"backend"`
+	JetstreamHosts []string `toml:"jetstream_hosts"`
+	FirehoseHosts  []string `toml:"firehose_hosts"`
+}
+
+// DIDWebConfig lets a self-hosted AppView be its own did:web (see didweb.go)
+type DIDWebConfig struct {
+	// e.g. "appview.example.com", empty means no DID document is served
+	Hostname string `toml:"hostname"`
+	// defaults to https://<hostname>
+	ServiceEndpoint string `toml:"service_endpoint"`
+}
+
+// BlobCacheConfig is for the on-disk cache behind /blob (see blobcache.go)
+type BlobCacheConfig struct {
+	// empty disables the cache
+	Dir string `toml:"dir"`
+	// total size of cached blobs, least recently used ones are evicted past this
+	MaxBytes int64 `toml:"max_bytes"`
+}
+
+// VerifyConfig is for checking blobs against the records that point at them (see verify.go)
+type VerifyConfig struct {
+	Enabled bool `toml:"enabled"`
+	// blobs up to this size are downloaded and hashed, bigger ones only get their size and type checked
+	MaxBytes int64 `toml:"max_bytes"`
+	// how many blobs are fetched at once
+	Workers int `toml:"workers"`
+}
+
+// ScanConfig is for the malware scanners (see scan.go)
+type ScanConfig struct {
+	// clamav and/or blocklist, run in order. empty disables scanning
+	Scanners []string `toml:"scanners"`
+	// hide or mark flagged files
+	Action string `toml:"action"`
+	// bigger blobs are left unscanned
+	MaxBytes int64 `toml:"max_bytes"`
+	Workers  int   `toml:"workers"`
+	// unix:///path/to/clamd.sock or tcp://host:port
+	ClamAVAddress string `toml:"clamav_address"`
+	// sha256 hashes, one per line (sha256sum's output works)
+	BlocklistFile string `toml:"blocklist_file"`
+}
+
+// LabelsConfig is for moderation labels, ours and other labelers' (see labels.go and labeler.go)
+type LabelsConfig struct {
+	// DIDs of the labelers to subscribe to
+	Labelers []string `toml:"labelers"`
+	// what label values do to files and accounts: hide, blur, warn or ignore.
+	// merged over the defaults, values that aren't listed are passed along without an effect
+	Actions map[string]string `toml:"actions"`
+	// multibase private key (K-256 or P-256) our own labels are signed with, empty turns our labeler off
+	SigningKey string `toml:"signing_key"`
+}
+
+// AdminConfig is for the dev.skywell.admin.* endpoints (see admin.go)
+type AdminConfig struct {
+	// DIDs allowed to call them, with a service auth JWT like any other authenticated endpoint
+	DIDs []string `toml:"dids"`
+}
+
+// LexiconsConfig is for checking requests and records against the lexicons (see lexicons.go)
+type LexiconsConfig struct {
+	// the lexicons directory from the repo, relative to the working directory
+	Dir string `toml:"dir"`
+	// check responses too, failures are only logged
+	ValidateResponses bool `toml:"validate_responses"`
+}
+
+// RateLimitConfig is for the rate limiter (see ratelimit.go).
+// requests_per_second and burst are the budget for everyone without a service auth JWT, per IP
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `toml:"requests_per_second"`
+	Burst             int     `toml:"burst"`
+	// budget for requests with a valid service auth JWT, per DID
+	Authenticated RateLimitBudget `toml:"authenticated"`
+	// extra budgets for expensive endpoints by NSID, on top of the overall one.
+	// merged over the defaults
+	Endpoints map[string]RateLimitBudget `toml:"endpoints"`
+	// proxies (IPs or CIDRs) whose X-Forwarded-For and X-Real-IP headers are believed.
+	// requests from anywhere else are limited by the address they come from
+	TrustedProxies  []string      `toml:"trusted_proxies"`
+	CleanupInterval time.Duration `toml:"cleanup_interval"`
+	MaxIdleTime     time.Duration `toml:"max_idle_time"`
+}
+
+type RateLimitBudget struct {
+	RequestsPerSecond float64 `toml:"requests_per_second"`
+	Burst             int     `toml:"burst"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:        ":4999",
+		ServiceDID:  "did:plc:tsaj4ffwyj5z6rjqaxmg5cp4",
+		UserAgent:   "Skywell AppView v0.1.12",
+		BskyAPIHost: "https://public.api.bsky.app",
+		Database: DatabaseConfig{
+			Driver: dbDriverSQLite,
+			DSN:    "database.db",
+		},
+		Ingest: IngestConfig{
+			Backend:        ingestBackendJetstream,
+			JetstreamHosts: jetstreamHosts,
+			FirehoseHosts:  firehoseHosts,
+		},
+		RateLimit: RateLimitConfig{
+			RequestsPerSecond: 10,
+			Burst:             30,
+			Authenticated:     RateLimitBudget{RequestsPerSecond: 30, Burst: 90},
+			Endpoints: map[string]RateLimitBudget{
+				// calls the Bluesky API
+				"dev.skywell.indexActorProfile": {RequestsPerSecond: 0.2, Burst: 5},
+				"dev.skywell.createReport":      {RequestsPerSecond: 0.05, Burst: 5},
+			},
+			// nginx on the same machine, see README
+			TrustedProxies:  []string{"127.0.0.1", "::1"},
+			CleanupInterval: 2 * time.Minute,
+			MaxIdleTime:     5 * time.Minute,
+		},
+		BlobCache: BlobCacheConfig{
+			Dir:      "blobcache",
+			MaxBytes: 1 << 30, // 1 GiB
+		},
+		Verify: VerifyConfig{
+			Enabled:  false,
+			MaxBytes: 100 << 20, // 100 MiB
+			Workers:  4,
+		},
+		Scan: ScanConfig{
+			Scanners:      []string{},
+			Action:        scanActionHide,
+			MaxBytes:      100 << 20, // 100 MiB
+			Workers:       2,
+			ClamAVAddress: "unix:///var/run/clamav/clamd.ctl",
+		},
+		Labels: LabelsConfig{
+			Labelers: []string{},
+			// the global values every atproto client knows about
+			Actions: map[string]string{
+				"!takedown":     labelActionHide,
+				"!hide":         labelActionHide,
+				"!warn":         labelActionWarn,
+				"porn":          labelActionBlur,
+				"sexual":        labelActionBlur,
+				"nudity":        labelActionBlur,
+				"graphic-media": labelActionBlur,
+				"gore":          labelActionBlur,
+			},
+		},
+		Lexicons: LexiconsConfig{
+			// server/ in development, /skywell/server in production (see README)
+			Dir: "../lexicons",
+		},
+	}
+}
+
+// loadConfig reads the config file at path (or $SKYWELL_CONFIG, or skywell.toml if it exists)
+// and applies environment overrides. it doesn't validate, see (*Config).validate
+func loadConfig(path string) (cfg *Config, err error) {
+	cfg = defaultConfig()
+
+	if path == "" {
+		path = os.Getenv("SKYWELL_CONFIG")
+	}
+	required := path != ""
+	if path == "" {
+		path = defaultConfigPath
+	}
+
+	md, err := toml.DecodeFile(path, cfg)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		// no config file is fine, the defaults are production's
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	} else if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown keys in config file %s: %v", path, undecoded)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) applyEnv() error {
+	strs := map[string]*string{
+		"SKYWELL_PORT":           &cfg.Port,
+		"SKYWELL_SERVICE_DID":    &cfg.ServiceDID,
+		"SKYWELL_USER_AGENT":     &cfg.UserAgent,
+		"SKYWELL_BSKY_API_HOST":  &cfg.BskyAPIHost,
+		"SKYWELL_DB_DRIVER":      &cfg.Database.Driver,
+		"SKYWELL_DB_DSN":         &cfg.Database.DSN,
+		"SKYWELL_INGEST_BACKEND": &cfg.Ingest.Backend,
+
+		"SKYWELL_DID_WEB_HOSTNAME":         &cfg.DIDWeb.Hostname,
+		"SKYWELL_DID_WEB_SERVICE_ENDPOINT": &cfg.DIDWeb.ServiceEndpoint,
+
+		"SKYWELL_BLOB_CACHE_DIR":      &cfg.BlobCache.Dir,
+		"SKYWELL_SCAN_ACTION":         &cfg.Scan.Action,
+		"SKYWELL_SCAN_CLAMAV_ADDRESS": &cfg.Scan.ClamAVAddress,
+		"SKYWELL_SCAN_BLOCKLIST_FILE": &cfg.Scan.BlocklistFile,
+		"SKYWELL_LABELER_SIGNING_KEY": &cfg.Labels.SigningKey,
+		"SKYWELL_LEXICONS_DIR":        &cfg.Lexicons.Dir,
+	}
+	for env, dst := range strs {
+		if v, ok := os.LookupEnv(env); ok {
+			*dst = v
+		}
+	}
+
+	lists := map[string]*[]string{
+		"SKYWELL_JETSTREAM_HOSTS": &cfg.Ingest.JetstreamHosts,
+		"SKYWELL_FIREHOSE_HOSTS":  &cfg.Ingest.FirehoseHosts,
+		"SKYWELL_SCAN_SCANNERS":   &cfg.Scan.Scanners,
+		"SKYWELL_LABELERS":        &cfg.Labels.Labelers,
+		"SKYWELL_ADMIN_DIDS":      &cfg.Admin.DIDs,
+
+		"SKYWELL_RATE_LIMIT_TRUSTED_PROXIES": &cfg.RateLimit.TrustedProxies,
+	}
+	for env, dst := range lists {
+		if v, ok := os.LookupEnv(env); ok {
+			*dst = splitList(v)
+		}
+	}
+
+	if v, ok := os.LookupEnv("SKYWELL_RATE_LIMIT_RPS"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SKYWELL_RATE_LIMIT_RPS: %w", err)
+		}
+		cfg.RateLimit.RequestsPerSecond = f
+	}
+	if v, ok := os.LookupEnv("SKYWELL_RATE_LIMIT_BURST"); ok {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid SKYWELL_RATE_LIMIT_BURST: %w", err)
+		}
+		cfg.RateLimit.Burst = i
+	}
+	if v, ok := os.LookupEnv("SKYWELL_BLOB_CACHE_MAX_BYTES"); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SKYWELL_BLOB_CACHE_MAX_BYTES: %w", err)
+		}
+		cfg.BlobCache.MaxBytes = i
+	}
+	if v, ok := os.LookupEnv("SKYWELL_VERIFY_ENABLED"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid SKYWELL_VERIFY_ENABLED: %w", err)
+		}
+		cfg.Verify.Enabled = b
+	}
+	if v, ok := os.LookupEnv("SKYWELL_VERIFY_MAX_BYTES"); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SKYWELL_VERIFY_MAX_BYTES: %w", err)
+		}
+		cfg.Verify.MaxBytes = i
+	}
+	if v, ok := os.LookupEnv("SKYWELL_LEXICONS_VALIDATE_RESPONSES"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid SKYWELL_LEXICONS_VALIDATE_RESPONSES: %w", err)
+		}
+		cfg.Lexicons.ValidateResponses = b
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty entries and trailing slashes
+func splitList(v string) []string {
+	out := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimRight(strings.TrimSpace(s), "/"); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// validate returns every problem with the config at once, so they can all be fixed in one go
+func (cfg *Config) validate() error {
+	errs := []error{}
+
+	if _, _, err := net.SplitHostPort(cfg.Port); err != nil {
+		errs = append(errs, fmt.Errorf("port: %w", err))
+	}
+	if _, err := syntax.ParseDID(cfg.ServiceDID); err != nil {
+		errs = append(errs, fmt.Errorf("service_did: %w", err))
+	}
+	if cfg.UserAgent == "" {
+		errs = append(errs, errors.New("user_agent: must not be empty"))
+	}
+	if err := validateURL(cfg.BskyAPIHost, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("bsky_api_host: %w", err))
+	}
+
+	switch cfg.Database.Driver {
+	case dbDriverSQLite:
+	case dbDriverPostgres:
+		if cfg.Database.DSN == "" {
+			errs = append(errs, errors.New("database.dsn: required for the postgres driver"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("database.driver: unknown driver %q", cfg.Database.Driver))
+	}
+
+	var hosts []string
+	switch cfg.Ingest.Backend {
+	case ingestBackendJetstream:
+		hosts = cfg.Ingest.JetstreamHosts
+	case ingestBackendFirehose:
+		hosts = cfg.Ingest.FirehoseHosts
+	default:
+		errs = append(errs, fmt.Errorf("ingest.backend: unknown backend %q", cfg.Ingest.Backend))
+	}
+	if hosts != nil && len(hosts) == 0 {
+		errs = append(errs, fmt.Errorf("ingest: no hosts configured for the %s backend", cfg.Ingest.Backend))
+	}
+	for _, h := range hosts {
+		if err := validateURL(h, "ws", "wss"); err != nil {
+			errs = append(errs, fmt.Errorf("ingest: host %q: %w", h, err))
+		}
+	}
+
+	if cfg.DIDWeb.Hostname != "" {
+		if _, err := syntax.ParseDID(cfg.didWeb()); err != nil {
+			errs = append(errs, fmt.Errorf("did_web.hostname: %w", err))
+		}
+		if err := validateURL(cfg.didWebServiceEndpoint(), "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("did_web.service_endpoint: %w", err))
+		}
+	} else if cfg.DIDWeb.ServiceEndpoint != "" {
+		errs = append(errs, errors.New("did_web.service_endpoint: set without did_web.hostname"))
+	}
+
+	if cfg.BlobCache.Dir != "" && cfg.BlobCache.MaxBytes <= 0 {
+		errs = append(errs, errors.New("blob_cache.max_bytes: must be positive (set blob_cache.dir to \"\" to disable the cache)"))
+	}
+
+	if cfg.Verify.Enabled {
+		if cfg.Verify.MaxBytes < 0 {
+			errs = append(errs, errors.New("verify.max_bytes: must not be negative"))
+		}
+		if cfg.Verify.Workers <= 0 {
+			errs = append(errs, errors.New("verify.workers: must be positive"))
+		}
+	}
+
+	switch cfg.Scan.Action {
+	case scanActionHide, scanActionMark:
+	default:
+		errs = append(errs, fmt.Errorf("scan.action: must be %q or %q", scanActionHide, scanActionMark))
+	}
+	for _, s := range cfg.Scan.Scanners {
+		switch s {
+		case scannerClamAV:
+			if _, err := newClamAVScanner(cfg.Scan.ClamAVAddress); err != nil {
+				errs = append(errs, fmt.Errorf("scan.clamav_address: %w", err))
+			}
+		case scannerBlocklist:
+			if cfg.Scan.BlocklistFile == "" {
+				errs = append(errs, errors.New("scan.blocklist_file: required for the blocklist scanner"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("scan.scanners: unknown scanner %q", s))
+		}
+	}
+	if len(cfg.Scan.Scanners) > 0 {
+		if cfg.Scan.MaxBytes <= 0 {
+			errs = append(errs, errors.New("scan.max_bytes: must be positive"))
+		}
+		if cfg.Scan.Workers <= 0 {
+			errs = append(errs, errors.New("scan.workers: must be positive"))
+		}
+	}
+
+	for _, l := range cfg.Labels.Labelers {
+		if _, err := syntax.ParseDID(l); err != nil {
+			errs = append(errs, fmt.Errorf("labels.labelers: %w", err))
+		}
+	}
+	for val, action := range cfg.Labels.Actions {
+		switch action {
+		case labelActionHide, labelActionBlur, labelActionWarn, labelActionIgnore:
+		default:
+			errs = append(errs, fmt.Errorf("labels.actions: unknown action %q for %q", action, val))
+		}
+	}
+	if cfg.Labels.SigningKey != "" {
+		if _, err := crypto.ParsePrivateMultibase(cfg.Labels.SigningKey); err != nil {
+			errs = append(errs, fmt.Errorf("labels.signing_key: %w", err))
+		}
+	}
+
+	for _, a := range cfg.Admin.DIDs {
+		if _, err := syntax.ParseDID(a); err != nil {
+			errs = append(errs, fmt.Errorf("admin.dids: %w", err))
+		}
+	}
+
+	if cfg.Lexicons.Dir == "" {
+		errs = append(errs, errors.New("lexicons.dir: must not be empty"))
+	}
+
+	if cfg.RateLimit.RequestsPerSecond <= 0 {
+		errs = append(errs, errors.New("rate_limit.requests_per_second: must be positive"))
+	}
+	if cfg.RateLimit.Burst <= 0 {
+		errs = append(errs, errors.New("rate_limit.burst: must be positive"))
+	}
+	if cfg.RateLimit.Authenticated.RequestsPerSecond <= 0 || cfg.RateLimit.Authenticated.Burst <= 0 {
+		errs = append(errs, errors.New("rate_limit.authenticated: requests_per_second and burst must be positive"))
+	}
+	for nsid, b := range cfg.RateLimit.Endpoints {
+		if _, err := syntax.ParseNSID(nsid); err != nil {
+			errs = append(errs, fmt.Errorf("rate_limit.endpoints: %w", err))
+		}
+		if b.RequestsPerSecond <= 0 || b.Burst <= 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.endpoints.%q: requests_per_second and burst must be positive", nsid))
+		}
+	}
+	if _, err := parseTrustedProxies(cfg.RateLimit.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit.trusted_proxies: %w", err))
+	}
+	if cfg.RateLimit.CleanupInterval <= 0 || cfg.RateLimit.MaxIdleTime <= 0 {
+		errs = append(errs, errors.New("rate_limit: cleanup_interval and max_idle_time must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateURL(s string, schemes ...string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("scheme must be one of %v", schemes)
+}
+
+// runConfig implements the `config` subcommand
+func runConfig(args []string, cfg *Config) error {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: skywell [-config path] config check\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.Arg(0) != "check" {
+		fs.Usage()
+		return errors.New("unknown config command " + fs.Arg(0))
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	// print what we ended up with, minus the postgres DSN since it might have a password in it
+	// and the labeler's private key
+	shown := *cfg
+	if shown.Database.Driver == dbDriverPostgres && shown.Database.DSN != "" {
+		shown.Database.DSN = "(set)"
+	}
+	if shown.Labels.SigningKey != "" {
+		shown.Labels.SigningKey = "(set)"
+	}
+	if err := toml.NewEncoder(os.Stdout).Encode(shown); err != nil {
+		return err
+	}
+	fmt.Println("# config ok")
+	return nil
+}
@@ -7,10 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	b58 "github.com/mr-tron/base58"
 	"github.com/saturn-vi/skywell/api/skywell"
 
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -24,17 +27,21 @@ import (
 
 type User struct {
 	gorm.Model
-	DID         syntax.DID `gorm:"uniqueIndex;column:did"`
+	DID         syntax.DID `gorm:"uniqueIndex:idx_users_did;column:did"`
 	Handle      syntax.Handle
 	Avatar      syntax.URI
 	DisplayName string
+	// hosting status from the account's PDS, e.g. takendown or deactivated.
+	// empty means the account is active
+	Status string
+	// taken down by one of our admins (see admin.go). separate from Status, the PDS doesn't know about it
+	TakenDown bool `gorm:"index;not null;default:false"`
 }
 
 type FileKey struct {
 	gorm.Model
-	gorm.DeletedAt `gorm:"index"`
-	Key            string `gorm:"uniqueIndex"`
-	File           uint   `gorm:"uniqueIndex:idx_file_key"`
+	Key  string `gorm:"uniqueIndex"`
+	File uint   `gorm:"uniqueIndex:idx_file_key"`
 }
 
 type File struct {
@@ -50,38 +57,103 @@ type File struct {
 	BlobRef     syntax.CID
 	MimeType    string
 	Size        int64
+	// sha256 of the whole file when it's split across several blobs, empty otherwise. see chunks.go
+	Hash string `gorm:"index;not null;default:''"`
+	// whether the chunks have been seen to put back together into Hash. until then ranges aren't served
+	HashVerified bool `gorm:"not null;default:false"`
+	// whether the blob matches what the record claims, see verify.go
+	Verification     string `gorm:"index;not null;default:pending"`
+	DetectedMimeType string
+	VerifyError      string
+	VerifyAttempts   int
+	// what the malware scanners made of the blob, see scan.go
+	ScanStatus   string `gorm:"index;not null;default:pending"`
+	ScanResult   string
+	ScanAttempts int
+	// taken down by one of our admins, see admin.go
+	TakenDown bool `gorm:"index;not null;default:false"`
 }
 
+// IngestCursor stores how far we've gotten through an event stream,
+// so we can pick up where we left off after a restart
+type IngestCursor struct {
+	Service   string `gorm:"primaryKey"`
+	Cursor    int64
+	UpdatedAt time.Time
+}
+
+// IngestError is a record we couldn't index.
+// they're kept for a week so admins can see what's going wrong without digging through logs
+type IngestError struct {
+	ID         uint      `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"index"`
+	DID        string    `gorm:"column:did;index"`
+	Uri        string
+	Collection string
+	Operation  string
+	Error      string
+}
+
+const ingestErrorRetention = 7 * 24 * time.Hour
+
 const SlugLength int = 6 // enough entropy for anyone
 
-func initializeDB() (db *gorm.DB, client *xrpc.Client, err error) {
-	db, err = gorm.Open(sqlite.Open("database.db"), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Silent), // Disable GORM logging
-	})
+// the schema is managed by migrations.go, not AutoMigrate
+func initializeDB(cfg *Config) (db *gorm.DB, client *xrpc.Client, err error) {
+	db, err = openDB(cfg)
 	if err != nil {
 		return nil, nil, err
 	}
-	err = db.AutoMigrate(&File{})
-	if err != nil {
-		return nil, nil, err
-	}
-	err = db.AutoMigrate(&User{})
-	if err != nil {
-		return nil, nil, err
-	}
-	err = db.AutoMigrate(&FileKey{})
+	err = migrateUp(db)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	client = &xrpc.Client{
 		Client:    &http.Client{},
-		Host:      "https://public.api.bsky.app",
-		UserAgent: userAgent(),
+		Host:      cfg.BskyAPIHost,
+		UserAgent: userAgent(cfg),
 	}
 	return db, client, nil
 }
 
+const (
+	dbDriverSQLite   = "sqlite"
+	dbDriverPostgres = "postgres"
+)
+
+// openDB connects to the database in cfg.Database.
+// defaults to database.db in the working directory
+func openDB(cfg *Config) (db *gorm.DB, err error) {
+	dsn := cfg.Database.DSN
+
+	var dialector gorm.Dialector
+	switch driver := cfg.Database.Driver; driver {
+	case dbDriverSQLite:
+		if dsn == "" {
+			dsn = "database.db"
+		}
+		// WAL lets the HTTP handlers read while jetstream is writing,
+		// and the busy timeout makes writers wait for each other instead of failing
+		if !strings.Contains(dsn, "?") {
+			dsn += "?_journal_mode=WAL&_busy_timeout=5000"
+		}
+		dialector = sqlite.Open(dsn)
+	case dbDriverPostgres:
+		if dsn == "" {
+			return nil, fmt.Errorf("a DSN is required for the postgres driver")
+		}
+		dialector = postgres.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+
+	return gorm.Open(dialector, &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent), // Disable GORM logging
+		TranslateError: true,                                  // so unique violations are gorm.ErrDuplicatedKey on every driver
+	})
+}
+
 func updateIdentity(evt jetstream.Event, db *gorm.DB, client *xrpc.Client, ctx context.Context) {
 	// updateIdentity called when identity cache should be purged
 	if evt.Kind != jetstream.EventKindIdentity {
@@ -105,19 +177,147 @@ func updateIdentity(evt jetstream.Event, db *gorm.DB, client *xrpc.Client, ctx c
 	}
 }
 
-func updateAccount(evt jetstream.Event) {
+func updateAccount(evt jetstream.Event, db *gorm.DB) {
 	// updateAccount called on account status change, e.g. active, inactive, or takendown
-	if evt.Kind != jetstream.EventKindAccount {
+	if evt.Kind != jetstream.EventKindAccount || evt.Account == nil {
+		return
+	}
+
+	user := User{}
+	err := db.First(&user, "did = ?", evt.Did).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// they haven't made any files, nothing to hide
+		return
+	} else if err != nil {
+		dbLogger.Error("Failed to query user for account update", "did", evt.Did, "error", err)
+		return
+	}
+
+	status := ""
+	if !evt.Account.Active {
+		status = "inactive"
+		if evt.Account.Status != nil {
+			status = *evt.Account.Status
+		}
+	}
+
+	if status == "deleted" {
+		if err := purgeUser(user, db); err != nil {
+			dbLogger.Error("Failed to purge deleted account", "did", evt.Did, "user_id", user.ID, "error", err)
+			return
+		}
+		jetstreamLogger.Info("Purged deleted account", "did", evt.Did, "user_id", user.ID)
+		return
+	}
+
+	if status == user.Status {
+		return
+	}
+	if err := db.Model(&user).Update("status", status).Error; err != nil {
+		dbLogger.Error("Failed to update account status", "did", evt.Did, "status", status, "error", err)
 		return
 	}
-	// TODO implement
-	// we don't care about it yet though
+	jetstreamLogger.Info("Updated account status", "did", evt.Did, "status", status, "active", evt.Account.Active)
 }
 
-func updateRecord(evt jetstream.Event, db *gorm.DB, client *xrpc.Client, ctx context.Context) {
-	// updateRecord called on commit to repo
+// purgeUser removes a user and everything they've made, for good
+func purgeUser(user User, db *gorm.DB) error {
+	blobRefs := []string{}
+	if err := db.Unscoped().Model(&File{}).Where("user_id = ?", user.ID).Distinct().Pluck("blob_ref", &blobRefs).Error; err != nil {
+		return err
+	}
+	chunkRefs := []string{}
+	userFileIDs := db.Unscoped().Model(&File{}).Select("id").Where("user_id = ?", user.ID)
+	if err := db.Model(&FileChunk{}).Where("file_id IN (?)", userFileIDs).Distinct().Pluck("blob_ref", &chunkRefs).Error; err != nil {
+		return err
+	}
+	blobRefs = append(blobRefs, chunkRefs...)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		fileIDs := tx.Unscoped().Model(&File{}).Select("id").Where("user_id = ?", user.ID)
+		if err := tx.Unscoped().Where("file IN (?)", fileIDs).Delete(&FileKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id IN (?)", fileIDs).Delete(&FileChunk{}).Error; err != nil {
+			return err
+		}
+		if err := unindexFileSearch(fileIDs, tx); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&File{}).Error; err != nil {
+			return err
+		}
+		collectionIDs := tx.Unscoped().Model(&Collection{}).Select("id").Where("user_id = ?", user.ID)
+		if err := tx.Where("collection_id IN (?)", collectionIDs).Delete(&CollectionFile{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&Collection{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range blobRefs {
+		releaseBlob(c, db)
+	}
+	return nil
+}
+
+// recordIngestError keeps track of a record that couldn't be indexed, on top of logging it.
+// it hands err back so callers can return it
+func recordIngestError(evt jetstream.Event, uri string, err error, db *gorm.DB) error {
+	ie := IngestError{DID: evt.Did, Uri: uri, Error: err.Error()}
+	if evt.Commit != nil {
+		ie.Collection = evt.Commit.Collection
+		ie.Operation = evt.Commit.Operation
+	}
+	if cerr := db.Create(&ie).Error; cerr != nil {
+		dbLogger.Error("Failed to record ingest error", "did", evt.Did, "uri", uri, "error", cerr)
+		return err
+	}
+	if perr := db.Where("created_at < ?", time.Now().Add(-ingestErrorRetention)).Delete(&IngestError{}).Error; perr != nil {
+		dbLogger.Error("Failed to prune ingest errors", "error", perr)
+	}
+	return err
+}
+
+// findOrCreateUser gets the user for did, fetching their profile if we haven't seen them before
+func findOrCreateUser(did string, db *gorm.DB, client *xrpc.Client, ctx context.Context) (user User, err error) {
+	err = db.First(&user, "did = ?", did).Error
+	if err == nil {
+		return user, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, fmt.Errorf("failed to find user: %w", err)
+	}
+
+	dbLogger.Debug("User not found, creating new user", "did", did)
+	h, d, a, err := getUserData(syntax.DID(did), client, ctx)
+	if err != nil {
+		return user, fmt.Errorf("failed to get user data: %w", err)
+	}
+	user = User{
+		DID:         syntax.DID(did),
+		Handle:      h,
+		DisplayName: d,
+		Avatar:      a,
+	}
+	if err := db.Create(&user).Error; errors.Is(err, gorm.ErrDuplicatedKey) {
+		// someone else (e.g. a backfill) created them first
+		if err := db.First(&user, "did = ?", did).Error; err != nil {
+			return user, fmt.Errorf("failed to find user: %w", err)
+		}
+	} else if err != nil {
+		return user, fmt.Errorf("failed to create user: %w", err)
+	}
+	return user, nil
+}
+
+// updateRecord indexes a commit to someone's repo. err is nil when the record was indexed
+// (or there was nothing to do, like a replayed event), and already logged when it isn't
+func updateRecord(evt jetstream.Event, db *gorm.DB, client *xrpc.Client, ctx context.Context) (err error) {
 	if evt.Kind != jetstream.EventKindCommit {
-		return
+		return nil
 	}
 
 	switch evt.Commit.Collection {
@@ -125,62 +325,68 @@ func updateRecord(evt jetstream.Event, db *gorm.DB, client *xrpc.Client, ctx con
 		uri, err := syntax.ParseURI(fmt.Sprintf("at://%s/%s/%s", evt.Did, evt.Commit.Collection, evt.Commit.RKey))
 		if err != nil {
 			jetstreamLogger.Error("Failed to parse URI", "did", evt.Did, "error", err)
-			return
+			return fmt.Errorf("invalid URI: %w", err)
 		}
 
-		// get user
-		var user User
-		result := db.First(&user, "did = ?", evt.Did)
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			// user not found, create user
-			dbLogger.Debug("User not found, creating new user", "did", evt.Did)
-			h, d, a, err := getUserData(syntax.DID(evt.Did), client, ctx)
-			if err != nil {
-				jetstreamLogger.Error("Failed to get user data", "did", evt.Did, "error", err)
-				return
-			}
-			user = User{
-				DID:         syntax.DID(evt.Did),
-				Handle:      h,
-				DisplayName: d,
-				Avatar:      a,
-			}
-
-			if err := db.Create(&user).Error; err != nil {
-				dbLogger.Error("Failed to create user", "did", evt.Did, "handle", h.String(), "error", err)
-				return
-			}
+		user, err := findOrCreateUser(evt.Did, db, client, ctx)
+		if err != nil {
+			dbLogger.Error("Failed to find or create user", "did", evt.Did, "error", err)
+			return recordIngestError(evt, uri.String(), err, db)
 		}
 
 		switch evt.Commit.Operation {
 		case jetstream.CommitOperationCreate, jetstream.CommitOperationUpdate:
+			// anything that doesn't match the lexicon isn't indexed, whatever was there before stays
+			if n, err := validateRecord(evt.Commit.Record, evt.Commit.Collection); err != nil {
+				jetstreamLogger.Warn("Record failed lexicon validation", "uri", uri.String(), "did", evt.Did, "failures", n, "error", err)
+				return recordIngestError(evt, uri.String(), fmt.Errorf("record doesn't match the lexicon: %w", err), db)
+			}
+
 			var r skywell.File
 			err = json.Unmarshal(evt.Commit.Record, &r)
 			if err != nil {
 				jetstreamLogger.Error("Failed to unmarshal to file", "did", evt.Did, "error", err)
-				return
+				return recordIngestError(evt, uri.String(), fmt.Errorf("invalid record: %w", err), db)
 			}
 
 			cid, err := syntax.ParseCID(evt.Commit.CID)
 			if err != nil {
 				jetstreamLogger.Error("Failed to parse CID", "cid", r.BlobRef.Ref.String(), "uri", uri.String(), "did", evt.Did, "error", err)
-				return
+				return recordIngestError(evt, uri.String(), fmt.Errorf("invalid CID: %w", err), db)
 			}
 
 			pt, err := syntax.ParseDatetime(r.CreatedAt)
 			if err != nil {
 				jetstreamLogger.Error("Failed to parse createdAt", "created_at", r.CreatedAt, "uri", uri.String(), "did", evt.Did, "error", err)
-				return
+				return recordIngestError(evt, uri.String(), fmt.Errorf("invalid createdAt: %w", err), db)
 			}
 
 			if r.BlobRef == nil {
 				jetstreamLogger.Error("BlobRef is nil", "uri", uri.String(), "did", evt.Did)
-				return
+				return recordIngestError(evt, uri.String(), errors.New("record has no blob"), db)
 			}
 			pc, err := syntax.ParseCID(r.BlobRef.Ref.String())
 			if err != nil {
 				jetstreamLogger.Error("Failed to parse blobRef", "blob_ref", r.BlobRef.Ref.String(), "uri", uri.String(), "did", evt.Did, "error", err)
-				return
+				return recordIngestError(evt, uri.String(), fmt.Errorf("invalid blob CID: %w", err), db)
+			}
+			chunks, hash, err := parseChunks(&r)
+			if err != nil {
+				jetstreamLogger.Warn("Invalid chunks", "uri", uri.String(), "did", evt.Did, "error", err)
+				return recordIngestError(evt, uri.String(), fmt.Errorf("invalid chunks: %w", err), db)
+			}
+
+			// jetstream replays a few seconds of events whenever we reconnect,
+			// so we might have already seen this exact version of the record
+			existing := File{}
+			err = db.Unscoped().Where("uri = ?", uri.String()).First(&existing).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				dbLogger.Error("Failed to query existing file", "uri", uri.String(), "did", evt.Did, "error", err)
+				return fmt.Errorf("failed to query existing file: %w", err)
+			}
+			if err == nil && !existing.DeletedAt.Valid && existing.Cid == cid {
+				jetstreamLogger.Debug("File already indexed, skipping", "file_id", existing.ID, "uri", uri.String(), "cid", cid.String(), "did", evt.Did)
+				return nil
 			}
 
 			file := File{
@@ -193,51 +399,82 @@ func updateRecord(evt jetstream.Event, db *gorm.DB, client *xrpc.Client, ctx con
 				BlobRef:   pc,
 				MimeType:  r.BlobRef.MimeType,
 				Size:      r.BlobRef.Size,
+				Hash:      hash,
+				// any change to the record gets checked again, the claims might be different
+				Verification: verifyPending,
+				ScanStatus:   scanPending,
+			}
+			if existing.ID != 0 && !existing.DeletedAt.Valid && existing.BlobRef == pc && existing.Hash == hash {
+				// same blob (or same chunked file), the verdict still stands.
+				// a chunked file is only the same if every chunk is, the hash is just the record's word
+				same := true
+				if hash != "" {
+					oldChunks, err := fileChunks(existing.ID, db)
+					if err != nil {
+						dbLogger.Error("Failed to get file chunks", "file_id", existing.ID, "uri", uri.String(), "did", evt.Did, "error", err)
+						return fmt.Errorf("failed to get file chunks: %w", err)
+					}
+					same = sameChunks(oldChunks, chunks)
+				}
+				if same {
+					file.HashVerified = existing.HashVerified
+					file.ScanStatus = existing.ScanStatus
+					file.ScanResult = existing.ScanResult
+					file.ScanAttempts = existing.ScanAttempts
+				}
 			}
 
 			if r.Description != nil {
 				file.Description = *r.Description
 			}
 
-			fk, err := generateSlug(db, file.BlobRef, file.Uri)
-
-			if err != nil {
-				dbLogger.Error("Failed to generate slug", "file_name", file.Name, "user_id", user.ID, "uri", uri.String(), "did", evt.Did, "error", err)
-				return
-			}
-
-			filekey := FileKey{
-				Key:  fk,
-				File: 0,
-			}
-
+			// deleted_at is reset so that a record recreated under the same rkey comes back
 			err = db.Clauses(clause.OnConflict{
-				Columns:   []clause.Column{{Name: "uri"}},
-				DoUpdates: clause.AssignmentColumns([]string{"name", "description", "blob_ref", "mime_type", "size"}),
+				Columns: []clause.Column{{Name: "uri"}},
+				DoUpdates: clause.AssignmentColumns([]string{
+					"cid", "name", "description", "blob_ref", "mime_type", "size", "hash", "hash_verified", "deleted_at",
+					"verification", "detected_mime_type", "verify_error", "verify_attempts",
+					"scan_status", "scan_result", "scan_attempts",
+				}),
 			}).Create(&file).Error
 			if err != nil {
 				dbLogger.Error("Failed to create or update file", "file_name", file.Name, "user_id", user.ID, "uri", uri.String(), "did", evt.Did, "error", err)
-				return
+				return recordIngestError(evt, uri.String(), fmt.Errorf("failed to create or update file: %w", err), db)
 			}
-			filekey.File = file.ID // set the file ID after file is created/updated
-			dbLogger.Debug("Creating filekey", "key", filekey.Key, "file_id", file.ID, "user_id", user.ID, "did", evt.Did)
-			err = db.Clauses(clause.OnConflict{
-				DoNothing: true,
-			}).Create(&filekey).Error
+
+			slug, err := ensureFileKey(db, file)
+			if err != nil {
+				dbLogger.Error("Failed to create file key", "file_id", file.ID, "user_id", user.ID, "uri", uri.String(), "did", evt.Did, "error", err)
+				return recordIngestError(evt, uri.String(), fmt.Errorf("failed to create file key: %w", err), db)
+			}
+			if err := indexFileSearch(file, db); err != nil {
+				dbLogger.Error("Failed to update search index", "file_id", file.ID, "uri", uri.String(), "did", evt.Did, "error", err)
+			}
+			oldChunks, err := replaceFileChunks(file.ID, chunks, db)
 			if err != nil {
-				dbLogger.Error("Failed to create file key", "key", filekey.Key, "file_id", file.ID, "user_id", user.ID, "did", evt.Did, "error", err)
-				return
+				dbLogger.Error("Failed to update file chunks", "file_id", file.ID, "uri", uri.String(), "did", evt.Did, "error", err)
+				return recordIngestError(evt, uri.String(), fmt.Errorf("failed to update file chunks: %w", err), db)
+			}
+			if existing.ID != 0 && existing.BlobRef != pc {
+				// the record points at a new blob now
+				releaseBlob(existing.BlobRef.String(), db)
+			}
+			for _, c := range oldChunks {
+				releaseBlob(c, db)
 			}
-			jetstreamLogger.Info("Created file", "file_id", file.ID, "file_name", file.Name, "slug", filekey.Key, "did", evt.Did)
+			wakeVerifier()
+			wakeScanner()
+			jetstreamLogger.Info("Created file", "file_id", file.ID, "file_name", file.Name, "slug", slug, "did", evt.Did)
 		case jetstream.CommitOperationDelete:
 			var fd File
 			if err := db.Where("uri = ?", uri.String()).First(&fd).Error; err != nil {
 				if errors.Is(err, gorm.ErrRecordNotFound) {
-					dbLogger.Warn("Attempted to delete non-existent file", "uri", uri.String(), "did", evt.Did)
-				} else {
-					dbLogger.Error("Failed to query file for deletion", "uri", uri.String(), "did", evt.Did, "error", err)
+					// most likely a replayed delete
+					dbLogger.Debug("Attempted to delete non-existent file", "uri", uri.String(), "did", evt.Did)
+					return nil
 				}
-				return
+				dbLogger.Error("Failed to query file for deletion", "uri", uri.String(), "did", evt.Did, "error", err)
+				return fmt.Errorf("failed to query file for deletion: %w", err)
 			}
 
 			var fk FileKey
@@ -247,9 +484,10 @@ func updateRecord(evt jetstream.Event, db *gorm.DB, client *xrpc.Client, ctx con
 				} else {
 					dbLogger.Error("Failed to query file key for deletion", "file_id", fd.ID, "did", evt.Did, "error", err)
 				}
-				return
+				return fmt.Errorf("failed to find file key: %w", err)
 			}
 
+			chunkRefs := []string{}
 			err = db.Transaction(func(tx *gorm.DB) error {
 				if err := tx.Delete(&fd).Error; err != nil {
 					return err
@@ -257,38 +495,74 @@ func updateRecord(evt jetstream.Event, db *gorm.DB, client *xrpc.Client, ctx con
 				if err := tx.Delete(&fk).Error; err != nil {
 					return err
 				}
-				return nil
+				// the chunks go for good, a recreated record brings its own
+				if err := tx.Model(&FileChunk{}).Where("file_id = ?", fd.ID).Pluck("blob_ref", &chunkRefs).Error; err != nil {
+					return err
+				}
+				if err := tx.Where("file_id = ?", fd.ID).Delete(&FileChunk{}).Error; err != nil {
+					return err
+				}
+				return unindexFileSearch([]uint{fd.ID}, tx)
 			})
 
 			if err != nil {
 				dbLogger.Error("Failed to delete file", "file_id", fd.ID, "file_name", fd.Name, "slug", fk.Key, "did", evt.Did, "error", err)
-				return
+				return recordIngestError(evt, uri.String(), fmt.Errorf("failed to delete file: %w", err), db)
 			}
 
+			releaseBlob(fd.BlobRef.String(), db)
+			for _, c := range chunkRefs {
+				releaseBlob(c, db)
+			}
 			jetstreamLogger.Info("Deleted file", "file_id", fd.ID, "file_name", fd.Name, "slug", fk.Key, "did", evt.Did)
 		default:
 			jetstreamLogger.Warn("Unknown commit operation", "operation", evt.Commit.Operation, "collection", evt.Commit.Collection, "did", evt.Did)
+			return fmt.Errorf("unknown commit operation %q", evt.Commit.Operation)
+		}
+
+	case "dev.skywell.collection":
+		uri, err := syntax.ParseURI(fmt.Sprintf("at://%s/%s/%s", evt.Did, evt.Commit.Collection, evt.Commit.RKey))
+		if err != nil {
+			jetstreamLogger.Error("Failed to parse URI", "did", evt.Did, "error", err)
+			return fmt.Errorf("invalid URI: %w", err)
+		}
+
+		switch evt.Commit.Operation {
+		case jetstream.CommitOperationCreate, jetstream.CommitOperationUpdate:
+			user, err := findOrCreateUser(evt.Did, db, client, ctx)
+			if err != nil {
+				dbLogger.Error("Failed to find or create user", "did", evt.Did, "error", err)
+				return recordIngestError(evt, uri.String(), err, db)
+			}
+			return updateCollection(evt, uri, user, db)
+		case jetstream.CommitOperationDelete:
+			return deleteCollection(evt, uri, db)
+		default:
+			jetstreamLogger.Warn("Unknown commit operation", "operation", evt.Commit.Operation, "collection", evt.Commit.Collection, "did", evt.Did)
+			return fmt.Errorf("unknown commit operation %q", evt.Commit.Operation)
 		}
 
 	case "app.bsky.actor.profile":
 		if evt.Commit.Operation == jetstream.CommitOperationDelete {
-			return // no need to handle delete for profile
+			return nil // no need to handle delete for profile
 		}
 
 		did, err := syntax.ParseDID(evt.Did)
 		if err != nil {
 			jetstreamLogger.Error("Failed to parse DID for profile update", "did", evt.Did, "error", err)
-			return
+			return fmt.Errorf("invalid DID: %w", err)
 		}
 		err = updateUserProfile(did, false, db, client, ctx)
 		if err != nil {
 			jetstreamLogger.Error("Failed to update user profile", "did", evt.Did, "error", err)
-			return
+			return fmt.Errorf("failed to update user profile: %w", err)
 		}
 
 	default:
 		jetstreamLogger.Warn("Unknown collection", "collection", evt.Commit.Collection, "operation", evt.Commit.Operation, "did", evt.Did)
+		return fmt.Errorf("unknown collection %q", evt.Commit.Collection)
 	}
+	return nil
 }
 
 func generateSlug(db *gorm.DB, cid syntax.CID, uri syntax.URI) (slug string, err error) {
@@ -314,19 +588,123 @@ func generateSlug(db *gorm.DB, cid syntax.CID, uri syntax.URI) (slug string, err
 	fk := FileKey{}
 
 	for {
-		err := db.First(&fk, "key = ?", cb).Error
+		// deleted keys still hold their spot in the unique index
+		err := db.Unscoped().First(&fk, "key = ?", cb).Error
 
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return cb, nil // found a unique slug
+			// and so do ones an admin reserved, and collections' (see collection.go)
+			reserved, err := slugReserved(cb, db)
+			if err != nil {
+				return "", err
+			}
+			taken, err := collectionHasSlug(cb, db)
+			if err != nil {
+				return "", err
+			}
+			if !reserved && !taken {
+				return cb, nil // found a unique slug
+			}
+		} else if err != nil {
+			return "", err
+		}
+
+		counter++
+		cb = fmt.Sprintf("%s%d", tb, counter)
+	}
+}
+
+// ensureFileKey returns the slug for a file, creating one if needed.
+// a file that already had a slug keeps it (even if it was deleted and came back)
+func ensureFileKey(db *gorm.DB, file File) (slug string, err error) {
+	fk := FileKey{}
+	err = db.Unscoped().Where("file = ?", file.ID).First(&fk).Error
+	if err == nil {
+		if fk.DeletedAt.Valid {
+			dbLogger.Debug("Restoring filekey", "key", fk.Key, "file_id", file.ID)
+			if err := db.Unscoped().Model(&fk).Update("deleted_at", nil).Error; err != nil {
+				return "", err
+			}
 		}
+		return fk.Key, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
 
+	// another writer can take the slug between generateSlug checking it and us inserting it,
+	// so if the insert collides we just try again
+	for attempt := 0; attempt < 5; attempt++ {
+		key, err := generateSlug(db, file.BlobRef, file.Uri)
 		if err != nil {
+			return "", fmt.Errorf("failed to generate slug: %w", err)
+		}
+		fk = FileKey{
+			Key:  key,
+			File: file.ID,
+		}
+		dbLogger.Debug("Creating filekey", "key", fk.Key, "file_id", file.ID)
+		err = db.Create(&fk).Error
+		if err == nil {
+			return fk.Key, nil
+		}
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
 			return "", err
 		}
+		// the collision might be on the file instead, if someone else indexed it at the same time
+		existing := FileKey{}
+		if err := db.Unscoped().Where("file = ?", file.ID).First(&existing).Error; err == nil {
+			return existing.Key, nil
+		}
+		dbLogger.Debug("Slug taken while creating filekey, retrying", "key", key, "file_id", file.ID, "attempt", attempt)
+	}
+	return "", fmt.Errorf("failed to create a unique slug for file %d", file.ID)
+}
 
-		counter++
-		cb = fmt.Sprintf("%s%d", tb, counter)
+// fileBySlug finds the file a slug points to and who made it.
+// files that shouldn't be shown to anyone (e.g. from inactive accounts, flagged by a scanner or hidden by a label) are 404s
+func fileBySlug(slug string, db *gorm.DB, cfg *Config) (file File, user User, httpResponse int, err error) {
+	fk := FileKey{}
+	if err := db.Where("key = ?", slug).First(&fk).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return file, user, 404, fmt.Errorf("no file key for slug")
+	} else if err != nil {
+		return file, user, 500, fmt.Errorf("failed to find file key: %w", err)
+	}
+	if err := db.Scopes(visibleFiles(false, cfg)).Where("id = ?", fk.File).First(&file).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return file, user, 404, fmt.Errorf("file %d not found", fk.File)
+	} else if err != nil {
+		return file, user, 500, fmt.Errorf("failed to find file: %w", err)
+	}
+	if err := db.Where("id = ?", file.UserID).First(&user).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return file, user, 404, fmt.Errorf("user %d not found", file.UserID)
+	} else if err != nil {
+		return file, user, 500, fmt.Errorf("failed to find user: %w", err)
+	}
+	if user.Status != "" {
+		// files from taken down or deactivated accounts stay hidden until the account comes back
+		return file, user, 404, fmt.Errorf("account is %s", user.Status)
+	}
+	if user.TakenDown {
+		return file, user, 404, fmt.Errorf("account was taken down by an admin")
 	}
+	return file, user, 200, nil
+}
+
+func loadCursor(service string, db *gorm.DB) (cursor int64, err error) {
+	ic := IngestCursor{}
+	err = db.First(&ic, "service = ?", service).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return ic.Cursor, nil
+}
+
+func saveCursor(service string, cursor int64, db *gorm.DB) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "service"}},
+		DoUpdates: clause.AssignmentColumns([]string{"cursor", "updated_at"}),
+	}).Create(&IngestCursor{Service: service, Cursor: cursor}).Error
 }
 
 func updateUserProfile(did syntax.DID, forceIndex bool, db *gorm.DB, client *xrpc.Client, ctx context.Context) error {
@@ -358,7 +736,8 @@ func updateUserProfile(did syntax.DID, forceIndex bool, db *gorm.DB, client *xrp
 	return nil
 }
 
-func getActorFileCount(did syntax.DID, db *gorm.DB) (count int64, err error) {
+// getActorFileCount counts did's files, owner says whether did is the one asking
+func getActorFileCount(did syntax.DID, owner bool, db *gorm.DB, cfg *Config) (count int64, err error) {
 	user := User{}
 	result := db.First(&user, "did = ?", did.String())
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
@@ -367,7 +746,7 @@ func getActorFileCount(did syntax.DID, db *gorm.DB) (count int64, err error) {
 		return 0, fmt.Errorf("failed to find user with DID %s: %w", did, result.Error)
 	}
 	count = 0
-	result = db.Model(&File{}).Where("user_id = ?", user.ID).Count(&count)
+	result = db.Model(&File{}).Scopes(visibleFiles(owner, cfg)).Where("user_id = ?", user.ID).Count(&count)
 	if result.Error != nil {
 		return 0, fmt.Errorf("failed to count files for user with DID %s: %w", did, result.Error)
 	}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	jetstream "github.com/bluesky-social/jetstream/pkg/models"
+)
+
+func TestMigrations(t *testing.T) {
+	forEachTestDB(t, func(t *testing.T, db *gorm.DB, cfg *Config) {
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			t.Fatalf("appliedMigrations: %v", err)
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; !ok {
+				t.Errorf("migration %d (%s) wasn't applied", m.version, m.name)
+			}
+		}
+		if len(applied) != len(migrations) {
+			t.Errorf("%d migrations applied, want %d", len(applied), len(migrations))
+		}
+
+		// running them again is a no-op
+		if err := migrateUp(db); err != nil {
+			t.Fatalf("migrateUp again: %v", err)
+		}
+		again, err := appliedMigrations(db)
+		if err != nil {
+			t.Fatalf("appliedMigrations: %v", err)
+		}
+		for v, m := range again {
+			if !m.AppliedAt.Equal(applied[v].AppliedAt) {
+				t.Errorf("migration %d was applied again", v)
+			}
+		}
+	})
+}
+
+func TestFileListAndSearch(t *testing.T) {
+	forEachTestDB(t, func(t *testing.T, db *gorm.DB, cfg *Config) {
+		createTestUser(t, db, testDID)
+		names := []string{"holiday photos", "holiday video", "tax return", "recipe book", "holiday playlist"}
+		for i, name := range names {
+			if err := ingestTestRecord(db, "dev.skywell.file", fmt.Sprintf("3kaaaaaaaa%03d", i), testFileRecord(name)); err != nil {
+				t.Fatalf("failed to index %q: %v", name, err)
+			}
+			// indexed_at only goes down to the millisecond, and the order should be the same every time
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		// getActorFiles, two at a time, newest first
+		seen := []string{}
+		cursor := ""
+		for page := 0; ; page++ {
+			if page > len(names) {
+				t.Fatal("pagination doesn't end")
+			}
+			next, fvs, stat, err := generateFileList(cursor, 2, syntax.DID(testDID), "", db, cfg)
+			if err != nil {
+				t.Fatalf("generateFileList(%q): %d %v", cursor, stat, err)
+			}
+			for _, fv := range *fvs {
+				seen = append(seen, fv.Name)
+			}
+			if len(*fvs) == 0 {
+				break
+			}
+			cursor = next
+		}
+		if len(seen) != len(names) {
+			t.Fatalf("listed %v, want all of %v", seen, names)
+		}
+		for i, name := range seen {
+			if want := names[len(names)-1-i]; name != want {
+				t.Errorf("file %d is %q, want %q", i, name, want)
+			}
+		}
+		if _, _, stat, _ := generateFileList("yesterday", 2, syntax.DID(testDID), "", db, cfg); stat != 400 {
+			t.Errorf("invalid cursor gave %d, want 400", stat)
+		}
+
+		search := func(q string, mimeType string) []string {
+			t.Helper()
+			_, fvs, stat, err := searchFiles(q, "", mimeType, 25, "", db, cfg)
+			if err != nil {
+				t.Fatalf("searchFiles(%q): %d %v", q, stat, err)
+			}
+			found := []string{}
+			for _, fv := range fvs {
+				found = append(found, fv.Name)
+			}
+			return found
+		}
+		if found := search("holiday", ""); len(found) != 3 {
+			t.Errorf("search for holiday found %v, want 3 files", found)
+		}
+		if found := search("tax", "text/"); len(found) != 1 || found[0] != "tax return" {
+			t.Errorf("search for tax in text/ found %v, want [tax return]", found)
+		}
+		if found := search("tax", "image/"); len(found) != 0 {
+			t.Errorf("search for tax in image/ found %v, want nothing", found)
+		}
+		if found := search("spreadsheet", ""); len(found) != 0 {
+			t.Errorf("search for spreadsheet found %v, want nothing", found)
+		}
+
+		// deleted files are gone from both
+		if err := deleteTestRecord(db, "dev.skywell.file", "3kaaaaaaaa000"); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+		if found := search("holiday", ""); len(found) != 2 {
+			t.Errorf("search for holiday after a delete found %v, want 2 files", found)
+		}
+		_, fvs, _, err := generateFileList("", 25, syntax.DID(testDID), "", db, cfg)
+		if err != nil {
+			t.Fatalf("generateFileList: %v", err)
+		}
+		if len(*fvs) != len(names)-1 {
+			t.Errorf("listed %d files after a delete, want %d", len(*fvs), len(names)-1)
+		}
+	})
+}
+
+func TestFileSearchWithoutFTS(t *testing.T) {
+	db, cfg := newTestDB(t)
+	createTestUser(t, db, testDID)
+	for i, name := range []string{"holiday photos", "Holiday video", "tax return"} {
+		if err := ingestTestRecord(db, "dev.skywell.file", fmt.Sprintf("3kaaaaaaaa%03d", i), testFileRecord(name)); err != nil {
+			t.Fatalf("failed to index %q: %v", name, err)
+		}
+	}
+	search := func(q string) []string {
+		t.Helper()
+		_, fvs, stat, err := searchFiles(q, "", "", 25, "", db, cfg)
+		if err != nil {
+			t.Fatalf("searchFiles(%q): %d %v", q, stat, err)
+		}
+		found := []string{}
+		for _, fv := range fvs {
+			found = append(found, fv.Name)
+		}
+		return found
+	}
+
+	// as if we'd been built without FTS5
+	if err := db.Exec("DROP TABLE IF EXISTS files_fts").Error; err != nil {
+		t.Fatalf("failed to drop files_fts: %v", err)
+	}
+	if useFTS(db) {
+		t.Fatal("useFTS is true without files_fts")
+	}
+	if found := search("holiday"); len(found) != 2 {
+		t.Errorf("LIKE search for holiday found %v, want 2 files", found)
+	}
+	if found := search("holiday vid"); len(found) != 1 || found[0] != "Holiday video" {
+		t.Errorf("LIKE search for holiday vid found %v, want [Holiday video]", found)
+	}
+	if found := search("100%"); len(found) != 0 {
+		t.Errorf("LIKE search for 100%% found %v, want nothing", found)
+	}
+	if _, _, stat, _ := searchFiles("***", "", "", 25, "", db, cfg); stat != 400 {
+		t.Errorf("search with no words gave %d, want 400", stat)
+	}
+	// indexing still works, it just doesn't touch files_fts
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa003", testFileRecord("holiday playlist")); err != nil {
+		t.Fatalf("failed to index without files_fts: %v", err)
+	}
+
+	// and once we're built with it, the index is made and filled on startup
+	if err := migrateUp(db); err != nil {
+		t.Fatalf("migrateUp: %v", err)
+	}
+	if useFTS(db) != sqliteFTS5(db) {
+		t.Errorf("useFTS is %v after migrateUp, sqliteFTS5 is %v", useFTS(db), sqliteFTS5(db))
+	}
+	if found := search("holiday"); len(found) != 3 {
+		t.Errorf("search for holiday found %v, want 3 files", found)
+	}
+}
+
+func TestUpdateRecordReplay(t *testing.T) {
+	db, _ := newTestDB(t)
+	useTestLexicons(t)
+	createTestUser(t, db, testDID)
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa000", testFileRecord("original")); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	first := File{}
+	db.Where("name = ?", "original").First(&first)
+	// as if the verifier had been through, which a replay shouldn't undo
+	db.Model(&first).Update("verification", verifyVerified)
+
+	// jetstream replays events when it reconnects. the CID says it's the same version,
+	// so nothing changes even if (somehow) the record does
+	time.Sleep(2 * time.Millisecond)
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa000", testFileRecord("replayed")); err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	replayed := File{}
+	db.Where("id = ?", first.ID).First(&replayed)
+	if replayed.Name != "original" || replayed.IndexedAt != first.IndexedAt || replayed.Verification != verifyVerified {
+		t.Errorf("replay changed the file: name %q, indexed_at %d (was %d), verification %s", replayed.Name, replayed.IndexedAt, first.IndexedAt, replayed.Verification)
+	}
+
+	// a new CID is a new version
+	if err := ingestTestRecordCID(db, "dev.skywell.file", "3kaaaaaaaa000", testBlobCID([]byte("v2")), testFileRecord("renamed")); err != nil {
+		t.Fatalf("failed to index new version: %v", err)
+	}
+	files := []File{}
+	db.Find(&files)
+	if len(files) != 1 {
+		t.Fatalf("%d files, want the one updated in place", len(files))
+	}
+	updated := files[0]
+	if updated.ID != first.ID || updated.Name != "renamed" || updated.Cid.String() != testBlobCID([]byte("v2")) {
+		t.Errorf("new version is file %d %q with CID %s", updated.ID, updated.Name, updated.Cid)
+	}
+	if updated.Verification != verifyPending {
+		t.Errorf("new version's verification is %s, want it checked again", updated.Verification)
+	}
+}
+
+func TestUpdateAccount(t *testing.T) {
+	status := func(s string) *string { return &s }
+	for _, tc := range []struct {
+		name   string
+		before string
+		active bool
+		status *string
+		purged bool
+		want   string
+	}{
+		{"deleted", "", false, status("deleted"), true, ""},
+		{"deleted while deactivated", "deactivated", false, status("deleted"), true, ""},
+		{"deactivated", "", false, status("deactivated"), false, "deactivated"},
+		{"takendown", "", false, status("takendown"), false, "takendown"},
+		{"inactive without a reason", "", false, nil, false, "inactive"},
+		{"reactivated", "deactivated", true, nil, false, ""},
+		{"still active", "", true, nil, false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db, cfg := newTestDB(t)
+			useTestLexicons(t)
+			user := createTestUser(t, db, testDID)
+			db.Model(&user).Update("status", tc.before)
+			if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa000", testFileRecord("file")); err != nil {
+				t.Fatalf("failed to index: %v", err)
+			}
+			fk := FileKey{}
+			db.First(&fk)
+
+			updateAccount(jetstream.Event{
+				Did:  testDID,
+				Kind: jetstream.EventKindAccount,
+				Account: &comatproto.SyncSubscribeRepos_Account{
+					Did:    testDID,
+					Active: tc.active,
+					Status: tc.status,
+				},
+			}, db)
+
+			after := User{}
+			err := db.Unscoped().Where("did = ?", testDID).First(&after).Error
+			var files int64
+			db.Unscoped().Model(&File{}).Count(&files)
+			if tc.purged {
+				if !errors.Is(err, gorm.ErrRecordNotFound) || files != 0 {
+					t.Errorf("user lookup gave %v and %d files are left, want them purged", err, files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("user is gone: %v", err)
+			}
+			if after.Status != tc.want || files != 1 {
+				t.Errorf("status is %q with %d files, want %q with the file kept", after.Status, files, tc.want)
+			}
+			// inactive accounts' files are hidden, not gone
+			_, _, stat, _ := fileBySlug(fk.Key, db, cfg)
+			if want := map[bool]int{true: 200, false: 404}[tc.want == ""]; stat != want {
+				t.Errorf("file by slug gave %d, want %d", stat, want)
+			}
+		})
+	}
+}
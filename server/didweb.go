@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// the service id other servers use to find us in a DID document,
+// e.g. `atproto-proxy: did:web:appview.example.com#skywell_appview`
+const appViewServiceID = "skywell_appview"
+const appViewServiceType = "SkywellAppView"
+
+type didDocument struct {
+	Context            []string                `json:"@context"`
+	ID                 string                  `json:"id"`
+	VerificationMethod []didVerificationMethod `json:"verificationMethod,omitempty"`
+	Service            []didService            `json:"service"`
+}
+
+type didVerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+type didService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// didWeb returns the did:web identity for the configured hostname, or "" if there isn't one.
+// ports have to be percent encoded in did:web
+func (cfg *Config) didWeb() string {
+	if cfg.DIDWeb.Hostname == "" {
+		return ""
+	}
+	return "did:web:" + strings.ReplaceAll(cfg.DIDWeb.Hostname, ":", "%3A")
+}
+
+func (cfg *Config) didWebServiceEndpoint() string {
+	if cfg.DIDWeb.ServiceEndpoint != "" {
+		return strings.TrimRight(cfg.DIDWeb.ServiceEndpoint, "/")
+	}
+	return "https://" + cfg.DIDWeb.Hostname
+}
+
+// serviceAudiences lists every `aud` a service auth JWT addressed to us can have.
+// PDSes proxying with atproto-proxy may or may not include the service fragment
+func (cfg *Config) serviceAudiences() []string {
+	auds := []string{cfg.ServiceDID, cfg.ServiceDID + "#" + appViewServiceID}
+	if did := cfg.didWeb(); did != "" && did != cfg.ServiceDID {
+		auds = append(auds, did, did+"#"+appViewServiceID)
+	}
+	return auds
+}
+
+// initializeDIDWeb serves /.well-known/did.json when did_web.hostname is set
+func initializeDIDWeb(cfg *Config) {
+	did := cfg.didWeb()
+	if did == "" {
+		return
+	}
+
+	dd := didDocument{
+		Context: []string{"https://www.w3.org/ns/did/v1"},
+		ID:      did,
+		Service: []didService{{
+			ID:              "#" + appViewServiceID,
+			Type:            appViewServiceType,
+			ServiceEndpoint: cfg.didWebServiceEndpoint(),
+		}},
+	}
+	// we're a labeler too if we have a key to sign with
+	if cfg.Labels.SigningKey != "" && cfg.labelerDID() == did {
+		vm, svc, err := cfg.didDocumentLabeler()
+		if err != nil {
+			// validate already checked the key
+			panic("Failed to read labeler signing key: " + err.Error())
+		}
+		dd.Context = append(dd.Context, "https://w3id.org/security/multikey/v1")
+		dd.VerificationMethod = append(dd.VerificationMethod, *vm)
+		dd.Service = append(dd.Service, *svc)
+	}
+
+	doc, err := json.Marshal(dd)
+	if err != nil {
+		// can't happen, it's all strings
+		panic("Failed to marshal DID document: " + err.Error())
+	}
+
+	http.HandleFunc("/.well-known/did.json", func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Context().Value(requestIDKey).(string)
+		logger := httpLogger.With("request_id", requestID)
+
+		logger.Debug("Received request", "endpoint", "/.well-known/did.json", "remote_addr", remoteAddr(r))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	})
+	httpLogger.Info("Serving did:web document", "did", did, "service_endpoint", cfg.didWebServiceEndpoint())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/bluesky-social/indigo/xrpc"
+	jetstream "github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+)
+
+// relays to subscribe to when ingest.backend is firehose.
+// these are the defaults for ingest.firehose_hosts
+var firehoseHosts = []string{
+	"wss://relay1.us-west.bsky.network",
+	"wss://relay1.us-east.bsky.network",
+}
+
+// same collections we ask jetstream for
+var firehoseCollections = map[string]bool{
+	"dev.skywell.file":       true,
+	"dev.skywell.collection": true,
+	"app.bsky.actor.profile": true,
+}
+
+func readFirehose(db *gorm.DB, client *xrpc.Client, cfg *Config, ctx context.Context) {
+	superviseStream(cfg.Ingest.FirehoseHosts, firehoseLogger, func(host string) error {
+		return readFirehoseHost(host, db, client, cfg, ctx)
+	}, ctx)
+	firehoseLogger.Info("Stopped reading from relay firehose")
+}
+
+// readFirehoseHost handles events from a single relay connection until it fails.
+// seq numbers are per relay, so each host gets its own cursor
+func readFirehoseHost(host string, db *gorm.DB, client *xrpc.Client, cfg *Config, ctx context.Context) error {
+	service := "firehose:" + host
+	cursor, err := loadCursor(service, db)
+	if err != nil {
+		firehoseLogger.Error("Failed to load cursor, starting from live", "host", host, "error", err)
+		cursor = 0
+	}
+
+	uri := host + "/xrpc/com.atproto.sync.subscribeRepos"
+	if cursor > 0 {
+		uri = fmt.Sprintf("%s?cursor=%d", uri, cursor)
+		firehoseLogger.Info("Resuming from cursor", "cursor", cursor, "host", host)
+	}
+
+	conn, res, err := websocket.DefaultDialer.DialContext(ctx, uri, http.Header{"User-Agent": []string{cfg.UserAgent}})
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		firehoseLogger.Error("Failed to connect to relay", "status_code", status, "error", err, "uri", uri)
+		return err
+	}
+	firehoseLogger.Info("Connected to relay", "host", host)
+
+	defer func() {
+		if err := saveCursor(service, cursor, db); err != nil {
+			firehoseLogger.Error("Failed to save cursor", "cursor", cursor, "host", host, "error", err)
+		}
+	}()
+
+	lastSave := time.Now()
+	advance := func(seq int64) {
+		if seq > cursor {
+			cursor = seq
+		}
+		if time.Since(lastSave) > cursorSaveInterval {
+			if err := saveCursor(service, cursor, db); err != nil {
+				firehoseLogger.Error("Failed to save cursor", "cursor", cursor, "host", host, "error", err)
+			}
+			lastSave = time.Now()
+		}
+	}
+
+	// everything gets turned into the jetstream equivalent, so both backends share the same handlers
+	rsc := &events.RepoStreamCallbacks{
+		RepoCommit: func(evt *comatproto.SyncSubscribeRepos_Commit) error {
+			handleFirehoseCommit(evt, db, client, ctx)
+			advance(evt.Seq)
+			return nil
+		},
+		RepoIdentity: func(evt *comatproto.SyncSubscribeRepos_Identity) error {
+			updateIdentity(jetstream.Event{
+				Did:      evt.Did,
+				Kind:     jetstream.EventKindIdentity,
+				Identity: evt,
+			}, db, client, ctx)
+			advance(evt.Seq)
+			return nil
+		},
+		RepoAccount: func(evt *comatproto.SyncSubscribeRepos_Account) error {
+			updateAccount(jetstream.Event{
+				Did:     evt.Did,
+				Kind:    jetstream.EventKindAccount,
+				Account: evt,
+			}, db)
+			advance(evt.Seq)
+			return nil
+		},
+	}
+
+	// HandleRepoStream closes the connection itself once ctx is done
+	return events.HandleRepoStream(ctx, conn, sequential.NewScheduler(service, rsc.EventHandler), firehoseLogger)
+}
+
+func handleFirehoseCommit(evt *comatproto.SyncSubscribeRepos_Commit, db *gorm.DB, client *xrpc.Client, ctx context.Context) {
+	// the vast majority of commits aren't for us, so skip them before doing any real work
+	relevant := false
+	for _, op := range evt.Ops {
+		nsid, _, err := syntax.ParseRepoPath(op.Path)
+		if err == nil && firehoseCollections[nsid.String()] {
+			relevant = true
+			break
+		}
+	}
+	if !relevant {
+		return
+	}
+
+	did, err := syntax.ParseDID(evt.Repo)
+	if err != nil {
+		firehoseLogger.Error("Failed to parse DID", "did", evt.Repo, "error", err)
+		return
+	}
+
+	if err := verifyFirehoseCommit(did, evt, ctx); err != nil {
+		firehoseLogger.Warn("Dropping commit that failed verification", "did", evt.Repo, "rev", evt.Rev, "seq", evt.Seq, "error", err)
+		return
+	}
+
+	// checks the records in the CAR against the MST and the ops list
+	r, err := repo.VerifyCommitMessage(ctx, evt)
+	if err != nil {
+		firehoseLogger.Warn("Dropping commit with invalid contents", "did", evt.Repo, "rev", evt.Rev, "seq", evt.Seq, "error", err)
+		return
+	}
+
+	for _, op := range evt.Ops {
+		nsid, rkey, err := syntax.ParseRepoPath(op.Path)
+		if err != nil || !firehoseCollections[nsid.String()] {
+			continue
+		}
+
+		jevt := jetstream.Event{
+			Did:  did.String(),
+			Kind: jetstream.EventKindCommit,
+			Commit: &jetstream.Commit{
+				Rev:        evt.Rev,
+				Operation:  op.Action,
+				Collection: nsid.String(),
+				RKey:       rkey.String(),
+			},
+		}
+
+		if op.Action == jetstream.CommitOperationCreate || op.Action == jetstream.CommitOperationUpdate {
+			if op.Cid == nil {
+				firehoseLogger.Warn("Op is missing CID", "path", op.Path, "action", op.Action, "did", evt.Repo)
+				continue
+			}
+			jevt.Commit.CID = cid.Cid(*op.Cid).String()
+
+			// profile updates get refetched from the bsky API, so only our own records need the record itself
+			if nsid.String() != "app.bsky.actor.profile" {
+				b, _, err := r.GetRecordBytes(ctx, nsid, rkey)
+				if err != nil {
+					firehoseLogger.Error("Failed to get record from commit", "path", op.Path, "did", evt.Repo, "error", err)
+					continue
+				}
+				// kept as it is in the repo (not round-tripped through the api/skywell types), so it's validated as written
+				f, err := data.UnmarshalCBOR(b)
+				if err != nil {
+					firehoseLogger.Error("Failed to unmarshal record", "path", op.Path, "did", evt.Repo, "error", err)
+					continue
+				}
+				rec, err := json.Marshal(f)
+				if err != nil {
+					firehoseLogger.Error("Failed to marshal record", "path", op.Path, "did", evt.Repo, "error", err)
+					continue
+				}
+				jevt.Commit.Record = rec
+			}
+		}
+
+		updateRecord(jevt, db, client, ctx)
+	}
+}
+
+// verifyFirehoseCommit checks the commit signature against the signing key in the DID document.
+// the key might have been rotated since we cached it, so failures get one retry with a fresh lookup
+func verifyFirehoseCommit(did syntax.DID, evt *comatproto.SyncSubscribeRepos_Commit, ctx context.Context) error {
+	err := repo.VerifyCommitSignature(ctx, &cacheDir, evt)
+	if err == nil {
+		return nil
+	}
+	firehoseLogger.Debug("Commit signature verification failed, retrying with fresh identity", "did", did.String(), "error", err)
+	if err := cacheDir.Purge(ctx, did.AtIdentifier()); err != nil {
+		return fmt.Errorf("failed to purge cache entry: %w", err)
+	}
+	return repo.VerifyCommitSignature(ctx, &cacheDir, evt)
+}
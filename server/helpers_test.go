@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	jetstream "github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const testDID = "did:plc:abcdefghijklmnopqrstuvwx"
+
+// a CID that parses, for records and blobs that are never fetched
+const testCID = "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"
+
+// testFileRecord is a dev.skywell.file record that matches the lexicon
+func testFileRecord(name string) json.RawMessage {
+	b, _ := json.Marshal(map[string]any{
+		"$type":     "dev.skywell.file",
+		"name":      name,
+		"createdAt": "2026-01-01T00:00:00Z",
+		"blobRef": map[string]any{
+			"$type":    "blob",
+			"ref":      map[string]string{"$link": "bafkreic6gi22qndoljcyl6gfqvrpkbjlr7rguo5relq6s3dwpbewjx6eme"},
+			"mimeType": "text/plain",
+			"size":     6,
+		},
+	})
+	return b
+}
+
+// testBlobCID is the CID a PDS gives a blob with these contents
+func testBlobCID(blob []byte) string {
+	mh, _ := multihash.Sum(blob, multihash.SHA2_256, -1)
+	return cid.NewCidV1(cid.Raw, mh).String()
+}
+
+func testBlobRef(blob []byte) map[string]any {
+	return map[string]any{
+		"$type":    "blob",
+		"ref":      map[string]string{"$link": testBlobCID(blob)},
+		"mimeType": "text/plain",
+		"size":     len(blob),
+	}
+}
+
+// testBlobFileRecord is a dev.skywell.file record for a blob with these contents
+func testBlobFileRecord(name string, blob []byte) json.RawMessage {
+	b, _ := json.Marshal(map[string]any{
+		"$type":     "dev.skywell.file",
+		"name":      name,
+		"createdAt": "2026-01-01T00:00:00Z",
+		"blobRef":   testBlobRef(blob),
+	})
+	return b
+}
+
+// testChunksHash is the hash a record should have for a file made of these chunks
+func testChunksHash(chunks ...[]byte) string {
+	h := sha256.New()
+	for _, c := range chunks {
+		h.Write(c)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// testChunkedFileRecord is a dev.skywell.file record for a file made of these chunks,
+// claiming whatever hash it's given
+func testChunkedFileRecord(name string, hash string, chunks ...[]byte) json.RawMessage {
+	refs := []any{}
+	for _, c := range chunks {
+		refs = append(refs, testBlobRef(c))
+	}
+	b, _ := json.Marshal(map[string]any{
+		"$type":     "dev.skywell.file",
+		"name":      name,
+		"createdAt": "2026-01-01T00:00:00Z",
+		"blobRef":   testBlobRef(chunks[0]),
+		"chunks":    refs,
+		"hash":      hash,
+	})
+	return b
+}
+
+// useTestBlobCache puts a fresh blob cache in place for the length of the test
+func useTestBlobCache(t *testing.T) {
+	t.Helper()
+	bc, err := openBlobCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open blob cache: %v", err)
+	}
+	prev := blobCache
+	blobCache = bc
+	t.Cleanup(func() { blobCache = prev })
+}
+
+// cacheTestBlob puts a blob in the cache, so it's never fetched from a PDS
+func cacheTestBlob(t *testing.T, blob []byte) {
+	t.Helper()
+	w, err := blobCache.create(testBlobCID(blob))
+	if err != nil {
+		t.Fatalf("failed to cache blob: %v", err)
+	}
+	w.Write(blob)
+	if err := w.commit(); err != nil {
+		t.Fatalf("failed to cache blob: %v", err)
+	}
+}
+
+// ingestTestRecord indexes a record as if it had come in from jetstream
+func ingestTestRecord(db *gorm.DB, collection string, rkey string, record json.RawMessage) error {
+	return ingestTestRecordCID(db, collection, rkey, testCID, record)
+}
+
+// ingestTestRecordCID is ingestTestRecord for a particular version of the record
+func ingestTestRecordCID(db *gorm.DB, collection string, rkey string, recordCID string, record json.RawMessage) error {
+	return updateRecord(jetstream.Event{
+		Did:  testDID,
+		Kind: jetstream.EventKindCommit,
+		Commit: &jetstream.Commit{
+			Operation:  jetstream.CommitOperationCreate,
+			Collection: collection,
+			RKey:       rkey,
+			CID:        recordCID,
+			Record:     record,
+		},
+	}, db, nil, context.Background())
+}
+
+// deleteTestRecord unindexes a record as if it had been deleted from the repo
+func deleteTestRecord(db *gorm.DB, collection string, rkey string) error {
+	return updateRecord(jetstream.Event{
+		Did:  testDID,
+		Kind: jetstream.EventKindCommit,
+		Commit: &jetstream.Commit{
+			Operation:  jetstream.CommitOperationDelete,
+			Collection: collection,
+			RKey:       rkey,
+		},
+	}, db, nil, context.Background())
+}
+
+// postgres tests only run when this points at a database they can make schemas in (the README has a
+// docker command for one), e.g.
+// SKYWELL_TEST_POSTGRES_DSN="host=localhost user=skywell dbname=skywell_test sslmode=disable"
+const testPostgresDSNEnv = "SKYWELL_TEST_POSTGRES_DSN"
+
+// newTestDB opens a fresh, migrated sqlite database for one test
+func newTestDB(t *testing.T) (*gorm.DB, *Config) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Database.DSN = filepath.Join(t.TempDir(), "test.db")
+	return openTestDB(t, cfg), cfg
+}
+
+// newTestPostgres opens a fresh, migrated postgres database for one test,
+// in its own schema that's dropped afterwards. skips the test when there's no postgres to use
+func newTestPostgres(t *testing.T) (*gorm.DB, *Config) {
+	t.Helper()
+	dsn := os.Getenv(testPostgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s isn't set, see Tests in the README", testPostgresDSNEnv)
+	}
+	cfg := defaultConfig()
+	cfg.Database.Driver = dbDriverPostgres
+	cfg.Database.DSN = dsn
+	admin, err := openDB(cfg)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	schema := fmt.Sprintf("skywell_test_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := admin.Exec("DROP SCHEMA " + schema + " CASCADE").Error; err != nil {
+			t.Errorf("failed to drop schema %s: %v", schema, err)
+		}
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatalf("invalid %s: %v", testPostgresDSNEnv, err)
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		cfg.Database.DSN = u.String()
+	} else {
+		cfg.Database.DSN = dsn + " search_path=" + schema
+	}
+	return openTestDB(t, cfg), cfg
+}
+
+func openTestDB(t *testing.T, cfg *Config) *gorm.DB {
+	t.Helper()
+	db, err := openDB(cfg)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// cleanups run last in first out, so this is closed before newTestPostgres drops the schema
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := migrateUp(db); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	return db
+}
+
+// forEachTestDB runs fn against every database driver we support, as subtests
+func forEachTestDB(t *testing.T, fn func(t *testing.T, db *gorm.DB, cfg *Config)) {
+	t.Run(dbDriverSQLite, func(t *testing.T) {
+		db, cfg := newTestDB(t)
+		fn(t, db, cfg)
+	})
+	t.Run(dbDriverPostgres, func(t *testing.T) {
+		db, cfg := newTestPostgres(t)
+		fn(t, db, cfg)
+	})
+}
+
+// useTestLexicons loads the real lexicons for the length of the test
+func useTestLexicons(t *testing.T) {
+	t.Helper()
+	cat, err := loadLexicons("../lexicons")
+	if err != nil {
+		t.Fatalf("failed to load lexicons: %v", err)
+	}
+	prev := lexicons
+	lexicons = cat
+	t.Cleanup(func() { lexicons = prev })
+}
+
+// useTestDirectory resolves these identities (and nothing else) for the length of the test
+func useTestDirectory(t *testing.T, ids ...identity.Identity) {
+	t.Helper()
+	dir := identity.NewMockDirectory()
+	for _, id := range ids {
+		dir.Insert(id)
+	}
+	useDirectory(t, &dir)
+}
+
+// useDirectory puts dir behind cacheDir for the length of the test
+func useDirectory(t *testing.T, dir identity.Directory) {
+	t.Helper()
+	cacheDir = identity.NewCacheDirectory(dir, 0, 0, 0, 0)
+	// it can't be copied, so it goes back to a fresh one like main.go's
+	t.Cleanup(func() { cacheDir = identity.NewCacheDirectory(identity.DefaultDirectory(), 0, 0, 0, 0) })
+}
+
+// createTestUser adds a user straight to the database, so indexing their records doesn't go to the network
+func createTestUser(t *testing.T, db *gorm.DB, did string) User {
+	t.Helper()
+	user := User{DID: syntax.DID(did), Handle: "test.invalid"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
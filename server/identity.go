@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+// resolveActor turns an `actor` parameter (an at-identifier, so a handle or a DID) into a DID.
+// handles only count if the DID document claims them back, which the identity directory checks for us
+func resolveActor(actor string, ctx context.Context) (did syntax.DID, httpResponse int, err error) {
+	atid, err := syntax.ParseAtIdentifier(actor)
+	if err != nil {
+		return "", 400, fmt.Errorf("invalid at-identifier: %w", err)
+	}
+	if did, err := atid.AsDID(); err == nil {
+		return did, 200, nil
+	}
+
+	id, stat, err := lookupActor(atid, ctx)
+	if err != nil {
+		return "", stat, err
+	}
+	return id.DID, 200, nil
+}
+
+// lookupActor resolves an at-identifier to a full identity.
+// for DIDs the handle is only filled in if it's verified, otherwise it's handle.invalid
+func lookupActor(atid *syntax.AtIdentifier, ctx context.Context) (id *identity.Identity, httpResponse int, err error) {
+	id, err = cacheDir.Lookup(ctx, *atid)
+	switch {
+	case err == nil:
+		return id, 200, nil
+	case errors.Is(err, identity.ErrHandleNotFound), errors.Is(err, identity.ErrHandleMismatch),
+		errors.Is(err, identity.ErrHandleNotDeclared), errors.Is(err, identity.ErrHandleReservedTLD),
+		errors.Is(err, identity.ErrDIDNotFound):
+		return nil, 404, xrpcserver.Errorf("ActorNotFound", "failed to resolve %s: %w", atid.String(), err)
+	default:
+		return nil, 502, fmt.Errorf("failed to resolve %s: %w", atid.String(), err)
+	}
+}
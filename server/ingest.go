@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// where records come from, picked with ingest.backend in the config.
+// jetstream is lighter, the firehose lets us verify everything ourselves
+const (
+	ingestBackendJetstream = "jetstream"
+	ingestBackendFirehose  = "firehose"
+)
+
+const (
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 2 * time.Minute
+	// a connection that lasted this long counts as healthy, so the backoff starts over
+	healthyConnection = 1 * time.Minute
+)
+
+// ingest reads from the configured backend until ctx is cancelled
+func ingest(db *gorm.DB, client *xrpc.Client, cfg *Config, ctx context.Context) {
+	switch backend := cfg.Ingest.Backend; backend {
+	case ingestBackendJetstream:
+		jetstreamLogger.Info("Reading from Jetstream...")
+		read(db, client, cfg, ctx)
+	case ingestBackendFirehose:
+		firehoseLogger.Info("Reading from relay firehose...")
+		readFirehose(db, client, cfg, ctx)
+	default:
+		slog.Error("Unknown ingest backend, not ingesting anything", "backend", backend)
+	}
+}
+
+// superviseStream calls connect with each host in turn until ctx is cancelled.
+// connect should block for as long as its connection is up
+func superviseStream(hosts []string, logger *slog.Logger, connect func(host string) error, ctx context.Context) {
+	backoff := minReconnectBackoff
+	for i := 0; ; i++ {
+		host := hosts[i%len(hosts)]
+		start := time.Now()
+		err := connect(host)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(start) > healthyConnection {
+			backoff = minReconnectBackoff
+		}
+		// anywhere from half to all of the backoff, so we don't reconnect in lockstep with everyone else
+		wait := backoff/2 + rand.N(backoff/2+1)
+		logger.Warn("Connection lost, reconnecting", "host", host, "next_host", hosts[(i+1)%len(hosts)], "retry_in", wait, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
+}
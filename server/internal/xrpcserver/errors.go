@@ -0,0 +1,77 @@
+package xrpcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// XRPC errors are {"error": name, "message": message}, which is what the generated clients parse.
+// names are either declared in the endpoint's lexicon (e.g. ActorNotFound) or one of these,
+// which any XRPC endpoint can return
+
+const (
+	InvalidRequest         = "InvalidRequest"
+	AuthenticationRequired = "AuthenticationRequired"
+	Forbidden              = "Forbidden"
+	NotFound               = "NotFound"
+	MethodNotAllowed       = "MethodNotAllowed"
+	RateLimitExceeded      = "RateLimitExceeded"
+	InternalServerError    = "InternalServerError"
+	MethodNotImplemented   = "MethodNotImplemented"
+	UpstreamFailure        = "UpstreamFailure"
+)
+
+// Error is an error with a name from the endpoint's lexicon
+type Error struct {
+	name string
+	err  error
+}
+
+func (e *Error) Error() string { return e.err.Error() }
+func (e *Error) Unwrap() error { return e.err }
+
+// Errorf is fmt.Errorf for errors that have a name in the lexicon
+func Errorf(name string, format string, args ...any) error {
+	return &Error{name: name, err: fmt.Errorf(format, args...)}
+}
+
+// ErrorName is err's lexicon name if it has one, otherwise the generic one for status
+func ErrorName(err error, status int) string {
+	if xe := (*Error)(nil); errors.As(err, &xe) {
+		return xe.name
+	}
+	switch {
+	case status == 401:
+		return AuthenticationRequired
+	case status == 403:
+		return Forbidden
+	case status == 404:
+		return NotFound
+	case status == 405:
+		return MethodNotAllowed
+	case status == 429:
+		return RateLimitExceeded
+	case status == 501:
+		return MethodNotImplemented
+	case status == 502:
+		return UpstreamFailure
+	case status >= 500:
+		return InternalServerError
+	default:
+		return InvalidRequest
+	}
+}
+
+// WriteError is http.Error for XRPC endpoints
+func WriteError(w http.ResponseWriter, status int, name string, message string) {
+	b, _ := json.Marshal(map[string]string{"error": name, "message": message})
+	// same headers as http.Error
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,360 @@
+// Package xrpcserver serves XRPC methods: typed handlers registered by NSID,
+// with the method, auth, content type and error handling they all share done once here.
+package xrpcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// biggest procedure input we'll decode
+const maxInputBytes = 1 << 20 // 1 MiB
+
+type Type string
+
+const (
+	TypeQuery        Type = "query"
+	TypeProcedure    Type = "procedure"
+	TypeSubscription Type = "subscription"
+)
+
+// Auth is what a method needs from the caller
+type Auth string
+
+const (
+	// credentials are ignored
+	AuthNone Auth = "none"
+	// logged out is fine, but bad credentials are still rejected
+	AuthOptional Auth = "optional"
+	AuthRequired Auth = "required"
+	// required, and the caller has to be one of Server.IsAdmin
+	AuthAdmin Auth = "admin"
+)
+
+// Empty is the input or output of a method that doesn't have one
+type Empty struct{}
+
+// Opts is how a method is registered
+type Opts struct {
+	Auth Auth
+	// defaults to the server's
+	Logger *slog.Logger
+}
+
+// Request is what handlers get
+type Request struct {
+	*http.Request
+	NSID string
+	// who's calling, empty if they aren't logged in
+	Caller syntax.DID
+	Logger *slog.Logger
+}
+
+// MethodInfo describes a registered method, for introspection
+type MethodInfo struct {
+	NSID string
+	Type Type
+	Auth Auth
+}
+
+type method struct {
+	MethodInfo
+	logger *slog.Logger
+	serve  func(w http.ResponseWriter, req *Request)
+}
+
+// Server routes /xrpc/<nsid> requests to the methods registered on it.
+// anything it doesn't know gets a MethodNotImplemented
+type Server struct {
+	Logger *slog.Logger
+	// extra attributes for every log line about r, e.g. a request id
+	LogAttrs func(r *http.Request) []any
+	// the client's address, for logs. defaults to r.RemoteAddr, which behind a proxy is the proxy's
+	RemoteAddr func(r *http.Request) string
+	// checks the caller's credentials and says who they are
+	Authenticate func(r *http.Request) (syntax.DID, error)
+	IsAdmin      func(did syntax.DID) bool
+
+	methods map[string]*method
+}
+
+func New(logger *slog.Logger) *Server {
+	return &Server{
+		Logger:  logger,
+		methods: map[string]*method{},
+	}
+}
+
+// Methods lists what's registered, sorted by NSID
+func (s *Server) Methods() []MethodInfo {
+	infos := []MethodInfo{}
+	for _, m := range s.methods {
+		infos = append(infos, m.MethodInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].NSID < infos[j].NSID })
+	return infos
+}
+
+func (s *Server) register(nsid string, t Type, opts Opts, serve func(w http.ResponseWriter, req *Request)) {
+	if _, err := syntax.ParseNSID(nsid); err != nil {
+		panic(fmt.Sprintf("xrpcserver: %v", err))
+	}
+	if _, ok := s.methods[nsid]; ok {
+		panic("xrpcserver: " + nsid + " registered twice")
+	}
+	if opts.Auth == "" {
+		opts.Auth = AuthNone
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = s.Logger
+	}
+	s.methods[nsid] = &method{
+		MethodInfo: MethodInfo{NSID: nsid, Type: t, Auth: opts.Auth},
+		logger:     logger,
+		serve:      serve,
+	}
+}
+
+// QueryHandler handles a query. params are decoded from the query string, see DecodeParams
+type QueryHandler[P, O any] func(req *Request, params P) (out *O, httpResponse int, err error)
+
+// ProcedureHandler handles a procedure. in is decoded from a JSON body, unless it's Empty
+type ProcedureHandler[I, O any] func(req *Request, in I) (out *O, httpResponse int, err error)
+
+// SubscriptionHandler handles a subscription, which writes its own response (usually by upgrading to a websocket)
+type SubscriptionHandler[P any] func(w http.ResponseWriter, req *Request, params P)
+
+func Query[P, O any](s *Server, nsid string, opts Opts, h QueryHandler[P, O]) {
+	s.register(nsid, TypeQuery, opts, func(w http.ResponseWriter, req *Request) {
+		var params P
+		if err := DecodeParams(req.URL.Query(), &params); err != nil {
+			req.Logger.Warn("Invalid parameters", "endpoint", req.URL.Path, "error", err)
+			WriteError(w, 400, InvalidRequest, err.Error())
+			return
+		}
+		out, stat, err := h(req, params)
+		writeOutput(w, req, out, stat, err)
+	})
+}
+
+func Procedure[I, O any](s *Server, nsid string, opts Opts, h ProcedureHandler[I, O]) {
+	s.register(nsid, TypeProcedure, opts, func(w http.ResponseWriter, req *Request) {
+		var in I
+		if _, empty := any(in).(Empty); !empty {
+			if ct := req.Header.Get("Content-Type"); ct != "" {
+				if mt, _, _ := mime.ParseMediaType(ct); mt != "application/json" {
+					WriteError(w, 415, InvalidRequest, "Content-Type must be application/json")
+					return
+				}
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxInputBytes)).Decode(&in); err != nil {
+				req.Logger.Warn("Failed to decode request body", "endpoint", req.URL.Path, "error", err)
+				WriteError(w, 400, InvalidRequest, "Invalid request body")
+				return
+			}
+		}
+		out, stat, err := h(req, in)
+		writeOutput(w, req, out, stat, err)
+	})
+}
+
+func Subscription[P any](s *Server, nsid string, opts Opts, h SubscriptionHandler[P]) {
+	s.register(nsid, TypeSubscription, opts, func(w http.ResponseWriter, req *Request) {
+		var params P
+		if err := DecodeParams(req.URL.Query(), &params); err != nil {
+			req.Logger.Warn("Invalid parameters", "endpoint", req.URL.Path, "error", err)
+			WriteError(w, 400, InvalidRequest, err.Error())
+			return
+		}
+		h(w, req, params)
+	})
+}
+
+// writeOutput sends back what a handler returned. errors under 500 are the caller's fault,
+// so they're told what went wrong. anything else is logged and kept to ourselves
+func writeOutput[O any](w http.ResponseWriter, req *Request, out *O, stat int, err error) {
+	if err != nil {
+		if stat < 400 {
+			stat = 500
+		}
+		if stat >= 500 {
+			req.Logger.Error("Request failed", "endpoint", req.URL.Path, "http_status", stat, "error", err)
+			WriteError(w, stat, ErrorName(err, stat), "Internal Server Error")
+			return
+		}
+		req.Logger.Warn("Invalid request", "endpoint", req.URL.Path, "http_status", stat, "error", err)
+		WriteError(w, stat, ErrorName(err, stat), err.Error())
+		return
+	}
+
+	if _, empty := any(out).(*Empty); empty || out == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		req.Logger.Error("Failed to marshal response", "endpoint", req.URL.Path, "error", err)
+		WriteError(w, 500, InternalServerError, "Internal Server Error (marshaling content)")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		req.Logger.Error("Failed to write response", "endpoint", req.URL.Path, "error", err)
+		return
+	}
+	req.Logger.Debug("Returned response", "endpoint", req.URL.Path, "response_size", len(b))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nsid, _ := strings.CutPrefix(r.URL.Path, "/xrpc/")
+	m, ok := s.methods[nsid]
+	if !ok {
+		WriteError(w, 501, MethodNotImplemented, "Method Not Implemented")
+		return
+	}
+
+	logger := m.logger
+	if s.LogAttrs != nil {
+		logger = logger.With(s.LogAttrs(r)...)
+	}
+	remoteAddr := r.RemoteAddr
+	if s.RemoteAddr != nil {
+		remoteAddr = s.RemoteAddr(r)
+	}
+	logger.Debug("Received request", "endpoint", r.URL.Path, "remote_addr", remoteAddr)
+
+	want := http.MethodGet
+	if m.Type == TypeProcedure {
+		want = http.MethodPost
+	}
+	if r.Method != want {
+		w.Header().Set("Allow", want)
+		WriteError(w, 405, MethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	if m.Type != TypeSubscription && !acceptsJSON(r.Header.Values("Accept")) {
+		WriteError(w, 406, InvalidRequest, "Responses are application/json")
+		return
+	}
+
+	req := &Request{Request: r, NSID: nsid, Logger: logger}
+	if m.Auth != AuthNone && (m.Auth != AuthOptional || r.Header.Get("Authorization") != "") {
+		if s.Authenticate == nil {
+			logger.Error("Method needs auth but the server has no Authenticate", "endpoint", r.URL.Path)
+			WriteError(w, 500, InternalServerError, "Internal Server Error")
+			return
+		}
+		did, err := s.Authenticate(r)
+		if err != nil {
+			logger.Warn("Failed to authenticate", "endpoint", r.URL.Path, "error", err)
+			WriteError(w, 401, AuthenticationRequired, "Authorization required")
+			return
+		}
+		if m.Auth == AuthAdmin && (s.IsAdmin == nil || !s.IsAdmin(did)) {
+			logger.Warn("Rejected admin request", "endpoint", r.URL.Path, "did", did.String())
+			WriteError(w, 403, Forbidden, "Admin authorization required")
+			return
+		}
+		req.Caller = did
+		req.Logger = logger.With("caller", did.String())
+	}
+
+	m.serve(w, req)
+}
+
+// acceptsJSON is whether an Accept header (if there is one) lets us send JSON
+func acceptsJSON(accept []string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	for _, a := range accept {
+		for _, r := range strings.Split(a, ",") {
+			mt, _, err := mime.ParseMediaType(r)
+			if err != nil {
+				continue
+			}
+			switch mt {
+			case "application/json", "application/*", "*/*":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DecodeParams fills the fields of the struct v points to from a query string.
+// fields are tagged `query:"name"` or `query:"name,required"`, and can be strings,
+// integers, booleans or slices of those
+func DecodeParams(q map[string][]string, v any) error {
+	rv := reflect.ValueOf(v).Elem()
+	if rv.Kind() != reflect.Struct {
+		// Empty and friends
+		return nil
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag, ok := rt.Field(i).Tag.Lookup("query")
+		if !ok {
+			continue
+		}
+		name, opt, _ := strings.Cut(tag, ",")
+		vals := q[name]
+		if len(vals) == 0 || (len(vals) == 1 && vals[0] == "") {
+			if opt == "required" {
+				return fmt.Errorf("required parameter '%s' missing", name)
+			}
+			continue
+		}
+
+		f := rv.Field(i)
+		if f.Kind() == reflect.Slice {
+			s := reflect.MakeSlice(f.Type(), len(vals), len(vals))
+			for j, val := range vals {
+				if err := setParam(s.Index(j), val); err != nil {
+					return fmt.Errorf("invalid '%s' parameter", name)
+				}
+			}
+			f.Set(s)
+			continue
+		}
+		if len(vals) > 1 {
+			return fmt.Errorf("parameter '%s' can only be given once", name)
+		}
+		if err := setParam(f, vals[0]); err != nil {
+			return fmt.Errorf("invalid '%s' parameter", name)
+		}
+	}
+	return nil
+}
+
+func setParam(f reflect.Value, val string) error {
+	var err error
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(val)
+	case reflect.Int, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(val, 10, 64); err == nil {
+			f.SetInt(i)
+		}
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(val); err == nil {
+			f.SetBool(b)
+		}
+	default:
+		err = errors.New("unsupported parameter type " + f.Type().String())
+	}
+	return err
+}
@@ -0,0 +1,329 @@
+package xrpcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const (
+	testUser  = syntax.DID("did:plc:useruseruseruseruseruser")
+	testAdmin = syntax.DID("did:plc:adminadminadminadminadmi")
+)
+
+type testParams struct {
+	Actor   string   `query:"actor,required"`
+	Limit   int      `query:"limit"`
+	Big     int64    `query:"big"`
+	Include bool     `query:"include"`
+	Tags    []string `query:"tag"`
+	Nums    []int    `query:"num"`
+	Ignored string
+}
+
+func TestDecodeParams(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  testParams
+		err   string
+	}{
+		{"actor=alice", testParams{Actor: "alice"}, ""},
+		{"actor=alice&limit=10&big=9000000000&include=true", testParams{Actor: "alice", Limit: 10, Big: 9000000000, Include: true}, ""},
+		{"actor=alice&tag=a&tag=b&num=1&num=2", testParams{Actor: "alice", Tags: []string{"a", "b"}, Nums: []int{1, 2}}, ""},
+		// empty is the same as missing
+		{"actor=alice&limit=", testParams{Actor: "alice"}, ""},
+		{"actor=alice&Ignored=x", testParams{Actor: "alice"}, ""},
+		{"", testParams{}, "required parameter 'actor' missing"},
+		{"actor=", testParams{}, "required parameter 'actor' missing"},
+		{"actor=alice&limit=ten", testParams{}, "invalid 'limit' parameter"},
+		{"actor=alice&include=maybe", testParams{}, "invalid 'include' parameter"},
+		{"actor=alice&num=1&num=two", testParams{}, "invalid 'num' parameter"},
+		{"actor=alice&limit=1&limit=2", testParams{}, "parameter 'limit' can only be given once"},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tc.query)
+			var got testParams
+			err := DecodeParams(q, &got)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeParams: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	// Empty has nothing to fill in
+	if err := DecodeParams(url.Values{"anything": {"x"}}, &Empty{}); err != nil {
+		t.Errorf("DecodeParams into Empty: %v", err)
+	}
+}
+
+func TestSetParam(t *testing.T) {
+	var s struct {
+		Str   string
+		Int   int
+		Bool  bool
+		Float float64
+	}
+	v := reflect.ValueOf(&s).Elem()
+	for _, tc := range []struct {
+		field string
+		val   string
+		ok    bool
+	}{
+		{"Str", "hello", true},
+		{"Int", "-42", true},
+		{"Int", "4.2", false},
+		{"Bool", "1", true},
+		{"Bool", "yes", false},
+		{"Float", "4.2", false},
+	} {
+		err := setParam(v.FieldByName(tc.field), tc.val)
+		if (err == nil) != tc.ok {
+			t.Errorf("setParam(%s, %q): %v", tc.field, tc.val, err)
+		}
+	}
+	if s.Str != "hello" || s.Int != -42 || !s.Bool {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestErrorName(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		want   string
+	}{
+		{Errorf("ActorNotFound", "no such actor"), 404, "ActorNotFound"},
+		// a name in the lexicon wins, even wrapped
+		{fmt.Errorf("looking up: %w", Errorf("SlugNotFound", "nope")), 400, "SlugNotFound"},
+		{errors.New("bad"), 400, InvalidRequest},
+		{errors.New("bad"), 401, AuthenticationRequired},
+		{errors.New("bad"), 403, Forbidden},
+		{errors.New("bad"), 404, NotFound},
+		{errors.New("bad"), 405, MethodNotAllowed},
+		{errors.New("bad"), 413, InvalidRequest},
+		{errors.New("bad"), 429, RateLimitExceeded},
+		{errors.New("bad"), 500, InternalServerError},
+		{errors.New("bad"), 501, MethodNotImplemented},
+		{errors.New("bad"), 502, UpstreamFailure},
+		{errors.New("bad"), 503, InternalServerError},
+	} {
+		if got := ErrorName(tc.err, tc.status); got != tc.want {
+			t.Errorf("ErrorName(%v, %d) = %q, want %q", tc.err, tc.status, got, tc.want)
+		}
+	}
+}
+
+type testOutput struct {
+	Caller string `json:"caller"`
+	Actor  string `json:"actor,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+type testInput struct {
+	Name string `json:"name"`
+}
+
+// newTestServer has a method for each auth level, plus a procedure and some failing handlers.
+// tokens are "Bearer <did>", anything else fails
+func newTestServer() *Server {
+	s := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.Authenticate = func(r *http.Request) (syntax.DID, error) {
+		tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return "", errors.New("no bearer token")
+		}
+		return syntax.ParseDID(tok)
+	}
+	s.IsAdmin = func(did syntax.DID) bool { return did == testAdmin }
+
+	whoami := func(req *Request, p Empty) (*testOutput, int, error) {
+		return &testOutput{Caller: req.Caller.String()}, 200, nil
+	}
+	Query(s, "dev.test.none", Opts{}, whoami)
+	Query(s, "dev.test.optional", Opts{Auth: AuthOptional}, whoami)
+	Query(s, "dev.test.required", Opts{Auth: AuthRequired}, whoami)
+	Query(s, "dev.test.admin", Opts{Auth: AuthAdmin}, whoami)
+
+	Query(s, "dev.test.params", Opts{}, func(req *Request, p testParams) (*testOutput, int, error) {
+		return &testOutput{Actor: p.Actor}, 200, nil
+	})
+	Procedure(s, "dev.test.procedure", Opts{}, func(req *Request, in testInput) (*testOutput, int, error) {
+		return &testOutput{Name: in.Name}, 200, nil
+	})
+	Procedure(s, "dev.test.empty", Opts{}, func(req *Request, in Empty) (*Empty, int, error) {
+		return &Empty{}, 200, nil
+	})
+	Query(s, "dev.test.notFound", Opts{}, func(req *Request, p Empty) (*testOutput, int, error) {
+		return nil, 404, Errorf("ThingNotFound", "no thing %q", "x")
+	})
+	Query(s, "dev.test.broken", Opts{}, func(req *Request, p Empty) (*testOutput, int, error) {
+		return nil, 0, errors.New("database is on fire")
+	})
+	return s
+}
+
+func TestServeHTTP(t *testing.T) {
+	s := newTestServer()
+	for _, tc := range []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		body    string
+		status  int
+		// the XRPC error name, or the body for 200s
+		want string
+	}{
+		{"no auth", "GET", "/xrpc/dev.test.none", nil, "", 200, `{"caller":""}`},
+		{"no auth ignores credentials", "GET", "/xrpc/dev.test.none", map[string]string{"Authorization": "garbage"}, "", 200, `{"caller":""}`},
+
+		{"optional, logged out", "GET", "/xrpc/dev.test.optional", nil, "", 200, `{"caller":""}`},
+		{"optional, logged in", "GET", "/xrpc/dev.test.optional", map[string]string{"Authorization": "Bearer " + string(testUser)}, "", 200, `{"caller":"` + string(testUser) + `"}`},
+		{"optional, bad credentials", "GET", "/xrpc/dev.test.optional", map[string]string{"Authorization": "garbage"}, "", 401, AuthenticationRequired},
+
+		{"required, logged out", "GET", "/xrpc/dev.test.required", nil, "", 401, AuthenticationRequired},
+		{"required, logged in", "GET", "/xrpc/dev.test.required", map[string]string{"Authorization": "Bearer " + string(testUser)}, "", 200, `{"caller":"` + string(testUser) + `"}`},
+
+		{"admin, logged out", "GET", "/xrpc/dev.test.admin", nil, "", 401, AuthenticationRequired},
+		{"admin, not an admin", "GET", "/xrpc/dev.test.admin", map[string]string{"Authorization": "Bearer " + string(testUser)}, "", 403, Forbidden},
+		{"admin, admin", "GET", "/xrpc/dev.test.admin", map[string]string{"Authorization": "Bearer " + string(testAdmin)}, "", 200, `{"caller":"` + string(testAdmin) + `"}`},
+
+		{"unknown method", "GET", "/xrpc/dev.test.nothing", nil, "", 501, MethodNotImplemented},
+		{"query with POST", "POST", "/xrpc/dev.test.none", nil, "", 405, MethodNotAllowed},
+		{"procedure with GET", "GET", "/xrpc/dev.test.procedure", nil, "", 405, MethodNotAllowed},
+
+		{"accepts json", "GET", "/xrpc/dev.test.none", map[string]string{"Accept": "text/html, application/json;q=0.9"}, "", 200, `{"caller":""}`},
+		{"accepts anything", "GET", "/xrpc/dev.test.none", map[string]string{"Accept": "*/*"}, "", 200, `{"caller":""}`},
+		{"doesn't accept json", "GET", "/xrpc/dev.test.none", map[string]string{"Accept": "text/html"}, "", 406, InvalidRequest},
+
+		{"params", "GET", "/xrpc/dev.test.params?actor=alice", nil, "", 200, `{"caller":"","actor":"alice"}`},
+		{"missing param", "GET", "/xrpc/dev.test.params", nil, "", 400, InvalidRequest},
+
+		{"procedure", "POST", "/xrpc/dev.test.procedure", map[string]string{"Content-Type": "application/json; charset=utf-8"}, `{"name":"x"}`, 200, `{"caller":"","name":"x"}`},
+		{"procedure without a content type", "POST", "/xrpc/dev.test.procedure", nil, `{"name":"x"}`, 200, `{"caller":"","name":"x"}`},
+		{"procedure with the wrong content type", "POST", "/xrpc/dev.test.procedure", map[string]string{"Content-Type": "text/plain"}, `{"name":"x"}`, 415, InvalidRequest},
+		{"procedure with a bad body", "POST", "/xrpc/dev.test.procedure", map[string]string{"Content-Type": "application/json"}, `{"name":`, 400, InvalidRequest},
+		{"procedure body too big", "POST", "/xrpc/dev.test.procedure", map[string]string{"Content-Type": "application/json"}, `{"name":"` + strings.Repeat("x", maxInputBytes) + `"}`, 400, InvalidRequest},
+		{"procedure without input ignores the body", "POST", "/xrpc/dev.test.empty", map[string]string{"Content-Type": "text/plain"}, "whatever", 200, ""},
+
+		{"named error", "GET", "/xrpc/dev.test.notFound", nil, "", 404, "ThingNotFound"},
+		{"internal error", "GET", "/xrpc/dev.test.broken", nil, "", 500, InternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("got %d, want %d: %s", w.Code, tc.status, w.Body.String())
+			}
+			if tc.status == 200 {
+				if got := w.Body.String(); got != tc.want {
+					t.Errorf("got %s, want %s", got, tc.want)
+				}
+				return
+			}
+			xerr := struct{ Error, Message string }{}
+			if err := json.Unmarshal(w.Body.Bytes(), &xerr); err != nil {
+				t.Fatalf("error isn't JSON: %s", w.Body.String())
+			}
+			if xerr.Error != tc.want {
+				t.Errorf("error is %q, want %q", xerr.Error, tc.want)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("error Content-Type is %q", ct)
+			}
+			if tc.status == 405 && w.Header().Get("Allow") == "" {
+				t.Error("405 without an Allow header")
+			}
+			if tc.status == 500 && strings.Contains(xerr.Message, "fire") {
+				t.Errorf("internal error leaked to the client: %q", xerr.Message)
+			}
+		})
+	}
+}
+
+func TestServeHTTPNoAuthenticate(t *testing.T) {
+	s := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	Query(s, "dev.test.required", Opts{Auth: AuthRequired}, func(req *Request, p Empty) (*Empty, int, error) {
+		return &Empty{}, 200, nil
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/xrpc/dev.test.required", nil))
+	if w.Code != 500 {
+		t.Errorf("auth without Authenticate gave %d, want 500", w.Code)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	s := newTestServer()
+	methods := s.Methods()
+	for i := 1; i < len(methods); i++ {
+		if methods[i-1].NSID >= methods[i].NSID {
+			t.Errorf("methods aren't sorted: %s before %s", methods[i-1].NSID, methods[i].NSID)
+		}
+	}
+	for _, m := range methods {
+		if m.NSID == "dev.test.none" && m.Auth != AuthNone {
+			t.Errorf("default auth is %q, want %q", m.Auth, AuthNone)
+		}
+		if m.NSID == "dev.test.procedure" && m.Type != TypeProcedure {
+			t.Errorf("dev.test.procedure is a %s", m.Type)
+		}
+	}
+
+	for name, nsid := range map[string]string{"twice": "dev.test.none", "invalid NSID": "not an nsid"} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("didn't panic")
+				}
+			}()
+			Query(s, nsid, Opts{}, func(req *Request, p Empty) (*Empty, int, error) { return nil, 200, nil })
+		})
+	}
+}
+
+func TestServeHTTPRemoteAddr(t *testing.T) {
+	logs := &strings.Builder{}
+	s := New(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	Query(s, "dev.test.none", Opts{}, func(req *Request, p Empty) (*Empty, int, error) {
+		return &Empty{}, 200, nil
+	})
+	r := httptest.NewRequest("GET", "/xrpc/dev.test.none", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+
+	s.ServeHTTP(httptest.NewRecorder(), r)
+	if !strings.Contains(logs.String(), "remote_addr=127.0.0.1:1234") {
+		t.Errorf("without RemoteAddr, logged %q", logs.String())
+	}
+
+	// behind a proxy, the client is whoever RemoteAddr says
+	logs.Reset()
+	s.RemoteAddr = func(r *http.Request) string { return "203.0.113.7" }
+	s.ServeHTTP(httptest.NewRecorder(), r)
+	if !strings.Contains(logs.String(), "remote_addr=203.0.113.7") || strings.Contains(logs.String(), "127.0.0.1") {
+		t.Errorf("with RemoteAddr, logged %q", logs.String())
+	}
+}
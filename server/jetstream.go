@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"gorm.io/gorm"
 
@@ -13,7 +15,7 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// todo maybe change to using real firehose in the future
+// see firehose.go for the (verified) relay firehose backend
 
 // NOTE
 // switched from jetstream east to jetstream west aug 15
@@ -23,32 +25,101 @@ import (
 // `uniphil` mentioned that it could happen due to "very sparse output", but
 // app.bsky.actor.profile is pretty frequent, to the tune of at least one per second
 // - saturn-vi
-var jetstreamUri = "wss://jetstream2.us-west.bsky.network/subscribe?wantedCollections=dev.skywell.file&wantedCollections=app.bsky.actor.profile"
+//
+// west is still first in the list, but we fail over to the others
+// (or a self-hosted instance) instead of picking one by hand.
+// these are the defaults for ingest.jetstream_hosts
+var jetstreamHosts = []string{
+	"wss://jetstream2.us-west.bsky.network",
+	"wss://jetstream1.us-west.bsky.network",
+	"wss://jetstream2.us-east.bsky.network",
+	"wss://jetstream1.us-east.bsky.network",
+}
+
+const jetstreamPath = "/subscribe?wantedCollections=dev.skywell.file&wantedCollections=dev.skywell.collection&wantedCollections=app.bsky.actor.profile"
+
+const jetstreamCursorService = "jetstream"
+
+// we resume a little before the saved cursor in case anything was in flight,
+// updateRecord doesn't mind seeing the same event twice
+const cursorRewind = 5 * time.Second
+
+// no need to hit the database on every single event
+const cursorSaveInterval = 5 * time.Second
+
+// profile updates come in constantly, so a quiet connection is a dead one
+const jetstreamReadTimeout = 1 * time.Minute
+
+// read keeps a jetstream connection open until ctx is cancelled,
+// moving on to the next host whenever it drops
+func read(db *gorm.DB, client *xrpc.Client, cfg *Config, ctx context.Context) {
+	cursor, err := loadCursor(jetstreamCursorService, db)
+	if err != nil {
+		jetstreamLogger.Error("Failed to load cursor, starting from live", "error", err)
+		cursor = 0
+	}
+
+	superviseStream(cfg.Ingest.JetstreamHosts, jetstreamLogger, func(host string) error {
+		return readJetstream(host, &cursor, db, client, ctx)
+	}, ctx)
+	jetstreamLogger.Info("Stopped reading from Jetstream", "cursor", cursor)
+}
+
+// readJetstream handles events from a single connection until it fails.
+// cursor is updated as events are processed so the next connection can resume from it
+func readJetstream(host string, cursor *int64, db *gorm.DB, client *xrpc.Client, ctx context.Context) error {
+	uri := host + jetstreamPath
+	if *cursor > 0 {
+		uri = fmt.Sprintf("%s&cursor=%d", uri, *cursor-cursorRewind.Microseconds())
+		jetstreamLogger.Info("Resuming from cursor", "cursor", *cursor, "rewind", cursorRewind, "host", host)
+	}
 
-func read(db *gorm.DB, client *xrpc.Client, ctx context.Context) {
-	conn, res, err := websocket.DefaultDialer.Dial(jetstreamUri, http.Header{})
+	conn, res, err := websocket.DefaultDialer.DialContext(ctx, uri, http.Header{})
 	if err != nil {
-		jetstreamLogger.Error("Failed to connect to Jetstream", "status_code", res.StatusCode, "error", err, "uri", jetstreamUri)
-		panic(err)
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		jetstreamLogger.Error("Failed to connect to Jetstream", "status_code", status, "error", err, "uri", uri)
+		return err
 	}
+	jetstreamLogger.Info("Connected to Jetstream", "host", host)
+
+	// unblocks NextReader when we're shutting down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
 	defer func(conn *websocket.Conn) {
+		if err := saveCursor(jetstreamCursorService, *cursor, db); err != nil {
+			jetstreamLogger.Error("Failed to save cursor", "cursor", *cursor, "error", err)
+		}
 		err := conn.Close()
-		if err != nil {
+		if err != nil && ctx.Err() == nil {
 			jetstreamLogger.Error("Failed to close connection", "error", err)
 		}
 	}(conn)
 
+	lastSave := time.Now()
+
 	for {
+		if err := conn.SetReadDeadline(time.Now().Add(jetstreamReadTimeout)); err != nil {
+			return err
+		}
 		_, r, err := conn.NextReader()
 		if err != nil {
-			jetstreamLogger.Error("Error reading from jetstream", "error", err, "uri", jetstreamUri)
-			continue
+			return fmt.Errorf("error reading from jetstream: %w", err)
 		}
 
 		msg, err := io.ReadAll(r)
 		if err != nil {
-			jetstreamLogger.Error("Error reading message", "error", err, "uri", jetstreamUri)
-			continue
+			return fmt.Errorf("error reading message: %w", err)
 		}
 
 		var evt jetstream.Event
@@ -62,11 +133,21 @@ func read(db *gorm.DB, client *xrpc.Client, ctx context.Context) {
 		case jetstream.EventKindIdentity:
 			updateIdentity(evt, db, client, ctx)
 		case jetstream.EventKindAccount:
-			updateAccount(evt)
+			updateAccount(evt, db)
 		case jetstream.EventKindCommit:
 			updateRecord(evt, db, client, ctx)
 		default:
 			jetstreamLogger.Warn("Unknown jetstream event kind", "kind", evt.Kind, "did", evt.Did)
 		}
+
+		if evt.TimeUS > *cursor {
+			*cursor = evt.TimeUS
+		}
+		if time.Since(lastSave) > cursorSaveInterval {
+			if err := saveCursor(jetstreamCursorService, *cursor, db); err != nil {
+				jetstreamLogger.Error("Failed to save cursor", "cursor", *cursor, "error", err)
+			}
+			lastSave = time.Now()
+		}
 	}
 }
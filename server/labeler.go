@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/label"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+// our own labeler, so operators can label abusive files and accounts.
+// labels are signed with labels.signing_key as cfg.labelerDID() and kept in label_events,
+// which is what com.atproto.label.subscribeLabels replays from a cursor.
+// they also go straight into the labels table, so they apply to our own views like anyone else's
+
+const (
+	labelerServiceID   = "atproto_labeler"
+	labelerServiceType = "AtprotoLabeler"
+	labelerKeyID       = "atproto_label"
+
+	labelPollInterval   = time.Second
+	labelBatchSize      = 100
+	defaultQueryLimit   = 50
+	maxLabelQueryLimit  = 250
+	labelerWriteTimeout = 10 * time.Second
+)
+
+// LabelEvent is one label we've emitted, in order. seq is the subscribeLabels cursor
+type LabelEvent struct {
+	Seq       int64 `gorm:"primaryKey"`
+	Src       string
+	Uri       string
+	Cid       string
+	Val       string
+	Neg       bool
+	Cts       string
+	Exp       string
+	Sig       []byte
+	CreatedAt time.Time
+}
+
+// labelerDID is who our labels are from: the did:web if there is one, otherwise the service DID
+func (cfg *Config) labelerDID() string {
+	if did := cfg.didWeb(); did != "" {
+		return did
+	}
+	return cfg.ServiceDID
+}
+
+// signLabel makes a signed label event (without a seq)
+func signLabel(src string, uri string, c string, val string, neg bool, exp *time.Time, key crypto.PrivateKey) (evt LabelEvent, err error) {
+	l := label.Label{
+		SourceDID: src,
+		URI:       uri,
+		Val:       val,
+		CreatedAt: syntax.DatetimeNow().String(),
+		Version:   label.ATPROTO_LABEL_VERSION,
+	}
+	if c != "" {
+		l.CID = &c
+	}
+	if neg {
+		l.Negated = &neg
+	}
+	if exp != nil {
+		s := exp.UTC().Format(syntax.AtprotoDatetimeLayout)
+		l.ExpiresAt = &s
+	}
+	if err := l.VerifySyntax(); err != nil {
+		return evt, fmt.Errorf("invalid label: %w", err)
+	}
+	if err := l.Sign(key); err != nil {
+		return evt, fmt.Errorf("failed to sign label: %w", err)
+	}
+	evt = LabelEvent{
+		Src: l.SourceDID,
+		Uri: l.URI,
+		Cid: c,
+		Val: l.Val,
+		Neg: neg,
+		Cts: l.CreatedAt,
+		Sig: l.Sig,
+	}
+	if l.ExpiresAt != nil {
+		evt.Exp = *l.ExpiresAt
+	}
+	return evt, nil
+}
+
+func (e LabelEvent) toLexicon() *comatproto.LabelDefs_Label {
+	ll := Label{Src: e.Src, Uri: e.Uri, Cid: e.Cid, Val: e.Val, Cts: e.Cts, Exp: e.Exp, Sig: e.Sig}.toLexicon()
+	if e.Neg {
+		ll.Neg = &e.Neg
+	}
+	return ll
+}
+
+// emitLabel signs a label as our labeler, publishes it and applies it
+func emitLabel(uri string, c string, val string, neg bool, exp *time.Time, db *gorm.DB, cfg *Config) (evt LabelEvent, err error) {
+	if cfg.Labels.SigningKey == "" {
+		return evt, errors.New("labels.signing_key isn't set")
+	}
+	key, err := crypto.ParsePrivateMultibase(cfg.Labels.SigningKey)
+	if err != nil {
+		return evt, fmt.Errorf("invalid labels.signing_key: %w", err)
+	}
+	evt, err = signLabel(cfg.labelerDID(), uri, c, val, neg, exp, key)
+	if err != nil {
+		return evt, err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&evt).Error; err != nil {
+			return fmt.Errorf("failed to save label event: %w", err)
+		}
+		return storeLabel(evt.toLexicon(), tx)
+	})
+	if err != nil {
+		return evt, err
+	}
+	labelLogger.Info("Emitted label", "seq", evt.Seq, "uri", uri, "val", val, "neg", neg)
+	return evt, nil
+}
+
+// labelLog is what a labeler serves. it's the database for ours (and memory for the tests' localLabeler)
+type labelLog interface {
+	// since returns up to limit events after seq, oldest first
+	since(seq int64, limit int) ([]LabelEvent, error)
+	// latest is the newest seq, 0 if there's nothing yet
+	latest() (int64, error)
+	// current returns up to limit labels in effect whose subject matches one of patterns, after cursor.
+	// a pattern ending in * matches by prefix
+	current(patterns []string, cursor int64, limit int) (labels []LabelEvent, next int64, err error)
+}
+
+type dbLabelLog struct {
+	db  *gorm.DB
+	src string
+}
+
+func (l dbLabelLog) since(seq int64, limit int) ([]LabelEvent, error) {
+	evts := []LabelEvent{}
+	err := l.db.Where("seq > ?", seq).Order("seq").Limit(limit).Find(&evts).Error
+	return evts, err
+}
+
+func (l dbLabelLog) latest() (int64, error) {
+	var seq int64
+	err := l.db.Model(&LabelEvent{}).Select("COALESCE(MAX(seq), 0)").Scan(&seq).Error
+	return seq, err
+}
+
+func (l dbLabelLog) current(patterns []string, cursor int64, limit int) (labels []LabelEvent, next int64, err error) {
+	conds := []string{}
+	args := []any{}
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			conds = append(conds, `uri LIKE ? ESCAPE '\'`)
+			args = append(args, escapeLike(prefix)+"%")
+		} else {
+			conds = append(conds, "uri = ?")
+			args = append(args, p)
+		}
+	}
+	rows := []Label{}
+	err = l.db.Where("src = ? AND id > ?", l.src, cursor).
+		Where(strings.Join(conds, " OR "), args...).
+		Order("id").Limit(limit).Find(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, r := range rows {
+		labels = append(labels, LabelEvent{Src: r.Src, Uri: r.Uri, Cid: r.Cid, Val: r.Val, Cts: r.Cts, Exp: r.Exp, Sig: r.Sig})
+		next = int64(r.ID)
+	}
+	return labels, next, nil
+}
+
+// initializeLabeler serves our labeler's endpoints when there's a signing key to label with
+func initializeLabeler(s *xrpcserver.Server, db *gorm.DB, cfg *Config, ctx context.Context) {
+	if cfg.Labels.SigningKey == "" {
+		return
+	}
+	serveLabeler(s, dbLabelLog{db, cfg.labelerDID()}, ctx)
+	labelLogger.Info("Serving labeler", "did", cfg.labelerDID())
+}
+
+type queryLabelsParams struct {
+	UriPatterns []string `query:"uriPatterns,required"`
+	Sources     []string `query:"sources"`
+	Limit       int      `query:"limit"`
+	Cursor      string   `query:"cursor"`
+}
+
+type subscribeLabelsParams struct {
+	// a string, since no cursor and 0 mean different things
+	Cursor string `query:"cursor"`
+}
+
+func serveLabeler(s *xrpcserver.Server, ll labelLog, ctx context.Context) {
+	opts := xrpcserver.Opts{Logger: labelLogger}
+
+	xrpcserver.Query(s, "com.atproto.label.queryLabels", opts, func(req *xrpcserver.Request, p queryLabelsParams) (*comatproto.LabelQueryLabels_Output, int, error) {
+		limit := defaultQueryLimit
+		if p.Limit != 0 {
+			if p.Limit < 1 || p.Limit > maxLabelQueryLimit {
+				return nil, 400, fmt.Errorf("parameter 'limit' must be between 1 and %d", maxLabelQueryLimit)
+			}
+			limit = p.Limit
+		}
+		var cursor int64
+		if p.Cursor != "" {
+			var err error
+			if cursor, err = strconv.ParseInt(p.Cursor, 10, 64); err != nil {
+				return nil, 400, fmt.Errorf("invalid 'cursor' parameter")
+			}
+		}
+
+		labels, next, err := ll.current(p.UriPatterns, cursor, limit)
+		if err != nil {
+			return nil, 500, fmt.Errorf("failed to query labels: %w", err)
+		}
+		// sources is a filter, and there's only the one source here
+		if len(p.Sources) > 0 {
+			filtered := labels[:0]
+			for _, l := range labels {
+				for _, s := range p.Sources {
+					if l.Src == s {
+						filtered = append(filtered, l)
+						break
+					}
+				}
+			}
+			labels = filtered
+		}
+
+		o := &comatproto.LabelQueryLabels_Output{Labels: []*comatproto.LabelDefs_Label{}}
+		for _, l := range labels {
+			o.Labels = append(o.Labels, l.toLexicon())
+		}
+		if next > 0 {
+			c := strconv.FormatInt(next, 10)
+			o.Cursor = &c
+		}
+		return o, 200, nil
+	})
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	xrpcserver.Subscription(s, "com.atproto.label.subscribeLabels", opts, func(w http.ResponseWriter, req *xrpcserver.Request, p subscribeLabelsParams) {
+		logger := req.Logger
+		latest, err := ll.latest()
+		if err != nil {
+			logger.Error("Failed to find latest label", "error", err)
+			xrpcserver.WriteError(w, 500, xrpcserver.InternalServerError, "Internal Server Error (label lookup)")
+			return
+		}
+		// no cursor means only new labels
+		seq := latest
+		if p.Cursor != "" {
+			if seq, err = strconv.ParseInt(p.Cursor, 10, 64); err != nil || seq < 0 {
+				xrpcserver.WriteError(w, 400, xrpcserver.InvalidRequest, "Invalid 'cursor' parameter")
+				return
+			}
+		}
+
+		conn, err := upgrader.Upgrade(w, req.Request, nil)
+		if err != nil {
+			// Upgrade has already told the client
+			logger.Warn("Failed to upgrade to websocket", "error", err)
+			return
+		}
+		defer conn.Close()
+
+		if seq > latest {
+			writeLabelFrame(conn, events.EventHeader{Op: events.EvtKindErrorFrame}, &events.ErrorFrame{Error: "FutureCursor", Message: "Cursor is ahead of the latest label"})
+			return
+		}
+
+		// we don't expect anything from subscribers, but reading is how we notice they left
+		// (and how pings get answered)
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(labelPollInterval)
+		defer ticker.Stop()
+		for {
+			evts, err := ll.since(seq, labelBatchSize)
+			if err != nil {
+				logger.Error("Failed to read label events", "seq", seq, "error", err)
+				return
+			}
+			for _, e := range evts {
+				msg := &comatproto.LabelSubscribeLabels_Labels{Seq: e.Seq, Labels: []*comatproto.LabelDefs_Label{e.toLexicon()}}
+				if err := writeLabelFrame(conn, events.EventHeader{Op: events.EvtKindMessage, MsgType: "#labels"}, msg); err != nil {
+					logger.Debug("Subscriber went away", "seq", seq, "error", err)
+					return
+				}
+				seq = e.Seq
+			}
+			if len(evts) == labelBatchSize {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+				return
+			case <-gone:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+type cborMarshaler interface {
+	MarshalCBOR(w io.Writer) error
+}
+
+// writeLabelFrame writes one event stream frame: a header, then the body.
+// events.XRPCStreamEvent only knows repo events, so labels are written by hand
+func writeLabelFrame(conn *websocket.Conn, header events.EventHeader, body cborMarshaler) error {
+	conn.SetWriteDeadline(time.Now().Add(labelerWriteTimeout))
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if err := header.MarshalCBOR(w); err != nil {
+		return err
+	}
+	if err := body.MarshalCBOR(w); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// didDocumentLabeler is what goes in our DID document so others can find and check our labels
+func (cfg *Config) didDocumentLabeler() (vm *didVerificationMethod, svc *didService, err error) {
+	key, err := crypto.ParsePrivateMultibase(cfg.Labels.SigningKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	did := cfg.labelerDID()
+	vm = &didVerificationMethod{
+		ID:                 did + "#" + labelerKeyID,
+		Type:               "Multikey",
+		Controller:         did,
+		PublicKeyMultibase: pub.Multibase(),
+	}
+	svc = &didService{
+		ID:              "#" + labelerServiceID,
+		Type:            labelerServiceType,
+		ServiceEndpoint: cfg.didWebServiceEndpoint(),
+	}
+	return vm, svc, nil
+}
+
+// runLabel implements the `label` subcommand
+func runLabel(args []string, cfg *Config) error {
+	fs := flag.NewFlagSet("label", flag.ExitOnError)
+	neg := fs.Bool("neg", false, "take the label back instead")
+	exp := fs.Duration("exp", 0, "make the label expire after this long (e.g. 720h)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: skywell [-config path] label [flags] <at-uri|did|slug> <value>\n")
+		fmt.Fprintf(fs.Output(), "       skywell [-config path] label genkey\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 1 && fs.Arg(0) == "genkey" {
+		key, err := crypto.GeneratePrivateKeyK256()
+		if err != nil {
+			return err
+		}
+		pub, err := key.PublicKey()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("signing_key = %q\n", key.Multibase())
+		fmt.Printf("# public key, for the #%s verification method: %s\n", labelerKeyID, pub.Multibase())
+		return nil
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("need a subject and a label value")
+	}
+	subject, val := fs.Arg(0), fs.Arg(1)
+
+	db, _, err := initializeDB(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	// labels on a file are pinned to the version we know about
+	uri, c := subject, ""
+	if !strings.HasPrefix(subject, "at://") && !strings.HasPrefix(subject, "did:") {
+		fk := FileKey{}
+		if err := db.Where("key = ?", subject).First(&fk).Error; err != nil {
+			return fmt.Errorf("failed to find file for slug %q: %w", subject, err)
+		}
+		f := File{}
+		if err := db.Where("id = ?", fk.File).First(&f).Error; err != nil {
+			return fmt.Errorf("failed to find file for slug %q: %w", subject, err)
+		}
+		uri, c = f.Uri.String(), f.Cid.String()
+	}
+
+	var expiry *time.Time
+	if *exp > 0 {
+		t := time.Now().Add(*exp)
+		expiry = &t
+	}
+	evt, err := emitLabel(uri, c, val, *neg, expiry, db, cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("labeled %s %s (seq %d)\n", uri, val, evt.Seq)
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+// localLabeler is a labeler that lives in memory on a loopback port, with a throwaway key.
+// it stands in for a real labeler: put identity() in useTestDirectory, and its DID in labels.labelers
+type localLabeler struct {
+	did    syntax.DID
+	key    crypto.PrivateKeyExportable
+	server *httptest.Server
+
+	mu     sync.Mutex
+	events []LabelEvent
+}
+
+func newLocalLabeler(t *testing.T, did syntax.DID) *localLabeler {
+	t.Helper()
+	key, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatalf("failed to make labeler key: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ll := &localLabeler{did: did, key: key}
+	s := xrpcserver.New(labelLogger)
+	s.LogAttrs = requestLogAttrs
+	serveLabeler(s, ll, ctx)
+	ll.server = httptest.NewServer(requestCorrelationMiddleware(s))
+	// subscribeLabels only lets go of its connections once ctx is done
+	t.Cleanup(func() {
+		cancel()
+		ll.server.Close()
+	})
+	return ll
+}
+
+// identity is the labeler's identity, as a DID document would describe it
+func (ll *localLabeler) identity() identity.Identity {
+	pub, _ := ll.key.PublicKey()
+	return identity.Identity{
+		DID:    ll.did,
+		Handle: syntax.HandleInvalid,
+		Keys: map[string]identity.VerificationMethod{
+			labelerKeyID: {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+		Services: map[string]identity.ServiceEndpoint{
+			labelerServiceID: {Type: labelerServiceType, URL: ll.server.URL},
+		},
+	}
+}
+
+// label publishes a label (or takes it back, with neg) on uri, which can also be a DID
+func (ll *localLabeler) label(uri string, val string, neg bool) error {
+	evt, err := signLabel(ll.did.String(), uri, "", val, neg, nil, ll.key)
+	if err != nil {
+		return err
+	}
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	evt.Seq = int64(len(ll.events) + 1)
+	evt.CreatedAt = time.Now()
+	ll.events = append(ll.events, evt)
+	return nil
+}
+
+func (ll *localLabeler) since(seq int64, limit int) ([]LabelEvent, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	evts := []LabelEvent{}
+	for _, e := range ll.events {
+		if e.Seq > seq && len(evts) < limit {
+			evts = append(evts, e)
+		}
+	}
+	return evts, nil
+}
+
+func (ll *localLabeler) latest() (int64, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return int64(len(ll.events)), nil
+}
+
+func (ll *localLabeler) current(patterns []string, cursor int64, limit int) (labels []LabelEvent, next int64, err error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	// the newest event for each label is the one that counts
+	newest := map[[2]string]LabelEvent{}
+	for _, e := range ll.events {
+		newest[[2]string{e.Uri, e.Val}] = e
+	}
+	for _, e := range ll.events {
+		if e.Seq <= cursor || e.Neg || newest[[2]string{e.Uri, e.Val}].Seq != e.Seq || len(labels) >= limit {
+			continue
+		}
+		for _, p := range patterns {
+			if prefix, ok := strings.CutSuffix(p, "*"); (ok && strings.HasPrefix(e.Uri, prefix)) || e.Uri == p {
+				labels = append(labels, e)
+				next = e.Seq
+				break
+			}
+		}
+	}
+	return labels, next, nil
+}
+
+func TestSubscribeLabelers(t *testing.T) {
+	db, cfg := newTestDB(t)
+	useTestLexicons(t)
+	user := createTestUser(t, db, testDID)
+	ll := newLocalLabeler(t, "did:plc:labelerlabelerlabelerla")
+	useTestDirectory(t, ll.identity(), identity.Identity{DID: user.DID, Handle: syntax.HandleInvalid})
+	cfg.Labels.Labelers = []string{ll.did.String()}
+
+	names := []string{"fine", "hidden", "blurred", "warned"}
+	files := map[string]File{}
+	for i, name := range names {
+		if err := ingestTestRecord(db, "dev.skywell.file", fmt.Sprintf("3kaaaaaaaa%03d", i), testFileRecord(name)); err != nil {
+			t.Fatalf("failed to index %q: %v", name, err)
+		}
+		f := File{}
+		db.Where("name = ?", name).First(&f)
+		files[name] = f
+	}
+	for name, val := range map[string]string{"fine": "!warn", "hidden": "!hide", "blurred": "porn", "warned": "!warn"} {
+		if err := ll.label(files[name].Uri.String(), val, false); err != nil {
+			t.Fatalf("failed to label %q: %v", name, err)
+		}
+	}
+	// labels from labelers we don't listen to don't count
+	if err := db.Create(&Label{Src: "did:plc:someoneelse", Uri: files["fine"].Uri.String(), Val: "!hide"}).Error; err != nil {
+		t.Fatalf("failed to add label: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribeLabelers(db, cfg, ctx)
+	waitForLabels := func(n int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var got int64
+			db.Model(&Label{}).Where("src = ?", ll.did.String()).Count(&got)
+			if got == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d labels stored, want %d", got, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForLabels(4)
+	// labels taken back while we're subscribed are gone too
+	if err := ll.label(files["fine"].Uri.String(), "!warn", true); err != nil {
+		t.Fatalf("failed to negate label: %v", err)
+	}
+	waitForLabels(3)
+
+	want := map[string]string{"fine": "", "hidden": labelActionHide, "blurred": labelActionBlur, "warned": labelActionWarn}
+	for name, m := range want {
+		fv, _, err := generateFileView(files[name].ID, db, cfg)
+		if err != nil {
+			t.Fatalf("generateFileView(%q): %v", name, err)
+		}
+		got := ""
+		if fv.Moderation != nil {
+			got = *fv.Moderation
+		}
+		if got != m {
+			t.Errorf("%q has moderation %q, want %q", name, got, m)
+		}
+		if (m == "") != (len(fv.Labels) == 0) {
+			t.Errorf("%q has %d labels", name, len(fv.Labels))
+		}
+	}
+	fk := FileKey{}
+	db.Where("file = ?", files["hidden"].ID).First(&fk)
+	if _, _, stat, _ := fileBySlug(fk.Key, db, cfg); stat != 404 {
+		t.Errorf("hidden file by slug gave %d, want 404", stat)
+	}
+
+	// labels on the account go on the profile, and a hide label hides it from everyone else
+	pv, _, err := generateProfileView(user.DID, "", db, cfg, ctx)
+	if err != nil {
+		t.Fatalf("generateProfileView: %v", err)
+	}
+	if pv.Moderation != nil {
+		t.Errorf("unlabeled profile has moderation %q", *pv.Moderation)
+	}
+	if err := ll.label(user.DID.String(), "!takedown", false); err != nil {
+		t.Fatalf("failed to label account: %v", err)
+	}
+	waitForLabels(4)
+	if _, stat, _ := generateProfileView(user.DID, "", db, cfg, ctx); stat != 404 {
+		t.Errorf("hidden profile gave %d, want 404", stat)
+	}
+	pv, _, err = generateProfileView(user.DID, user.DID, db, cfg, ctx)
+	if err != nil {
+		t.Fatalf("generateProfileView as the owner: %v", err)
+	}
+	if pv.Moderation == nil || *pv.Moderation != labelActionHide {
+		t.Errorf("owner's hidden profile has moderation %v, want hide", pv.Moderation)
+	}
+	// which hides all their files too
+	fv, _, err := generateFileView(files["warned"].ID, db, cfg)
+	if err != nil {
+		t.Fatalf("generateFileView: %v", err)
+	}
+	if fv.Moderation == nil || *fv.Moderation != labelActionHide {
+		t.Errorf("file on a hidden account has moderation %v, want hide", fv.Moderation)
+	}
+}
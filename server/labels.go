@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/label"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/gorilla/websocket"
+	"github.com/saturn-vi/skywell/api/skywell"
+)
+
+// moderation labels. we subscribe to the labelers in labels.labelers with com.atproto.label.subscribeLabels,
+// check each label's signature, and keep the current state in the labels table.
+// our own labels (see labeler.go) end up in the same table.
+// what a label does is up to labels.actions: hide makes files and accounts 404 for everyone but their owner,
+// blur and warn are passed along in the views' moderation field for clients to act on
+
+var labelLogger = slog.With("component", "labels")
+
+const (
+	labelActionHide   = "hide"
+	labelActionBlur   = "blur"
+	labelActionWarn   = "warn"
+	labelActionIgnore = "ignore"
+)
+
+// how strong each action is, when a subject has more than one
+var labelActionRank = map[string]int{
+	labelActionWarn: 1,
+	labelActionBlur: 2,
+	labelActionHide: 3,
+}
+
+// Label is the current state of one label value on one subject (an at-uri or a DID) from one labeler.
+// negations delete the row
+type Label struct {
+	ID  uint   `gorm:"primaryKey"`
+	Src string `gorm:"uniqueIndex:idx_labels_src_uri_val"`
+	Uri string `gorm:"uniqueIndex:idx_labels_src_uri_val;index"`
+	Val string `gorm:"uniqueIndex:idx_labels_src_uri_val"`
+	Cid string
+	// cts and exp exactly as the labeler sent them, since they're covered by the signature
+	Cts       string
+	Exp       string
+	ExpiresAt *time.Time `gorm:"index"`
+	Sig       []byte
+	UpdatedAt time.Time
+}
+
+// trustedLabelers are the labelers whose labels count. ours always does
+func (cfg *Config) trustedLabelers() []string {
+	return append([]string{cfg.labelerDID()}, cfg.Labels.Labelers...)
+}
+
+// labelValues returns the label values configured with action
+func (cfg *Config) labelValues(action string) []string {
+	vals := []string{}
+	for val, a := range cfg.Labels.Actions {
+		if a == action {
+			vals = append(vals, val)
+		}
+	}
+	return vals
+}
+
+// activeLabels is a scope for label queries that leaves out expired labels and ones from labelers we don't trust
+func activeLabels(cfg *Config) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("labels.src IN ?", cfg.trustedLabelers()).
+			Where("labels.expires_at IS NULL OR labels.expires_at > ?", time.Now())
+	}
+}
+
+// hideLabeled is a scope for file queries that drops files with a hide label on them or their account,
+// unless the owner is the one looking
+func hideLabeled(owner bool, cfg *Config) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		vals := cfg.labelValues(labelActionHide)
+		if owner || len(vals) == 0 {
+			return db
+		}
+		hidden := db.Session(&gorm.Session{NewDB: true}).Model(&Label{}).Select("1").
+			Scopes(activeLabels(cfg)).
+			Where("labels.val IN ?", vals).
+			Where("labels.uri = files.uri OR labels.uri = (SELECT users.did FROM users WHERE users.id = files.user_id)")
+		return db.Where("NOT EXISTS (?)", hidden)
+	}
+}
+
+// visibleFiles is a scope for file queries that leaves out everything that shouldn't be shown:
+// taken down by an admin (even to the owner), flagged by a scanner or hidden by a label
+func visibleFiles(owner bool, cfg *Config) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("files.taken_down = ?", false).Scopes(hideFlagged(owner, cfg), hideLabeled(owner, cfg))
+	}
+}
+
+// labelsFor returns the active labels on each subject
+func labelsFor(subjects []string, db *gorm.DB, cfg *Config) (labels map[string][]Label, err error) {
+	labels = map[string][]Label{}
+	if len(subjects) == 0 {
+		return labels, nil
+	}
+	rows := []Label{}
+	if err := db.Scopes(activeLabels(cfg)).Where("uri IN ?", subjects).Order("id").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to find labels: %w", err)
+	}
+	for _, l := range rows {
+		labels[l.Uri] = append(labels[l.Uri], l)
+	}
+	return labels, nil
+}
+
+// moderationFor picks the strongest action out of labels. onlyHide is for account labels on files,
+// where a porn label on the account shouldn't blur every file but a takedown should still hide them
+func moderationFor(labels []Label, onlyHide bool, cfg *Config) string {
+	best := ""
+	for _, l := range labels {
+		a := cfg.Labels.Actions[l.Val]
+		if onlyHide && a != labelActionHide {
+			continue
+		}
+		if labelActionRank[a] > labelActionRank[best] {
+			best = a
+		}
+	}
+	return best
+}
+
+// accountHidden reports whether did has a hide label on it
+func accountHidden(did syntax.DID, db *gorm.DB, cfg *Config) (hidden bool, err error) {
+	labels, err := labelsFor([]string{did.String()}, db, cfg)
+	if err != nil {
+		return false, err
+	}
+	return moderationFor(labels[did.String()], true, cfg) == labelActionHide, nil
+}
+
+func (l Label) toLexicon() *comatproto.LabelDefs_Label {
+	ver := label.ATPROTO_LABEL_VERSION
+	ll := &comatproto.LabelDefs_Label{
+		Ver: &ver,
+		Src: l.Src,
+		Uri: l.Uri,
+		Val: l.Val,
+		Cts: l.Cts,
+		Sig: l.Sig,
+	}
+	if l.Cid != "" {
+		ll.Cid = &l.Cid
+	}
+	if l.Exp != "" {
+		ll.Exp = &l.Exp
+	}
+	return ll
+}
+
+// labelFileViews fills in labels and moderation on fileviews
+func labelFileViews(fileviews []*skywell.Defs_FileView, db *gorm.DB, cfg *Config) error {
+	subjects := []string{}
+	for _, fv := range fileviews {
+		subjects = append(subjects, fv.Uri)
+		if u, err := syntax.ParseATURI(fv.Uri); err == nil {
+			subjects = append(subjects, u.Authority().String())
+		}
+	}
+	labels, err := labelsFor(subjects, db, cfg)
+	if err != nil {
+		return err
+	}
+	for _, fv := range fileviews {
+		own := labels[fv.Uri]
+		for _, l := range own {
+			fv.Labels = append(fv.Labels, l.toLexicon())
+		}
+		m := moderationFor(own, false, cfg)
+		if u, err := syntax.ParseATURI(fv.Uri); err == nil {
+			if am := moderationFor(labels[u.Authority().String()], true, cfg); am != "" {
+				m = am
+			}
+		}
+		if m != "" {
+			fv.Moderation = &m
+		}
+	}
+	return nil
+}
+
+// labelProfileView fills in labels and moderation on a profile view
+func labelProfileView(pv *skywell.Defs_ProfileView, db *gorm.DB, cfg *Config) error {
+	labels, err := labelsFor([]string{pv.Did}, db, cfg)
+	if err != nil {
+		return err
+	}
+	for _, l := range labels[pv.Did] {
+		pv.Labels = append(pv.Labels, l.toLexicon())
+	}
+	if m := moderationFor(labels[pv.Did], false, cfg); m != "" {
+		pv.Moderation = &m
+	}
+	return nil
+}
+
+// storeLabel applies a label (or its negation) to the labels table.
+// the label should already have been checked
+func storeLabel(l *comatproto.LabelDefs_Label, db *gorm.DB) error {
+	if l.Neg != nil && *l.Neg {
+		return db.Where("src = ? AND uri = ? AND val = ?", l.Src, l.Uri, l.Val).Delete(&Label{}).Error
+	}
+
+	row := Label{
+		Src: l.Src,
+		Uri: l.Uri,
+		Val: l.Val,
+		Cts: l.Cts,
+		Sig: l.Sig,
+	}
+	if l.Cid != nil {
+		row.Cid = *l.Cid
+	}
+	if l.Exp != nil {
+		exp, err := syntax.ParseDatetimeLenient(*l.Exp)
+		if err != nil {
+			return fmt.Errorf("invalid exp: %w", err)
+		}
+		t := exp.Time()
+		row.Exp = *l.Exp
+		row.ExpiresAt = &t
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "src"}, {Name: "uri"}, {Name: "val"}},
+		DoUpdates: clause.AssignmentColumns([]string{"cid", "cts", "exp", "expires_at", "sig", "updated_at"}),
+	}).Create(&row).Error
+}
+
+// subscribeLabelers keeps a subscription open to every configured labeler until ctx is cancelled
+func subscribeLabelers(db *gorm.DB, cfg *Config, ctx context.Context) {
+	for _, did := range cfg.Labels.Labelers {
+		go func() {
+			superviseStream([]string{did}, labelLogger, func(did string) error {
+				return readLabeler(syntax.DID(did), db, cfg, ctx)
+			}, ctx)
+		}()
+	}
+}
+
+// labelerSigner finds a labeler's endpoint and the key its labels are signed with
+func labelerSigner(did syntax.DID, ctx context.Context) (endpoint string, key crypto.PublicKey, err error) {
+	id, err := cacheDir.LookupDID(ctx, did)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve labeler: %w", err)
+	}
+	endpoint = id.GetServiceEndpoint("atproto_labeler")
+	if endpoint == "" {
+		return "", nil, errors.New("DID document has no atproto_labeler service")
+	}
+	key, err = id.GetPublicKey("atproto_label")
+	if err != nil {
+		return "", nil, fmt.Errorf("DID document has no usable atproto_label key: %w", err)
+	}
+	return endpoint, key, nil
+}
+
+// readLabeler handles labels from one labeler until the connection fails
+func readLabeler(did syntax.DID, db *gorm.DB, cfg *Config, ctx context.Context) error {
+	endpoint, key, err := labelerSigner(did, ctx)
+	if err != nil {
+		return err
+	}
+
+	service := "labeler:" + did.String()
+	cursor, err := loadCursor(service, db)
+	if err != nil {
+		labelLogger.Error("Failed to load cursor, starting from the beginning", "labeler", did, "error", err)
+		cursor = 0
+	}
+
+	// labelers are https, their streams are wss
+	uri := strings.TrimRight(endpoint, "/") + "/xrpc/com.atproto.label.subscribeLabels"
+	uri = strings.Replace(strings.Replace(uri, "https://", "wss://", 1), "http://", "ws://", 1)
+	if cursor > 0 {
+		uri = fmt.Sprintf("%s?cursor=%d", uri, cursor)
+		labelLogger.Info("Resuming from cursor", "cursor", cursor, "labeler", did)
+	} else {
+		// everything they've ever said, so we start out with the full picture
+		uri += "?cursor=0"
+	}
+
+	conn, res, err := websocket.DefaultDialer.DialContext(ctx, uri, http.Header{"User-Agent": []string{cfg.UserAgent}})
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		labelLogger.Error("Failed to connect to labeler", "status_code", status, "error", err, "uri", uri)
+		return err
+	}
+	labelLogger.Info("Connected to labeler", "labeler", did, "endpoint", endpoint)
+
+	defer func() {
+		if err := saveCursor(service, cursor, db); err != nil {
+			labelLogger.Error("Failed to save cursor", "cursor", cursor, "labeler", did, "error", err)
+		}
+	}()
+
+	lastSave := time.Now()
+	rekeyed := false
+	rsc := &events.RepoStreamCallbacks{
+		LabelLabels: func(evt *comatproto.LabelSubscribeLabels_Labels) error {
+			for _, l := range evt.Labels {
+				err := checkLabel(l, did, key)
+				if err != nil && !rekeyed {
+					// the labeler might have rotated its key since we looked it up
+					rekeyed = true
+					if err := cacheDir.Purge(ctx, did.AtIdentifier()); err == nil {
+						if _, k, err := labelerSigner(did, ctx); err == nil {
+							key = k
+							err = checkLabel(l, did, key)
+						}
+					}
+				}
+				if err != nil {
+					labelLogger.Warn("Dropped invalid label", "labeler", did, "uri", l.Uri, "val", l.Val, "seq", evt.Seq, "error", err)
+					continue
+				}
+				if err := storeLabel(l, db); err != nil {
+					labelLogger.Error("Failed to store label", "labeler", did, "uri", l.Uri, "val", l.Val, "error", err)
+					continue
+				}
+				labelLogger.Debug("Stored label", "labeler", did, "uri", l.Uri, "val", l.Val, "neg", l.Neg != nil && *l.Neg)
+			}
+
+			if evt.Seq > cursor {
+				cursor = evt.Seq
+			}
+			if time.Since(lastSave) > cursorSaveInterval {
+				if err := saveCursor(service, cursor, db); err != nil {
+					labelLogger.Error("Failed to save cursor", "cursor", cursor, "labeler", did, "error", err)
+				}
+				lastSave = time.Now()
+			}
+			return nil
+		},
+		// indigo hands #info frames to RepoInfo whatever stream they came from, LabelInfo is in case it ever doesn't
+		RepoInfo: func(evt *comatproto.SyncSubscribeRepos_Info) error {
+			logLabelerInfo(did, evt.Name, evt.Message)
+			return nil
+		},
+		LabelInfo: func(evt *comatproto.LabelSubscribeLabels_Info) error {
+			logLabelerInfo(did, evt.Name, evt.Message)
+			return nil
+		},
+	}
+
+	// HandleRepoStream closes the connection itself once ctx is done
+	return events.HandleRepoStream(ctx, conn, sequential.NewScheduler(service, rsc.EventHandler), labelLogger)
+}
+
+func logLabelerInfo(did syntax.DID, name string, message *string) {
+	msg := ""
+	if message != nil {
+		msg = *message
+	}
+	labelLogger.Info("Labeler info", "labeler", did, "name", name, "message", msg)
+}
+
+// checkLabel makes sure a label is well formed, from the labeler we got it from, and signed by them
+func checkLabel(l *comatproto.LabelDefs_Label, did syntax.DID, key crypto.PublicKey) error {
+	if l.Src != did.String() {
+		return fmt.Errorf("label is from %s", l.Src)
+	}
+	ll := label.Label{
+		CID:       l.Cid,
+		CreatedAt: l.Cts,
+		ExpiresAt: l.Exp,
+		Negated:   l.Neg,
+		SourceDID: l.Src,
+		URI:       l.Uri,
+		Val:       l.Val,
+		Version:   label.ATPROTO_LABEL_VERSION,
+		Sig:       data.Bytes(l.Sig),
+	}
+	if l.Ver != nil {
+		ll.Version = *l.Ver
+	}
+	if err := ll.VerifySyntax(); err != nil {
+		return err
+	}
+	return ll.VerifySignature(key)
+}
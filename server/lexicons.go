@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/lexicon"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+var lexiconLogger = slog.With("component", "lexicon")
+
+// the lexicons in lexicons/, loaded at startup. nil means nothing is validated
+var lexicons *lexiconCatalog
+
+// biggest procedure input we'll read to validate
+const lexiconMaxInputBytes = 1 << 20 // 1 MiB
+
+// how many things failed validation since startup, by what was being validated
+var lexiconFailures struct {
+	params, input, output, record atomic.Int64
+}
+
+// lexiconCatalog is the lexicons plus what's needed to check requests against them.
+// lexicon.ValidateRecord only validates records, so every query/procedure body with a
+// schema also gets a made up "<nsid>#input" or "<nsid>#output" record def to validate with
+type lexiconCatalog struct {
+	lexicon.BaseCatalog
+	bodies    map[string]lexicon.Schema
+	endpoints map[string]lexiconEndpoint
+}
+
+type lexiconEndpoint struct {
+	// GET for queries, POST for procedures
+	method string
+	params lexicon.SchemaParams
+	// JSON bodies with a schema, otherwise not checked
+	input  bool
+	output bool
+}
+
+// loadLexicons reads every lexicon file under dir
+func loadLexicons(dir string) (*lexiconCatalog, error) {
+	c := &lexiconCatalog{
+		BaseCatalog: lexicon.NewBaseCatalog(),
+		bodies:      map[string]lexicon.Schema{},
+		endpoints:   map[string]lexiconEndpoint{},
+	}
+
+	ids := []string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var sf lexicon.SchemaFile
+		if err := json.Unmarshal(b, &sf); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if err := c.AddSchemaFile(sf); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		ids = append(ids, sf.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no lexicons in %s", dir)
+	}
+
+	for _, id := range ids {
+		s, err := c.BaseCatalog.Resolve(id)
+		if err != nil {
+			// a file without a main def, e.g. dev.skywell.defs
+			continue
+		}
+
+		var e lexiconEndpoint
+		var input, output *lexicon.SchemaBody
+		switch def := s.Def.(type) {
+		case lexicon.SchemaQuery:
+			e = lexiconEndpoint{method: http.MethodGet, params: def.Parameters}
+			output = def.Output
+		case lexicon.SchemaProcedure:
+			e = lexiconEndpoint{method: http.MethodPost, params: def.Parameters}
+			input, output = def.Input, def.Output
+		default:
+			continue
+		}
+
+		if e.input, err = c.addBody(id, "input", input); err != nil {
+			return nil, err
+		}
+		if e.output, err = c.addBody(id, "output", output); err != nil {
+			return nil, err
+		}
+		c.endpoints[id] = e
+	}
+
+	return c, nil
+}
+
+// addBody makes the "<nsid>#<name>" record def for a JSON body, if it has a schema we can check
+func (c *lexiconCatalog) addBody(nsid, name string, body *lexicon.SchemaBody) (bool, error) {
+	if body == nil || body.Encoding != "application/json" || body.Schema == nil {
+		return false, nil
+	}
+
+	var obj lexicon.SchemaObject
+	switch s := body.Schema.Inner.(type) {
+	case lexicon.SchemaObject:
+		obj = s
+	case lexicon.SchemaRef:
+		ref := s.Ref
+		if strings.HasPrefix(ref, "#") {
+			ref = nsid + ref
+		}
+		def, err := c.Resolve(ref)
+		if err != nil {
+			return false, fmt.Errorf("%s %s: %w", nsid, name, err)
+		}
+		var ok bool
+		if obj, ok = def.Def.(lexicon.SchemaObject); !ok {
+			return false, fmt.Errorf("%s %s: %s isn't an object", nsid, name, ref)
+		}
+	default:
+		// unions, nothing uses them
+		return false, nil
+	}
+
+	ref := nsid + "#" + name
+	c.bodies[ref] = lexicon.Schema{
+		ID:  ref,
+		Def: lexicon.SchemaRecord{Type: "record", Key: "any", Record: obj},
+	}
+	return true, nil
+}
+
+func (c *lexiconCatalog) Resolve(ref string) (*lexicon.Schema, error) {
+	if s, ok := c.bodies[ref]; ok {
+		return &s, nil
+	}
+	s, err := c.BaseCatalog.Resolve(ref)
+	if err != nil && !strings.HasPrefix(ref, "dev.skywell.") {
+		// lexicons we don't have a copy of (com.atproto.label.defs) are taken on trust
+		return &lexicon.Schema{ID: ref, Def: lexicon.SchemaUnknown{}}, nil
+	}
+	return s, err
+}
+
+// validate checks JSON data against the record def at ref
+func (c *lexiconCatalog) validate(b []byte, ref string) error {
+	rec, err := data.UnmarshalJSON(b)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.bodies[ref]; ok {
+		// bodies don't say what they are
+		rec["$type"] = ref
+	}
+	return lexicon.ValidateRecord(c, rec, ref, 0)
+}
+
+// validateRecord checks a record from the network against its lexicon, and counts it if it doesn't pass
+func validateRecord(b []byte, collection string) (failures int64, err error) {
+	if lexicons == nil {
+		return 0, nil
+	}
+	if err := lexicons.validate(b, collection); err != nil {
+		return lexiconFailures.record.Add(1), err
+	}
+	return 0, nil
+}
+
+// validateParams checks a query string against the endpoint's parameters
+func validateParams(params lexicon.SchemaParams, query map[string][]string) error {
+	for _, k := range params.Required {
+		if len(query[k]) == 0 {
+			return fmt.Errorf("missing required parameter %q", k)
+		}
+	}
+	for k, def := range params.Properties {
+		vals := query[k]
+		if len(vals) == 0 {
+			continue
+		}
+		if arr, ok := def.Inner.(lexicon.SchemaArray); ok {
+			if (arr.MinLength != nil && len(vals) < *arr.MinLength) || (arr.MaxLength != nil && len(vals) > *arr.MaxLength) {
+				return fmt.Errorf("invalid parameter %q: wrong number of values", k)
+			}
+			for _, v := range vals {
+				if err := validateParam(arr.Items.Inner, v); err != nil {
+					return fmt.Errorf("invalid parameter %q: %w", k, err)
+				}
+			}
+			continue
+		}
+		if len(vals) > 1 {
+			return fmt.Errorf("invalid parameter %q: expected a single value", k)
+		}
+		if err := validateParam(def.Inner, vals[0]); err != nil {
+			return fmt.Errorf("invalid parameter %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func validateParam(def any, v string) error {
+	switch s := def.(type) {
+	case lexicon.SchemaInteger:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("expected an integer")
+		}
+		return s.Validate(i)
+	case lexicon.SchemaBoolean:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("expected a boolean")
+		}
+		return s.Validate(b)
+	case lexicon.SchemaString:
+		return s.Validate(v, 0)
+	}
+	return nil
+}
+
+// middleware checks requests for our XRPC endpoints against their lexicons before they get to the handler.
+// with validateResponses, it checks what the handlers send back too, but only logs what's wrong
+func (c *lexiconCatalog) middleware(validateResponses bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nsid, ok := strings.CutPrefix(r.URL.Path, "/xrpc/")
+		e, known := c.endpoints[nsid]
+		if !ok || !known || r.Method != e.method {
+			// the handler sends back whatever error fits
+			next.ServeHTTP(w, r)
+			return
+		}
+		requestID := r.Context().Value(requestIDKey).(string)
+
+		if err := validateParams(e.params, r.URL.Query()); err != nil {
+			n := lexiconFailures.params.Add(1)
+			lexiconLogger.Info("Request params failed validation", "nsid", nsid, "failures", n, "request_id", requestID, "error", err)
+			xrpcserver.WriteError(w, 400, xrpcserver.InvalidRequest, err.Error())
+			return
+		}
+
+		if e.input {
+			b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, lexiconMaxInputBytes))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				xrpcserver.WriteError(w, 413, xrpcserver.InvalidRequest, "Request body too large")
+				return
+			} else if err != nil {
+				xrpcserver.WriteError(w, 400, xrpcserver.InvalidRequest, "Failed to read request body")
+				return
+			}
+			if err := c.validate(b, nsid+"#input"); err != nil {
+				n := lexiconFailures.input.Add(1)
+				lexiconLogger.Info("Request body failed validation", "nsid", nsid, "failures", n, "request_id", requestID, "error", err)
+				xrpcserver.WriteError(w, 400, xrpcserver.InvalidRequest, "Invalid request body: "+err.Error())
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(b))
+		}
+
+		if !e.output || !validateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(rec, r)
+		mt, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if rec.status == 200 && mt == "application/json" {
+			if err := c.validate(rec.body.Bytes(), nsid+"#output"); err != nil {
+				n := lexiconFailures.output.Add(1)
+				lexiconLogger.Error("Response failed validation", "nsid", nsid, "failures", n, "request_id", requestID, "error", err)
+			}
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// responseRecorder holds on to a response so it can be checked before it's sent
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLexiconMiddleware(t *testing.T) {
+	useTestLexicons(t)
+	reached := false
+	h := requestCorrelationMiddleware(lexicons.middleware(false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(200)
+	})))
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"limit in range", "GET", "/xrpc/dev.skywell.getActorFiles?actor=" + testDID + "&limit=1", "", 200},
+		{"limit at the max", "GET", "/xrpc/dev.skywell.getActorFiles?actor=" + testDID + "&limit=100", "", 200},
+		{"limit 0", "GET", "/xrpc/dev.skywell.getActorFiles?actor=" + testDID + "&limit=0", "", 400},
+		{"limit 101", "GET", "/xrpc/dev.skywell.getActorFiles?actor=" + testDID + "&limit=101", "", 400},
+		{"negative limit", "GET", "/xrpc/dev.skywell.getActorFiles?actor=" + testDID + "&limit=-5", "", 400},
+		{"limit isn't a number", "GET", "/xrpc/dev.skywell.getActorFiles?actor=" + testDID + "&limit=lots", "", 400},
+		{"limit twice", "GET", "/xrpc/dev.skywell.getActorFiles?actor=" + testDID + "&limit=1&limit=2", "", 400},
+		{"missing required param", "GET", "/xrpc/dev.skywell.getActorFiles?limit=10", "", 400},
+		// searchFiles leaves these to the middleware
+		{"q at the max", "GET", "/xrpc/dev.skywell.searchFiles?q=" + strings.Repeat("a", 256), "", 200},
+		{"q too long", "GET", "/xrpc/dev.skywell.searchFiles?q=" + strings.Repeat("a", 257), "", 400},
+		{"empty q", "GET", "/xrpc/dev.skywell.searchFiles?q=", "", 400},
+		{"mimeType too long", "GET", "/xrpc/dev.skywell.searchFiles?q=a&mimeType=" + strings.Repeat("a", 129), "", 400},
+		{"search limit 101", "GET", "/xrpc/dev.skywell.searchFiles?q=a&limit=101", "", 400},
+		{"valid body", "POST", "/xrpc/dev.skywell.createReport", `{"subject":"abc123","reasonType":"spam","reason":"` + strings.Repeat("👍🏽", 2000) + `"}`, 200},
+		{"body missing a required field", "POST", "/xrpc/dev.skywell.createReport", `{"subject":"abc123"}`, 400},
+		{"body field too long", "POST", "/xrpc/dev.skywell.createReport", `{"subject":"abc123","reasonType":"spam","reason":"` + strings.Repeat("a", 2001) + `"}`, 400},
+		{"body isn't JSON", "POST", "/xrpc/dev.skywell.createReport", `subject=abc123`, 400},
+		// left to the handler
+		{"unknown endpoint", "GET", "/xrpc/dev.skywell.notAThing?limit=0", "", 200},
+		{"wrong method", "POST", "/xrpc/dev.skywell.getActorFiles?limit=0", "", 200},
+		{"not xrpc", "GET", "/blob/abc?limit=0", "", 200},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reached = false
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.body != "" {
+				r.Header.Set("Content-Type", "application/json")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Fatalf("got %d, want %d: %s", w.Code, tc.want, w.Body.String())
+			}
+			if reached != (tc.want == 200) {
+				t.Errorf("handler reached: %v", reached)
+			}
+			if tc.want == 400 {
+				xerr := struct{ Error string }{}
+				json.Unmarshal(w.Body.Bytes(), &xerr)
+				if xerr.Error != "InvalidRequest" {
+					t.Errorf("error is %q, want InvalidRequest", xerr.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestLexiconMiddlewareResponses(t *testing.T) {
+	useTestLexicons(t)
+	output := ""
+	h := requestCorrelationMiddleware(lexicons.middleware(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(output))
+	})))
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/xrpc/dev.skywell.getActorFiles?"+url.Values{"actor": {testDID}}.Encode(), nil))
+		return w
+	}
+
+	before := lexiconFailures.output.Load()
+	output = `{"files":[],"actor":{"did":"` + testDID + `","handle":"test.invalid"}}`
+	if w := get(); w.Code != 200 || w.Body.String() != output {
+		t.Errorf("valid response came back as %d %q", w.Code, w.Body.String())
+	}
+	if n := lexiconFailures.output.Load() - before; n != 0 {
+		t.Errorf("valid response counted as %d failures", n)
+	}
+
+	// a bad response is only counted, it still goes out
+	output = `{"files":[]}`
+	if w := get(); w.Code != 200 || w.Body.String() != output {
+		t.Errorf("invalid response came back as %d %q", w.Code, w.Body.String())
+	}
+	if n := lexiconFailures.output.Load() - before; n != 1 {
+		t.Errorf("invalid response counted as %d failures, want 1", n)
+	}
+}
+
+func TestValidateRecord(t *testing.T) {
+	useTestLexicons(t)
+	record := func(fields map[string]any) []byte {
+		rec := map[string]any{}
+		json.Unmarshal(testFileRecord("file"), &rec)
+		for k, v := range fields {
+			if v == nil {
+				delete(rec, k)
+			} else {
+				rec[k] = v
+			}
+		}
+		b, _ := json.Marshal(rec)
+		return b
+	}
+
+	for _, tc := range []struct {
+		name   string
+		fields map[string]any
+		valid  bool
+	}{
+		{"valid", nil, true},
+		{"80 grapheme name", map[string]any{"name": strings.Repeat("a", 80)}, true},
+		// graphemes, not bytes or code points
+		{"80 grapheme name of emoji", map[string]any{"name": strings.Repeat("👍🏽", 80)}, true},
+		{"81 grapheme name", map[string]any{"name": strings.Repeat("a", 81)}, false},
+		{"81 grapheme name of emoji", map[string]any{"name": strings.Repeat("👍🏽", 81)}, false},
+		{"empty name", map[string]any{"name": ""}, false},
+		{"no name", map[string]any{"name": nil}, false},
+		{"500 grapheme description", map[string]any{"description": strings.Repeat("é", 500)}, true},
+		{"501 grapheme description", map[string]any{"description": strings.Repeat("a", 501)}, false},
+		{"501 grapheme description of emoji", map[string]any{"description": strings.Repeat("👍🏽", 501)}, false},
+		{"no blob", map[string]any{"blobRef": nil}, false},
+		{"bad createdAt", map[string]any{"createdAt": "yesterday"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := lexiconFailures.record.Load()
+			n, err := validateRecord(record(tc.fields), "dev.skywell.file")
+			if tc.valid && err != nil {
+				t.Errorf("valid record failed: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("invalid record passed")
+			}
+			counted := lexiconFailures.record.Load() - before
+			if want := map[bool]int64{true: 0, false: 1}[tc.valid]; counted != want {
+				t.Errorf("counted %d failures, want %d", counted, want)
+			}
+			if !tc.valid && n != lexiconFailures.record.Load() {
+				t.Errorf("returned count %d, running count is %d", n, lexiconFailures.record.Load())
+			}
+		})
+	}
+}
+
+func TestIngestInvalidRecord(t *testing.T) {
+	db, _ := newTestDB(t)
+	useTestLexicons(t)
+	createTestUser(t, db, testDID)
+
+	long, _ := json.Marshal(map[string]any{
+		"$type":     "dev.skywell.file",
+		"name":      strings.Repeat("a", 81),
+		"createdAt": "2026-01-01T00:00:00Z",
+		"blobRef":   json.RawMessage(`{"$type":"blob","ref":{"$link":"bafkreic6gi22qndoljcyl6gfqvrpkbjlr7rguo5relq6s3dwpbewjx6eme"},"mimeType":"text/plain","size":6}`),
+	})
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa000", long); err == nil {
+		t.Error("indexing a record with an 81 grapheme name succeeded")
+	}
+	var n int64
+	db.Model(&File{}).Count(&n)
+	if n != 0 {
+		t.Errorf("%d files indexed, want none", n)
+	}
+	db.Model(&IngestError{}).Count(&n)
+	if n != 1 {
+		t.Errorf("%d ingest errors, want 1", n)
+	}
+}
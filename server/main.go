@@ -4,13 +4,14 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -23,14 +24,13 @@ import (
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/xrpc"
-	"github.com/gigatar/ratelimiter"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/ipfs/go-cid"
 	"github.com/saturn-vi/skywell/api/skywell"
+
+	"saturnvi/skywell/internal/xrpcserver"
 )
 
-const PORT string = ":4999"
-const SkywellDid syntax.DID = "did:plc:tsaj4ffwyj5z6rjqaxmg5cp4"
-const UserAgent string = "Skywell AppView v0.1.12"
 const requestIDKey string = "requestID"
 
 var cacheDir = identity.NewCacheDirectory(identity.DefaultDirectory(), 0, 0, 0, 0)
@@ -40,6 +40,8 @@ var (
 	dbLogger        = slog.With("component", "database")
 	jetstreamLogger = slog.With("component", "jetstream")
 	authLogger      = slog.With("component", "auth")
+	backfillLogger  = slog.With("component", "backfill")
+	firehoseLogger  = slog.With("component", "firehose")
 )
 
 func main() {
@@ -47,35 +49,133 @@ func main() {
 	defer stop()
 
 	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	fs := flag.NewFlagSet("skywell", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to config file (default $SKYWELL_CONFIG, then "+defaultConfigPath+" if it exists)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: skywell [-config path] [backfill|migrate|config|label] ...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if fs.NArg() > 0 {
+		args := fs.Args()[1:]
+		switch fs.Arg(0) {
+		case "backfill":
+			if err := cfg.validate(); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+				os.Exit(1)
+			}
+			if lexicons, err = loadLexicons(cfg.Lexicons.Dir); err != nil {
+				lexiconLogger.Error("Failed to load lexicons", "dir", cfg.Lexicons.Dir, "error", err)
+				os.Exit(1)
+			}
+			if err := runBackfill(args, cfg, ctx); err != nil {
+				backfillLogger.Error("Backfill failed", "error", err)
+				os.Exit(1)
+			}
+		case "migrate":
+			if err := cfg.validate(); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+				os.Exit(1)
+			}
+			if err := runMigrate(args, cfg); err != nil {
+				dbLogger.Error("Migration failed", "error", err)
+				os.Exit(1)
+			}
+		case "label":
+			if err := cfg.validate(); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+				os.Exit(1)
+			}
+			if err := runLabel(args, cfg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		case "config":
+			if err := runConfig(args, cfg); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+				os.Exit(1)
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", fs.Arg(0))
+			os.Exit(2)
+		}
+		return
+	}
+
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	httpLogger.Info("Loading lexicons...")
+	lexicons, err = loadLexicons(cfg.Lexicons.Dir)
+	if err != nil {
+		lexiconLogger.Error("Failed to load lexicons", "dir", cfg.Lexicons.Dir, "error", err)
+		os.Exit(1)
+	}
+
 	httpLogger.Info("Initializing database...")
-	db, client, err := initializeDB()
+	db, client, err := initializeDB(cfg)
 
 	if err != nil {
 		dbLogger.Error("Failed to initialize database", "error", err)
 		panic("Failed to initialize database: " + err.Error())
 	}
 
+	if cfg.BlobCache.Dir != "" {
+		httpLogger.Info("Initializing blob cache...")
+		blobCache, err = openBlobCache(cfg.BlobCache.Dir, cfg.BlobCache.MaxBytes)
+		if err != nil {
+			// downloads still work without it, just slower
+			blobCacheLogger.Error("Failed to open blob cache, continuing without it", "dir", cfg.BlobCache.Dir, "error", err)
+		}
+	}
+
 	httpLogger.Info("Initializing HTTP server...")
-	initializeHandleFuncs(db, client, ctx)
+	initializeHandleFuncs(db, client, cfg, ctx)
 
 	httpLogger.Info("Initializing rate limiter...")
-	limiter := ratelimiter.New(&ratelimiter.Config{
-		RequestsPerSecond: 10,
-		Burst:             30,
-		CleanupInterval:   2 * time.Minute,
-		MaxIdleTime:       5 * time.Minute,
-	})
+	limiter, err := newRateLimiter(cfg, ctx)
+	if err != nil {
+		rateLimitLogger.Error("Failed to set up rate limiter", "error", err)
+		os.Exit(1)
+	}
 
-	handler := requestCorrelationMiddleware(limiter.Middleware(corsMiddleware(http.DefaultServeMux)))
-	server := &http.Server{Addr: PORT, Handler: handler}
+	handler := requestCorrelationMiddleware(corsMiddleware(limiter.middleware(lexicons.middleware(cfg.Lexicons.ValidateResponses, http.DefaultServeMux))))
+	server := &http.Server{Addr: cfg.Port, Handler: handler}
 
-	jetstreamLogger.Info("Reading from Jetstream...")
-	go read(db, client, ctx)
+	if cfg.Verify.Enabled {
+		go runVerifier(db, cfg, ctx)
+	}
+	if len(cfg.Scan.Scanners) > 0 {
+		scanners, err := newScanners(cfg)
+		if err != nil {
+			scanLogger.Error("Failed to set up scanners", "error", err)
+			os.Exit(1)
+		}
+		go runScanner(scanners, db, cfg, ctx)
+	}
+
+	subscribeLabelers(db, cfg, ctx)
+
+	ingestDone := make(chan struct{})
+	go func() {
+		ingest(db, client, cfg, ctx)
+		close(ingestDone)
+	}()
 
 	go func() {
-		httpLogger.Info("Server started!", "port", PORT)
+		httpLogger.Info("Server started!", "port", cfg.Port)
 		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			httpLogger.Error("Server error", "error", err, "port", PORT)
+			httpLogger.Error("Server error", "error", err, "port", cfg.Port)
 		}
 	}()
 
@@ -90,6 +190,9 @@ func main() {
 	} else {
 		httpLogger.Info("Server shutdown gracefully.")
 	}
+
+	// wait for the cursor to be saved
+	<-ingestDone
 }
 
 func generateRequestID() string {
@@ -112,41 +215,12 @@ func requestCorrelationMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func getRealIPAddress(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		if ips := strings.Split(xff, ","); len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
-	}
-
-	// X-Real-IP (nginx)
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return strings.TrimSpace(xri)
-	}
-
-	// CF-Connecting-IP (Cloudflare)
-	if cfip := r.Header.Get("CF-Connecting-IP"); cfip != "" {
-		return strings.TrimSpace(cfip)
-	}
-
-	// True-Client-IP (Akamai, Cloudflare)
-	if tcip := r.Header.Get("True-Client-IP"); tcip != "" {
-		return strings.TrimSpace(tcip)
-	}
-
-	if xcip := r.Header.Get("X-Client-IP"); xcip != "" {
-		return strings.TrimSpace(xcip)
-	}
-
-	return r.RemoteAddr
-}
-
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -157,245 +231,195 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func initializeHandleFuncs(db *gorm.DB, client *xrpc.Client, ctx context.Context) {
-	// returns ProfileView
-	http.HandleFunc("/xrpc/dev.skywell.getActorProfile", func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Context().Value(requestIDKey).(string)
-		logger := httpLogger.With("request_id", requestID)
-
-		logger.Debug("Received request", "endpoint", "/xrpc/dev.skywell.getActorProfile", "remote_addr", getRealIPAddress(r))
-		actor := r.URL.Query().Get("actor")
-		if actor == "" {
-			logger.Warn("Missing required parameter", "endpoint", "/xrpc/dev.skywell.getActorProfile", "parameter", "actor")
-			http.Error(w, "Required parameter 'actor' missing", 400)
-			return
-		}
-		did, err := syntax.ParseDID(actor)
-		if err != nil {
-			logger.Error("Failed to parse DID", "actor", actor, "error", err, "endpoint", "/xrpc/dev.skywell.getActorProfile")
-			http.Error(w, "Invalid 'actor' parameter", 400)
-			return
-		}
-		view, stat, err := generateProfileView(did, db, ctx)
-		if err != nil {
-			logger.Error("Failed to generate profile view", "did", did.String(), "http_status", stat, "error", err)
-			http.Error(w, "Internal Server Error (profile view generation)", stat)
-			return
-		}
-		b, err := json.Marshal(view)
-		if err != nil {
-			logger.Error("Failed to marshal profile", "did", did.String(), "error", err)
-			http.Error(w, "Internal Server Error (marshaling content)", 500)
-			return
-		}
-		logger.Debug("Returning profile response", "actor", actor, "did", did.String(), "response_size", len(b))
-		w.Header().Set("Content-Type", "application/json")
-		_, err = fmt.Fprintf(w, "%s", b)
+func initializeHandleFuncs(db *gorm.DB, client *xrpc.Client, cfg *Config, ctx context.Context) {
+	initializeDIDWeb(cfg)
+	initializeBlobRoutes(db, cfg, ctx)
+
+	s := newXRPCServer(cfg, ctx)
+	initializeLabeler(s, db, cfg, ctx)
+	initializeAdminRoutes(s, db, client, cfg, ctx)
+	initializeReportRoutes(s, db, cfg, ctx)
+	initializeCollectionRoutes(s, db, cfg, ctx)
+
+	type actorParams struct {
+		Actor string `query:"actor,required"`
+	}
+
+	xrpcserver.Query(s, "dev.skywell.getActorProfile", xrpcserver.Opts{}, func(req *xrpcserver.Request, p actorParams) (*skywell.Defs_ProfileView, int, error) {
+		did, stat, err := resolveActor(p.Actor, ctx)
 		if err != nil {
-			logger.Error("Failed to write response", "did", did.String(), "error", err)
-			http.Error(w, "Internal Server Error", 500)
-			return
+			return nil, stat, fmt.Errorf("failed to resolve 'actor' parameter: %w", err)
 		}
+		return generateProfileView(did, "", db, cfg, ctx)
 	})
 
-	// returns GetFileFromSlug_Output
-	http.HandleFunc("/xrpc/dev.skywell.getFileFromSlug", func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Context().Value(requestIDKey).(string)
-		logger := httpLogger.With("request_id", requestID)
-
-		// based on slug, get:
-		// URI, CID, and DID
-		logger.Debug("Received request", "endpoint", "/xrpc/dev.skywell.getFileFromSlug", "remote_addr", getRealIPAddress(r))
-		slug := r.URL.Query().Get("slug")
-		if slug == "" {
-			logger.Warn("Missing required parameter", "endpoint", "/xrpc/dev.skywell.getFileFromSlug", "parameter", "slug")
-			http.Error(w, "Required parameter 'slug' missing", 400)
-			return
-		}
-		fk := FileKey{}
-		if err := db.Where("key = ?", slug).First(&fk).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				logger.Debug("File key not found", "slug", slug)
-				http.Error(w, "No matching slug found", 404)
-				return
-			}
-			logger.Error("Failed to find file key", "slug", slug, "error", err)
-			http.Error(w, "Internal Server Error (file key lookup)", 500)
-			return
-		}
-		fi := File{}
-		if err := db.Where("id = ?", fk.File).First(&fi).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				logger.Debug("File not found", "file_id", fk.File, "slug", slug)
-				http.Error(w, "No matching file found", 404)
-				return
-			}
-			logger.Error("Failed to find file", "file_id", fk.File, "slug", slug, "error", err)
-			http.Error(w, "Internal Server Error (file lookup)", 500)
-			return
-		}
-		u := User{}
-		if err := db.Where("id = ?", fi.UserID).First(&u).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				logger.Debug("User not found", "user_id", fi.UserID, "file_id", fi.ID, "slug", slug)
-				http.Error(w, "No matching user found", 404)
-				return
-			}
-			logger.Error("Failed to find user", "user_id", fi.UserID, "file_id", fi.ID, "slug", slug, "error", err)
-			http.Error(w, "Internal Server Error (user lookup)", 500)
-			return
-		}
+	type getFileFromSlugParams struct {
+		Slug string `query:"slug,required"`
+	}
 
-		profile, stat, err := generateProfileView(u.DID, db, ctx)
+	xrpcserver.Query(s, "dev.skywell.getFileFromSlug", xrpcserver.Opts{}, func(req *xrpcserver.Request, p getFileFromSlugParams) (*skywell.GetFileFromSlug_Output, int, error) {
+		fi, u, stat, err := fileBySlug(p.Slug, db, cfg)
+		if stat == 404 {
+			return nil, 404, xrpcserver.Errorf("SlugNotFound", "no matching file found")
+		} else if err != nil {
+			return nil, stat, fmt.Errorf("failed to find file: %w", err)
+		}
+		profile, stat, err := generateProfileView(u.DID, "", db, cfg, ctx)
 		if err != nil {
-			logger.Error("Failed to generate profile view", "did", u.DID.String(), "http_status", stat, "slug", slug, "error", err)
-			http.Error(w, "Internal Server Error (profile view generation)", stat)
-			return
+			return nil, stat, fmt.Errorf("failed to generate profile view: %w", err)
 		}
-
-		fileView, stat, err := generateFileView(fi.ID, db)
+		fileView, stat, err := generateFileView(fi.ID, db, cfg)
 		if err != nil {
-			logger.Error("Failed to generate file view", "file_id", fi.ID, "http_status", stat, "slug", slug, "error", err)
-			http.Error(w, "Internal Server Error (file view generation)", stat)
-			return
+			return nil, stat, fmt.Errorf("failed to generate file view: %w", err)
 		}
-
-		o := skywell.GetFileFromSlug_Output{
+		return &skywell.GetFileFromSlug_Output{
 			Cid:   fi.Cid.String(),
 			Uri:   fi.Uri.String(),
 			File:  fileView,
 			Actor: profile,
-		}
-
-		b, err := json.Marshal(o)
-		if err != nil {
-			logger.Error("Failed to marshal file response", "slug", slug, "file_id", fi.ID, "error", err)
-			http.Error(w, "Internal Server Error (marshaling content)", 500)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		logger.Debug("Returning file response", "slug", slug, "file_id", fi.ID, "response_size", len(b))
-		_, err = fmt.Fprintf(w, "%s", b)
-		if err != nil {
-			logger.Error("Failed to write response", "slug", slug, "error", err)
-			http.Error(w, "Internal Server Error", 500)
-			return
-		}
+		}, 200, nil
 	})
 
-	// returns GetActorFiles_Output
-	http.HandleFunc("/xrpc/dev.skywell.getActorFiles", func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Context().Value(requestIDKey).(string)
-		logger := httpLogger.With("request_id", requestID)
+	type getActorFilesParams struct {
+		Actor  string `query:"actor,required"`
+		Limit  int    `query:"limit"`
+		Cursor string `query:"cursor"`
+	}
 
-		logger.Debug("Received request", "endpoint", "/xrpc/dev.skywell.getActorFiles", "remote_addr", getRealIPAddress(r))
-		did, err := verifyJWT(ctx, r)
+	// logged out callers and other accounts get the public listing, the owner gets everything
+	xrpcserver.Query(s, "dev.skywell.getActorFiles", xrpcserver.Opts{Auth: xrpcserver.AuthOptional}, func(req *xrpcserver.Request, p getActorFilesParams) (*skywell.GetActorFiles_Output, int, error) {
+		did, stat, err := resolveActor(p.Actor, ctx)
 		if err != nil {
-			logger.Error("Failed to verify JWT", "error", err, "remote_addr", getRealIPAddress(r))
-			http.Error(w, "Internal Server Error (JWT verification)", 500)
-			return
-		}
-		a := r.URL.Query().Get("actor")
-		if a == "" {
-			logger.Warn("Missing required parameter", "endpoint", "/xrpc/dev.skywell.getActorFiles", "parameter", "actor", "did", did.String())
-			http.Error(w, "Required parameter 'actor' missing", 400)
-			return
-		}
-		if did.String() != a {
-			logger.Warn("JWT issuer mismatch", "jwt_iss", did.String(), "actor_param", a)
-			http.Error(w, "JWT 'iss' does not match 'actor' parameter", 403)
-			return
+			return nil, stat, fmt.Errorf("failed to resolve 'actor' parameter: %w", err)
 		}
-		profile, stat, err := generateProfileView(did, db, ctx)
+		profile, stat, err := generateProfileView(did, req.Caller, db, cfg, ctx)
 		if err != nil {
-			logger.Error("Failed to generate profile view", "did", did.String(), "http_status", stat, "error", err)
-			http.Error(w, "Internal Server Error (profile view generation)", stat)
-			return
+			return nil, stat, err
 		}
-		var limit = 50 // default limit
-		if l := r.URL.Query().Get("limit"); l != "" {
-			limit, err = strconv.Atoi(l)
-			if err != nil {
-				logger.Error("Invalid limit parameter", "limit_param", l, "did", did.String(), "error", err)
-				http.Error(w, "Invalid 'limit' parameter", 400)
-				return
-			}
+		if p.Limit == 0 {
+			p.Limit = 50 // default limit
 		}
-		c, files, stat, err := generateFileList(r.URL.Query().Get("cursor"), limit, did, db)
+		c, files, stat, err := generateFileList(p.Cursor, p.Limit, did, req.Caller, db, cfg)
 		if err != nil {
-			logger.Error("Failed to generate file list", "did", did.String(), "limit", limit, "http_status", stat, "error", err)
-			http.Error(w, "Internal Server Error (file list generation)", stat)
-			return
+			return nil, stat, err
 		}
-		resp := skywell.GetActorFiles_Output{
+		return &skywell.GetActorFiles_Output{
 			Actor:  profile,
 			Cursor: &c,
 			Files:  *files,
-		}
+		}, 200, nil
+	})
 
-		b, err := json.Marshal(resp)
+	xrpcserver.Query(s, "dev.skywell.resolveActor", xrpcserver.Opts{}, func(req *xrpcserver.Request, p actorParams) (*skywell.ResolveActor_Output, int, error) {
+		atid, err := syntax.ParseAtIdentifier(p.Actor)
 		if err != nil {
-			logger.Error("Failed to marshal actor files response", "did", did.String(), "file_count", len(*files), "error", err)
-			http.Error(w, "Internal Server Error (marshaling content)", 500)
-			return
+			return nil, 400, fmt.Errorf("invalid 'actor' parameter")
 		}
-		logger.Debug("Returning actor files response", "did", did.String(), "file_count", len(*files), "response_size", len(b))
-		w.Header().Set("Content-Type", "application/json")
-		_, err = fmt.Fprintf(w, "%s", b)
+		id, stat, err := lookupActor(atid, ctx)
 		if err != nil {
-			logger.Error("Failed to write response", "error", err)
-			http.Error(w, "Internal Server Error", 500)
-			return
+			return nil, stat, fmt.Errorf("failed to resolve 'actor' parameter: %w", err)
 		}
+		return &skywell.ResolveActor_Output{
+			Did:    id.DID.String(),
+			Handle: id.Handle.String(),
+		}, 200, nil
 	})
 
-	type IapBody struct {
-		Actor string `json:"actor"`
+	type searchFilesParams struct {
+		Q        string `query:"q,required"`
+		Actor    string `query:"actor"`
+		MimeType string `query:"mimeType"`
+		Limit    int    `query:"limit"`
+		Cursor   string `query:"cursor"`
 	}
 
-	// returns nothing
-	http.HandleFunc("/xrpc/dev.skywell.indexActorProfile", func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Context().Value(requestIDKey).(string)
-		logger := httpLogger.With("request_id", requestID)
+	xrpcserver.Query(s, "dev.skywell.searchFiles", xrpcserver.Opts{}, func(req *xrpcserver.Request, p searchFilesParams) (*skywell.SearchFiles_Output, int, error) {
+		// the lexicon middleware has already checked the lengths and the limit,
+		// but it can't tell that q is only whitespace
+		q := strings.TrimSpace(p.Q)
+		if q == "" {
+			return nil, 400, fmt.Errorf("parameter 'q' is blank")
+		}
+		var did syntax.DID
+		if p.Actor != "" {
+			var stat int
+			var err error
+			did, stat, err = resolveActor(p.Actor, ctx)
+			if err != nil {
+				return nil, stat, fmt.Errorf("failed to resolve 'actor' parameter: %w", err)
+			}
+		}
+		if p.Limit == 0 {
+			p.Limit = 25 // default limit
+		}
 
-		logger.Debug("Received request", "endpoint", "/xrpc/dev.skywell.indexActorProfile", "remote_addr", getRealIPAddress(r))
-		decoder := json.NewDecoder(r.Body)
-		var body IapBody
-		err := decoder.Decode(&body)
+		c, files, stat, err := searchFiles(q, did, p.MimeType, p.Limit, p.Cursor, db, cfg)
 		if err != nil {
-			logger.Error("Failed to decode request body", "error", err, "endpoint", "/xrpc/dev.skywell.indexActorProfile")
-			http.Error(w, "Invalid request body", 400)
-			return
+			return nil, stat, err
 		}
-		if body.Actor == "" {
-			logger.Warn("Missing required parameter", "endpoint", "/xrpc/dev.skywell.indexActorProfile", "parameter", "actor")
-			http.Error(w, "Required parameter 'actor' missing", 400)
-			return
+		resp := &skywell.SearchFiles_Output{
+			Files: files,
 		}
-		atid, err := syntax.ParseAtIdentifier(body.Actor)
-		if err != nil {
-			logger.Error("Failed to parse AtIdentifier", "actor", body.Actor, "error", err, "endpoint", "/xrpc/dev.skywell.indexActorProfile")
-			http.Error(w, "Invalid 'actor' parameter", 400)
-			return
+		if c != "" {
+			resp.Cursor = &c
 		}
-		did, err := atid.AsDID()
-		if err != nil {
-			logger.Error("Failed to convert AtIdentifier to DID", "atid", atid.String(), "error", err, "endpoint", "/xrpc/dev.skywell.indexActorProfile")
-			http.Error(w, "Invalid 'actor' parameter", 400)
-			return
+		return resp, 200, nil
+	})
+
+	xrpcserver.Procedure(s, "dev.skywell.indexActorProfile", xrpcserver.Opts{}, func(req *xrpcserver.Request, in skywell.IndexActorProfile_Input) (*xrpcserver.Empty, int, error) {
+		if in.Actor == "" {
+			return nil, 400, fmt.Errorf("required parameter 'actor' missing")
 		}
-		err = updateUserProfile(did, true, db, client, ctx)
+		did, stat, err := resolveActor(in.Actor, ctx)
 		if err != nil {
-			logger.Error("Failed to update user profile", "did", did.String(), "error", err, "endpoint", "/xrpc/dev.skywell.indexActorProfile")
-			http.Error(w, "Internal Server Error (profile update)", 500)
-			return
+			return nil, stat, fmt.Errorf("failed to resolve 'actor' parameter: %w", err)
+		}
+		if err := updateUserProfile(did, true, db, client, ctx); err != nil {
+			return nil, 500, fmt.Errorf("failed to update user profile: %w", err)
+		}
+		req.Logger.Debug("Profile indexed successfully", "did", did.String())
+		return &xrpcserver.Empty{}, 200, nil
+	})
+
+	xrpcserver.Query(s, "dev.skywell.describeServer", xrpcserver.Opts{}, func(req *xrpcserver.Request, p xrpcserver.Empty) (*skywell.DescribeServer_Output, int, error) {
+		out := &skywell.DescribeServer_Output{Did: cfg.ServiceDID, Methods: []*skywell.DescribeServer_Method{}}
+		if cfg.DIDWeb.Hostname != "" {
+			out.Did = cfg.didWeb()
+		}
+		for _, m := range s.Methods() {
+			out.Methods = append(out.Methods, &skywell.DescribeServer_Method{Nsid: m.NSID, Type: string(m.Type), Auth: string(m.Auth)})
 		}
-		logger.Debug("Profile indexed successfully", "did", did.String(), "endpoint", "/xrpc/dev.skywell.indexActorProfile")
-		w.WriteHeader(http.StatusOK)
+		return out, 200, nil
 	})
+
+	http.Handle("/xrpc/", s)
 }
 
-func verifyJWT(ctx context.Context, r *http.Request) (did syntax.DID, err error) {
+// newXRPCServer is the server every /xrpc/ method is registered on
+func newXRPCServer(cfg *Config, ctx context.Context) *xrpcserver.Server {
+	s := xrpcserver.New(httpLogger)
+	s.LogAttrs = requestLogAttrs
+	s.RemoteAddr = remoteAddr
+	s.Authenticate = func(r *http.Request) (syntax.DID, error) {
+		return verifyJWT(cfg.serviceAudiences(), ctx, r)
+	}
+	s.IsAdmin = func(did syntax.DID) bool {
+		return slices.Contains(cfg.Admin.DIDs, did.String())
+	}
+	return s
+}
+
+func requestLogAttrs(r *http.Request) []any {
+	return []any{"request_id", r.Context().Value(requestIDKey)}
+}
+
+// verifyJWT checks the service auth token in r, which can be addressed to any of audiences
+func verifyJWT(audiences []string, ctx context.Context, r *http.Request) (did syntax.DID, err error) {
+	// the rate limiter already checked it, against the same audiences
+	if did, ok := authedDID(r); ok {
+		return did, nil
+	}
+
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return "", fmt.Errorf("authorization header missing")
@@ -409,23 +433,33 @@ func verifyJWT(ctx context.Context, r *http.Request) (did syntax.DID, err error)
 
 	authLogger.Debug("Processing JWT token", "token", tokStr, "token_length", len(tokStr))
 
-	validator := &auth.ServiceAuthValidator{
-		Audience:        SkywellDid.String(),
-		Dir:             &cacheDir,
-		TimestampLeeway: 10 * time.Second,
-	}
+	// the validator only takes one audience, so try them in turn.
+	// anything other than a wrong audience means the token is bad no matter who it's for
+	for _, audience := range audiences {
+		validator := &auth.ServiceAuthValidator{
+			Audience:        audience,
+			Dir:             &cacheDir,
+			TimestampLeeway: 10 * time.Second,
+		}
 
-	issuerDID, err := validator.Validate(ctx, tokStr, nil)
-	if err != nil {
-		authLogger.Error("JWT validation failed", "error", err)
-		return "", fmt.Errorf("JWT validation failed: %w", err)
+		issuerDID, err := validator.Validate(ctx, tokStr, nil)
+		if errors.Is(err, jwt.ErrTokenInvalidAudience) {
+			continue
+		}
+		if err != nil {
+			authLogger.Error("JWT validation failed", "error", err)
+			return "", fmt.Errorf("JWT validation failed: %w", err)
+		}
+
+		authLogger.Debug("JWT validated successfully", "issuer", issuerDID, "audience", audience)
+		return issuerDID, nil
 	}
 
-	authLogger.Debug("JWT validated successfully", "issuer", issuerDID, "audience", SkywellDid)
-	return issuerDID, nil
+	authLogger.Error("JWT validation failed", "error", jwt.ErrTokenInvalidAudience, "audiences", audiences)
+	return "", fmt.Errorf("JWT validation failed: %w", jwt.ErrTokenInvalidAudience)
 }
 
-func generateFileView(fileID uint, db *gorm.DB) (fileView *skywell.Defs_FileView, httpResponse int, err error) {
+func generateFileView(fileID uint, db *gorm.DB, cfg *Config) (fileView *skywell.Defs_FileView, httpResponse int, err error) {
 	file := File{}
 	result := db.First(&file, "id = ?", fileID)
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
@@ -434,41 +468,86 @@ func generateFileView(fileID uint, db *gorm.DB) (fileView *skywell.Defs_FileView
 		return nil, 500, fmt.Errorf("failed to find file: %w", result.Error)
 	}
 
-	c, err := cid.Decode(file.BlobRef.String())
+	fileView, err = fileToView(file, "", cfg)
 	if err != nil {
-		return nil, 500, fmt.Errorf("failed to decode blob CID: %w", err)
+		return nil, 500, err
+	}
+	if err := labelFileViews([]*skywell.Defs_FileView{fileView}, db, cfg); err != nil {
+		return nil, 500, err
+	}
+	if err := chunkFileViews([]*skywell.Defs_FileView{fileView}, db); err != nil {
+		return nil, 500, err
 	}
+	return fileView, 200, nil
+}
 
-	fileView = &skywell.Defs_FileView{
-		Uri: file.Uri.String(),
-		Cid: file.Cid.String(),
+// fileToView is the one place a File turns into a fileView
+func fileToView(f File, slug string, cfg *Config) (*skywell.Defs_FileView, error) {
+	c, err := cid.Decode(f.BlobRef.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode blob CID: %w", err)
+	}
+	fv := &skywell.Defs_FileView{
+		Uri: f.Uri.String(),
+		Cid: f.Cid.String(),
 		Blob: &util.LexBlob{
 			Ref:      util.LexLink(c),
-			MimeType: file.MimeType,
-			Size:     file.Size,
+			MimeType: f.MimeType,
+			Size:     f.Size,
 		},
-		CreatedAt:   file.CreatedAt.String(),
-		Name:        file.Name,
-		Description: &file.Description,
+		CreatedAt:   f.CreatedAt.String(),
+		Name:        f.Name,
+		Slug:        slug,
+		Description: &f.Description,
 	}
-
-	return fileView, 200, nil
+	// every file starts out pending, which only means something if there's a verifier or scanner to get to it
+	if cfg.Verify.Enabled {
+		fv.Verification = &f.Verification
+		if f.DetectedMimeType != "" {
+			fv.DetectedMimeType = &f.DetectedMimeType
+		}
+	}
+	// flagged files stay hidden after scanning's turned off, so that's still worth saying
+	if len(cfg.Scan.Scanners) > 0 || f.ScanStatus == scanFlagged {
+		fv.ScanStatus = &f.ScanStatus
+	}
+	if f.ScanStatus == scanFlagged {
+		fv.ScanResult = &f.ScanResult
+	}
+	if f.Hash != "" {
+		// the chunks themselves come from chunkFileViews
+		fv.Hash = &f.Hash
+	}
+	return fv, nil
 }
 
-func generateProfileView(did syntax.DID, db *gorm.DB, ctx context.Context) (profileView *skywell.Defs_ProfileView, httpResponse int, err error) {
-	id, err := cacheDir.Lookup(ctx, did.AtIdentifier())
+// generateProfileView builds did's profile as seen by viewer ("" for logged out)
+func generateProfileView(did syntax.DID, viewer syntax.DID, db *gorm.DB, cfg *Config, ctx context.Context) (profileView *skywell.Defs_ProfileView, httpResponse int, err error) {
+	atid := did.AtIdentifier()
+	id, stat, err := lookupActor(&atid, ctx)
 	if err != nil {
 		slog.Error("Failed to lookup DID in cache", "did", did.String(), "error", err)
-		return nil, 500, fmt.Errorf("failed to lookup DID in cache: %w", err)
+		return nil, stat, err
 	}
 	user := User{}
 	result := db.First(&user, "did = ?", id.DID.String())
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return nil, 404, fmt.Errorf("actor not found")
+		return nil, 404, xrpcserver.Errorf("ActorNotFound", "actor not found")
 	} else if result.Error != nil {
 		return nil, 500, fmt.Errorf("failed to find actor: %w", result.Error)
 	}
-	afc, err := getActorFileCount(id.DID, db)
+	if user.Status != "" && viewer != did {
+		return nil, 404, xrpcserver.Errorf("ActorNotFound", "actor's account is %s", user.Status)
+	}
+	if user.TakenDown {
+		return nil, 404, xrpcserver.Errorf("ActorNotFound", "actor was taken down by an admin")
+	}
+	if hidden, err := accountHidden(did, db, cfg); err != nil {
+		return nil, 500, err
+	} else if hidden && viewer != did {
+		return nil, 404, xrpcserver.Errorf("ActorNotFound", "actor is hidden by a label")
+	}
+	afc, err := getActorFileCount(id.DID, viewer == did, db, cfg)
 	if err != nil {
 		return nil, 500, fmt.Errorf("failed to get actor file count: %w", err)
 	}
@@ -479,29 +558,44 @@ func generateProfileView(did syntax.DID, db *gorm.DB, ctx context.Context) (prof
 		FileCount:   &afc,
 		Handle:      id.Handle.String(),
 	}
+	if err := labelProfileView(profileView, db, cfg); err != nil {
+		return nil, 500, err
+	}
 
 	return profileView, 200, nil
 }
 
-// cursor probably just a datetime
-func generateFileList(c string, limit int, a syntax.DID, db *gorm.DB) (cursor string, fileviews *[]*skywell.Defs_FileView, httpResponse int, err error) {
+// generateFileList lists a's files as seen by viewer ("" for logged out).
+// a's own listing includes everything, even while their account isn't active
+func generateFileList(c string, limit int, a syntax.DID, viewer syntax.DID, db *gorm.DB, cfg *Config) (cursor string, fileviews *[]*skywell.Defs_FileView, httpResponse int, err error) {
 	user := User{}
 	result := db.First(&user, "did = ?", a.String())
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return "", nil, 404, fmt.Errorf("actor not found")
+		return "", nil, 404, xrpcserver.Errorf("ActorNotFound", "actor not found")
 	} else if result.Error != nil {
 		return "", nil, 500, fmt.Errorf("failed to find actor: %w", result.Error)
 	}
+	if user.Status != "" && viewer != a {
+		return "", nil, 404, xrpcserver.Errorf("ActorNotFound", "actor's account is %s", user.Status)
+	}
+	if user.TakenDown {
+		return "", nil, 404, xrpcserver.Errorf("ActorNotFound", "actor was taken down by an admin")
+	}
+	if hidden, err := accountHidden(a, db, cfg); err != nil {
+		return "", nil, 500, err
+	} else if hidden && viewer != a {
+		return "", nil, 404, xrpcserver.Errorf("ActorNotFound", "actor is hidden by a label")
+	}
 	fileviews = &[]*skywell.Defs_FileView{}
 	files := &[]File{} // so we can use Last() to get the cursor
-	query := db.Model(&File{}).Where("user_id = ?", user.ID).Order("indexed_at DESC").Limit(limit)
+	query := db.Model(&File{}).Scopes(visibleFiles(viewer == a, cfg)).Where("user_id = ?", user.ID).Order("indexed_at DESC").Limit(limit)
 	if c != "" {
 		pint, err := strconv.ParseInt(c, 10, 64)
 		if err != nil {
-			return "", nil, 400, fmt.Errorf("invalid 'cursor' parameter: %w", err)
+			return "", nil, 400, xrpcserver.Errorf("InvalidCursor", "invalid 'cursor' parameter")
 		}
-		dt := time.Unix(0, pint) // cursor is a nanosecond timestamp
-		query = query.Where("indexed_at < ?", dt)
+		// cursor is a nanosecond timestamp, same as indexed_at
+		query = query.Where("indexed_at < ?", pint)
 	}
 	result = query.Find(files)
 	if result.Error != nil {
@@ -516,23 +610,17 @@ func generateFileList(c string, limit int, a syntax.DID, db *gorm.DB) (cursor st
 			}
 			return "", nil, 500, fmt.Errorf("failed to find file key: %w", err)
 		}
-		c, err := cid.Decode(f.BlobRef.String())
+		fv, err := fileToView(f, fk.Key, cfg)
 		if err != nil {
-			return "", nil, 500, fmt.Errorf("failed to decode blob CID: %w", err)
-		}
-		*fileviews = append(*fileviews, &skywell.Defs_FileView{
-			Uri: f.Uri.String(),
-			Cid: f.Cid.String(),
-			Blob: &util.LexBlob{
-				Ref:      util.LexLink(c),
-				MimeType: f.MimeType,
-				Size:     f.Size,
-			},
-			CreatedAt:   f.CreatedAt.String(),
-			Name:        f.Name,
-			Slug:        fk.Key,
-			Description: &f.Description,
-		})
+			return "", nil, 500, err
+		}
+		*fileviews = append(*fileviews, fv)
+	}
+	if err := labelFileViews(*fileviews, db, cfg); err != nil {
+		return "", nil, 500, err
+	}
+	if err := chunkFileViews(*fileviews, db); err != nil {
+		return "", nil, 500, err
 	}
 	if len(*files) == 0 {
 		return "", fileviews, 200, nil
@@ -541,7 +629,7 @@ func generateFileList(c string, limit int, a syntax.DID, db *gorm.DB) (cursor st
 	return cursor, fileviews, 200, nil
 }
 
-func userAgent() *string {
-	str := UserAgent
+func userAgent(cfg *Config) *string {
+	str := cfg.UserAgent
 	return &str
 }
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// SchemaMigration is a row in schema_migrations, one per applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// migrations are applied in order, each in its own transaction.
+// once one has shipped, don't edit it, add a new one instead.
+// they use their own copies of the models (see below) so that
+// changing the structs in datamanager.go can't change old migrations
+var migrations = []migration{
+	{1, "initial schema", migrateInitialSchema},
+	{2, "ingest cursors", migrateIngestCursors},
+	{3, "account status", migrateAccountStatus},
+	{4, "fix index shapes", migrateFixIndexShapes},
+	{5, "file search", migrateFileSearch},
+	{6, "blob verification", migrateBlobVerification},
+	{7, "blob scanning", migrateBlobScanning},
+	{8, "labels", migrateLabels},
+	{9, "admin", migrateAdmin},
+	{10, "reports", migrateReports},
+	{11, "collections", migrateCollections},
+	{12, "file chunks", migrateFileChunks},
+	{13, "chunk verification", migrateChunkVerification},
+}
+
+// the tables as AutoMigrate created them before there were migrations.
+// databases from that era already have these, so every step checks before creating
+type userV1 struct {
+	gorm.Model
+	DID         syntax.DID `gorm:"uniqueIndex;column:did"`
+	Handle      syntax.Handle
+	Avatar      syntax.URI
+	DisplayName string
+}
+
+func (userV1) TableName() string { return "users" }
+
+type fileV1 struct {
+	gorm.Model
+	Uri         syntax.URI `gorm:"uniqueIndex"`
+	Cid         syntax.CID
+	UserID      uint
+	User        userV1 `gorm:"foreignKey:UserID"`
+	CreatedAt   syntax.Datetime
+	IndexedAt   int64 `gorm:"index"`
+	Name        string
+	Description string
+	BlobRef     syntax.CID
+	MimeType    string
+	Size        int64
+}
+
+func (fileV1) TableName() string { return "files" }
+
+type fileKeyV1 struct {
+	gorm.Model
+	Key  string `gorm:"uniqueIndex"`
+	File uint   `gorm:"uniqueIndex:idx_file_key"`
+}
+
+func (fileKeyV1) TableName() string { return "file_keys" }
+
+type ingestCursorV2 struct {
+	Service   string `gorm:"primaryKey"`
+	Cursor    int64
+	UpdatedAt time.Time
+}
+
+func (ingestCursorV2) TableName() string { return "ingest_cursors" }
+
+func migrateInitialSchema(tx *gorm.DB) error {
+	m := tx.Migrator()
+	for _, model := range []any{&userV1{}, &fileV1{}, &fileKeyV1{}} {
+		if m.HasTable(model) {
+			continue
+		}
+		if err := m.CreateTable(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateIngestCursors(tx *gorm.DB) error {
+	if tx.Migrator().HasTable(&ingestCursorV2{}) {
+		return nil
+	}
+	return tx.Migrator().CreateTable(&ingestCursorV2{})
+}
+
+func migrateAccountStatus(tx *gorm.DB) error {
+	type userV3 struct {
+		userV1
+		Status string
+	}
+	if tx.Migrator().HasColumn(&userV3{}, "status") {
+		return nil
+	}
+	return tx.Migrator().AddColumn(&userV3{}, "Status")
+}
+
+func migrateFixIndexShapes(tx *gorm.DB) error {
+	// AutoMigrate named the DID index after "d_id",
+	// and FileKey embedding a second DeletedAt got us an index on (deleted_at, deleted_at)
+	stmts := []string{
+		"DROP INDEX IF EXISTS idx_users_d_id",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_did ON users (did)",
+		"DROP INDEX IF EXISTS idx_file_keys_deleted_at",
+		"CREATE INDEX IF NOT EXISTS idx_file_keys_deleted_at ON file_keys (deleted_at)",
+	}
+	for _, s := range stmts {
+		if err := tx.Exec(s).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateFileSearch(tx *gorm.DB) error {
+	if tx.Dialector.Name() == dbDriverPostgres {
+		stmts := []string{
+			"ALTER TABLE files ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', coalesce(name, '') || ' ' || coalesce(description, ''))) STORED",
+			"CREATE INDEX IF NOT EXISTS idx_files_search_vector ON files USING GIN (search_vector)",
+		}
+		for _, s := range stmts {
+			if err := tx.Exec(s).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !sqliteFTS5(tx) {
+		// search falls back to LIKE, and syncFileSearch makes the table if we're ever built with FTS5
+		return nil
+	}
+	if err := createFileSearchTable(tx); err != nil {
+		return err
+	}
+	// index everything that's already there
+	return tx.Exec("INSERT OR REPLACE INTO files_fts (rowid, name, description) SELECT id, name, description FROM files WHERE deleted_at IS NULL").Error
+}
+
+func migrateBlobVerification(tx *gorm.DB) error {
+	type fileV6 struct {
+		fileV1
+		Verification     string `gorm:"index;not null;default:pending"`
+		DetectedMimeType string
+		VerifyError      string
+		VerifyAttempts   int
+	}
+	m := tx.Migrator()
+	for _, field := range []string{"Verification", "DetectedMimeType", "VerifyError", "VerifyAttempts"} {
+		if m.HasColumn(&fileV6{}, field) {
+			continue
+		}
+		if err := m.AddColumn(&fileV6{}, field); err != nil {
+			return err
+		}
+	}
+	// existing files start out pending, like new ones
+	if m.HasIndex(&fileV6{}, "Verification") {
+		return nil
+	}
+	return m.CreateIndex(&fileV6{}, "Verification")
+}
+
+func migrateBlobScanning(tx *gorm.DB) error {
+	type fileV7 struct {
+		fileV1
+		ScanStatus   string `gorm:"index;not null;default:pending"`
+		ScanResult   string
+		ScanAttempts int
+	}
+	m := tx.Migrator()
+	for _, field := range []string{"ScanStatus", "ScanResult", "ScanAttempts"} {
+		if m.HasColumn(&fileV7{}, field) {
+			continue
+		}
+		if err := m.AddColumn(&fileV7{}, field); err != nil {
+			return err
+		}
+	}
+	if m.HasIndex(&fileV7{}, "ScanStatus") {
+		return nil
+	}
+	return m.CreateIndex(&fileV7{}, "ScanStatus")
+}
+
+type labelV8 struct {
+	ID        uint   `gorm:"primaryKey"`
+	Src       string `gorm:"uniqueIndex:idx_labels_src_uri_val"`
+	Uri       string `gorm:"uniqueIndex:idx_labels_src_uri_val;index"`
+	Val       string `gorm:"uniqueIndex:idx_labels_src_uri_val"`
+	Cid       string
+	Cts       string
+	Exp       string
+	ExpiresAt *time.Time `gorm:"index"`
+	Sig       []byte
+	UpdatedAt time.Time
+}
+
+func (labelV8) TableName() string { return "labels" }
+
+type labelEventV8 struct {
+	Seq       int64 `gorm:"primaryKey"`
+	Src       string
+	Uri       string
+	Cid       string
+	Val       string
+	Neg       bool
+	Cts       string
+	Exp       string
+	Sig       []byte
+	CreatedAt time.Time
+}
+
+func (labelEventV8) TableName() string { return "label_events" }
+
+func migrateLabels(tx *gorm.DB) error {
+	m := tx.Migrator()
+	for _, model := range []any{&labelV8{}, &labelEventV8{}} {
+		if m.HasTable(model) {
+			continue
+		}
+		if err := m.CreateTable(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type auditLogV9 struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+	Admin     string    `gorm:"index"`
+	Action    string
+	Subject   string `gorm:"index"`
+	Reason    string
+	Details   string
+}
+
+func (auditLogV9) TableName() string { return "audit_logs" }
+
+type reservedSlugV9 struct {
+	Key       string `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+func (reservedSlugV9) TableName() string { return "reserved_slugs" }
+
+type ingestErrorV9 struct {
+	ID         uint      `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"index"`
+	DID        string    `gorm:"column:did;index"`
+	Uri        string
+	Collection string
+	Operation  string
+	Error      string
+}
+
+func (ingestErrorV9) TableName() string { return "ingest_errors" }
+
+func migrateAdmin(tx *gorm.DB) error {
+	type userV9 struct {
+		userV1
+		TakenDown bool `gorm:"index;not null;default:false"`
+	}
+	type fileV9 struct {
+		fileV1
+		TakenDown bool `gorm:"index;not null;default:false"`
+	}
+	m := tx.Migrator()
+	for _, model := range []any{&userV9{}, &fileV9{}} {
+		if m.HasColumn(model, "TakenDown") {
+			continue
+		}
+		if err := m.AddColumn(model, "TakenDown"); err != nil {
+			return err
+		}
+		if err := m.CreateIndex(model, "TakenDown"); err != nil {
+			return err
+		}
+	}
+	for _, model := range []any{&auditLogV9{}, &reservedSlugV9{}, &ingestErrorV9{}} {
+		if m.HasTable(model) {
+			continue
+		}
+		if err := m.CreateTable(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type reportV10 struct {
+	ID         uint      `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"index"`
+	UpdatedAt  time.Time
+	FileID     uint `gorm:"index"`
+	Uri        string
+	Reporter   string `gorm:"index"`
+	ReasonType string
+	Reason     string
+	Status     string `gorm:"index;not null;default:open"`
+	ResolvedBy string
+	ResolvedAt *time.Time
+	Note       string
+}
+
+func (reportV10) TableName() string { return "reports" }
+
+func migrateReports(tx *gorm.DB) error {
+	m := tx.Migrator()
+	if m.HasTable(&reportV10{}) {
+		return nil
+	}
+	return m.CreateTable(&reportV10{})
+}
+
+type collectionV11 struct {
+	gorm.Model
+	Uri         syntax.URI `gorm:"uniqueIndex"`
+	Cid         syntax.CID
+	UserID      uint `gorm:"index"`
+	CreatedAt   syntax.Datetime
+	IndexedAt   int64 `gorm:"index"`
+	Name        string
+	Description string
+	FileCount   int
+	Slug        string `gorm:"uniqueIndex"`
+}
+
+func (collectionV11) TableName() string { return "collections" }
+
+type collectionFileV11 struct {
+	CollectionID uint   `gorm:"primaryKey;autoIncrement:false"`
+	Position     int    `gorm:"primaryKey;autoIncrement:false"`
+	Uri          string `gorm:"index"`
+	Cid          string
+}
+
+func (collectionFileV11) TableName() string { return "collection_files" }
+
+func migrateCollections(tx *gorm.DB) error {
+	m := tx.Migrator()
+	for _, model := range []any{&collectionV11{}, &collectionFileV11{}} {
+		if m.HasTable(model) {
+			continue
+		}
+		if err := m.CreateTable(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileChunkV12 struct {
+	FileID   uint   `gorm:"primaryKey;autoIncrement:false"`
+	Position int    `gorm:"primaryKey;autoIncrement:false"`
+	BlobRef  string `gorm:"index"`
+	MimeType string
+	Size     int64
+}
+
+func (fileChunkV12) TableName() string { return "file_chunks" }
+
+func migrateFileChunks(tx *gorm.DB) error {
+	type fileV12 struct {
+		fileV1
+		Hash string `gorm:"index;not null;default:''"`
+	}
+	m := tx.Migrator()
+	if !m.HasColumn(&fileV12{}, "Hash") {
+		if err := m.AddColumn(&fileV12{}, "Hash"); err != nil {
+			return err
+		}
+	}
+	if !m.HasIndex(&fileV12{}, "Hash") {
+		if err := m.CreateIndex(&fileV12{}, "Hash"); err != nil {
+			return err
+		}
+	}
+	if m.HasTable(&fileChunkV12{}) {
+		return nil
+	}
+	return m.CreateTable(&fileChunkV12{})
+}
+
+func migrateChunkVerification(tx *gorm.DB) error {
+	type fileV13 struct {
+		fileV1
+		HashVerified bool `gorm:"not null;default:false"`
+	}
+	m := tx.Migrator()
+	if m.HasColumn(&fileV13{}, "HashVerified") {
+		return nil
+	}
+	return m.AddColumn(&fileV13{}, "HashVerified")
+}
+
+// appliedMigrations returns the applied migrations by version
+func appliedMigrations(db *gorm.DB) (applied map[int]SchemaMigration, err error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	rows := []SchemaMigration{}
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied = map[int]SchemaMigration{}
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// migrateUp applies every migration that hasn't been applied yet
+func migrateUp(db *gorm.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		dbLogger.Info("Applying migration", "version", m.version, "name", m.name)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   m.version,
+				Name:      m.name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+	}
+	// files_fts depends on how we were built as well as on the schema
+	if err := syncFileSearch(db); err != nil {
+		return fmt.Errorf("failed to sync file search index: %w", err)
+	}
+	return nil
+}
+
+// runMigrate implements the `migrate` subcommand
+func runMigrate(args []string, cfg *Config) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: skywell [-config path] migrate [status|up]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	switch fs.Arg(0) {
+	case "", "status":
+	case "up":
+		if err := migrateUp(db); err != nil {
+			return err
+		}
+	default:
+		fs.Usage()
+		return errors.New("unknown migrate command " + fs.Arg(0))
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS")
+	pending := 0
+	for _, m := range migrations {
+		status := "pending"
+		if a, ok := applied[m.version]; ok {
+			status = "applied " + a.AppliedAt.Format(time.RFC3339)
+		} else {
+			pending++
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.version, m.name, status)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d pending\n", pending)
+	return nil
+}
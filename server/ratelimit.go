@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"golang.org/x/time/rate"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+// rate limiting. requests with a valid service auth JWT are counted against their DID,
+// everything else against the client's IP (as told by a trusted proxy, or the connection itself).
+// every request takes from the overall budget, and the endpoints in rate_limit.endpoints
+// also take from their own one, so an expensive endpoint can't use up everything else.
+// checking a JWT can mean resolving whatever DID it claims to be from, so tokens are only checked
+// once the request has got past the IP's budget. valid ones get that back, and are counted against their DID instead
+
+var rateLimitLogger = slog.With("component", "ratelimit")
+
+// authDIDKey is where the rate limiter leaves the DID it verified, so verifyJWT doesn't do it twice
+const authDIDKey string = "authDID"
+
+// clientIPKey is where the rate limiter leaves the client's IP, for logging
+const clientIPKey string = "clientIP"
+
+type rateLimiter struct {
+	cfg     *Config
+	trusted []netip.Prefix
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	limiter  *rate.Limiter
+	burst    int
+	lastSeen time.Time
+}
+
+func parseTrustedProxies(proxies []string) (prefixes []netip.Prefix, err error) {
+	for _, p := range proxies {
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(p)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func newRateLimiter(cfg *Config, ctx context.Context) (rl *rateLimiter, err error) {
+	trusted, err := parseTrustedProxies(cfg.RateLimit.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	rl = &rateLimiter{cfg: cfg, trusted: trusted, buckets: map[string]*rateBucket{}}
+	go rl.cleanup(ctx)
+	return rl, nil
+}
+
+// cleanup forgets clients that haven't been seen for a while
+func (rl *rateLimiter) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(rl.cfg.RateLimit.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-rl.cfg.RateLimit.MaxIdleTime)
+		rl.mu.Lock()
+		for k, b := range rl.buckets {
+			if b.lastSeen.Before(cutoff) {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+func (rl *rateLimiter) isTrusted(addr netip.Addr) bool {
+	for _, p := range rl.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address r comes from. forwarding headers are only believed from trusted proxies,
+// and X-Forwarded-For is read from the right so clients can't put whatever they like in it
+func (rl *rateLimiter) clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	if !rl.isTrusted(addr) {
+		return addr
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = hop.Unmap()
+			if !rl.isTrusted(addr) {
+				break
+			}
+		}
+		return addr
+	}
+	if xri := r.Header.Get("X-Real-IP"); xri != "" {
+		if real, err := netip.ParseAddr(strings.TrimSpace(xri)); err == nil {
+			return real.Unmap()
+		}
+	}
+	return addr
+}
+
+// ipKey is what r is counted against when it isn't authenticated, and the budget that goes with it
+func (rl *rateLimiter) ipKey(addr netip.Addr) (key string, budget RateLimitBudget) {
+	budget = RateLimitBudget{RequestsPerSecond: rl.cfg.RateLimit.RequestsPerSecond, Burst: rl.cfg.RateLimit.Burst}
+	if addr.Is6() {
+		// people usually get a whole /64
+		prefix, _ := addr.Prefix(64)
+		return "ip:" + prefix.String(), budget
+	}
+	return "ip:" + addr.String(), budget
+}
+
+// bucketsFor are the buckets a request to path from key takes from
+func (rl *rateLimiter) bucketsFor(key string, budget RateLimitBudget, path string, now time.Time) []*rateBucket {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	buckets := []*rateBucket{rl.bucket(key, budget, now)}
+	nsid, isXRPC := strings.CutPrefix(path, "/xrpc/")
+	if endpoint, ok := rl.cfg.RateLimit.Endpoints[nsid]; ok && isXRPC {
+		buckets = append(buckets, rl.bucket(nsid+" "+key, endpoint, now))
+	}
+	return buckets
+}
+
+func (rl *rateLimiter) bucket(key string, budget RateLimitBudget, now time.Time) *rateBucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &rateBucket{limiter: rate.NewLimiter(rate.Limit(budget.RequestsPerSecond), budget.Burst), burst: budget.Burst}
+		rl.buckets[key] = b
+	}
+	b.lastSeen = now
+	return b
+}
+
+// take takes a request from each bucket, or from none of them if any is empty.
+// tightest is the bucket with the least left, which is what the headers describe.
+// reservations are what was taken, for giving it back
+func (rl *rateLimiter) take(buckets []*rateBucket, now time.Time) (allowed bool, tightest *rateBucket, retryAfter time.Duration, reservations []*rate.Reservation) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for _, b := range buckets {
+		res := b.limiter.ReserveN(now, 1)
+		if delay := res.DelayFrom(now); !res.OK() || delay > 0 {
+			res.CancelAt(now)
+			for _, prev := range reservations {
+				prev.CancelAt(now)
+			}
+			return false, b, delay, nil
+		}
+		reservations = append(reservations, res)
+	}
+
+	for _, b := range buckets {
+		if tightest == nil || b.limiter.TokensAt(now) < tightest.limiter.TokensAt(now) {
+			tightest = b
+		}
+	}
+	return true, tightest, 0, reservations
+}
+
+// giveBack undoes a take
+func (rl *rateLimiter) giveBack(reservations []*rate.Reservation, now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, res := range reservations {
+		res.CancelAt(now)
+	}
+}
+
+// setRateLimitHeaders describes b in the RateLimit-* headers, the same way the Bluesky PDS does
+func setRateLimitHeaders(w http.ResponseWriter, b *rateBucket, now time.Time) {
+	tokens := b.limiter.TokensAt(now)
+	perSecond := float64(b.limiter.Limit())
+	window := math.Ceil(float64(b.burst) / perSecond)
+	full := now.Add(time.Duration((float64(b.burst) - tokens) / perSecond * float64(time.Second)))
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(b.burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(max(0, int(tokens))))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(full.UnixMilli())/1000)), 10))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", b.burst, int64(window)))
+}
+
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		addr := rl.clientIP(r)
+		r = r.WithContext(context.WithValue(r.Context(), clientIPKey, addr))
+
+		key, budget := rl.ipKey(addr)
+		allowed, tightest, retryAfter, taken := rl.take(rl.bucketsFor(key, budget, r.URL.Path, now), now)
+		if allowed && r.Header.Get("Authorization") != "" {
+			// a bad token stays on the IP budget, the endpoint itself will turn it away
+			if did, err := verifyJWT(rl.cfg.serviceAudiences(), r.Context(), r); err == nil {
+				rl.giveBack(taken, now)
+				key = did.String()
+				r = r.WithContext(context.WithValue(r.Context(), authDIDKey, did))
+				allowed, tightest, retryAfter, _ = rl.take(rl.bucketsFor(key, rl.cfg.RateLimit.Authenticated, r.URL.Path, now), now)
+			}
+		}
+		setRateLimitHeaders(w, tightest, now)
+		if allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestID, _ := r.Context().Value(requestIDKey).(string)
+		rateLimitLogger.Info("Rate limited request", "request_id", requestID, "key", key, "path", r.URL.Path, "retry_after", retryAfter)
+		if retryAfter > 0 && retryAfter < rate.InfDuration {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+		}
+		xrpcserver.WriteError(w, http.StatusTooManyRequests, xrpcserver.RateLimitExceeded, "Rate Limit Exceeded")
+	})
+}
+
+// remoteAddr is the client's IP as the rate limiter worked it out, for logging
+func remoteAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientIPKey).(netip.Addr); ok && addr.IsValid() {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// authedDID is the DID the rate limiter verified for r, if any
+func authedDID(r *http.Request) (did syntax.DID, ok bool) {
+	did, ok = r.Context().Value(authDIDKey).(syntax.DID)
+	return did, ok
+}
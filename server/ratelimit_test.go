@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/auth"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// countingDirectory counts DID lookups, which for a real directory would mean going to the network
+type countingDirectory struct {
+	*identity.MockDirectory
+	lookups atomic.Int64
+}
+
+func (d *countingDirectory) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	d.lookups.Add(1)
+	return d.MockDirectory.LookupDID(ctx, did)
+}
+
+func (d *countingDirectory) Lookup(ctx context.Context, atid syntax.AtIdentifier) (*identity.Identity, error) {
+	if did, err := atid.AsDID(); err == nil {
+		return d.LookupDID(ctx, did)
+	}
+	return d.MockDirectory.Lookup(ctx, atid)
+}
+
+// newTestRateLimiter is a rate limiter in front of a handler that says who it thinks the client is
+func newTestRateLimiter(t *testing.T, cfg *Config) http.Handler {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	rl, err := newRateLimiter(cfg, ctx)
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	return rl.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		did, _ := authedDID(r)
+		fmt.Fprintf(w, "%s %s", remoteAddr(r), did)
+	}))
+}
+
+func testRateLimitRequest(h http.Handler, remote string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/xrpc/dev.skywell.getActorFiles", nil)
+	r.RemoteAddr = remote
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimitForgedTokens(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RateLimit.RequestsPerSecond = 0.001
+	cfg.RateLimit.Burst = 3
+	mock := identity.NewMockDirectory()
+	dir := &countingDirectory{MockDirectory: &mock}
+	useDirectory(t, dir)
+	h := newTestRateLimiter(t, cfg)
+
+	key, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatalf("failed to make key: %v", err)
+	}
+	limited := 0
+	for i := range 20 {
+		// a different DID every time, so none of them are cached
+		tok, err := auth.SignServiceAuth(syntax.DID(fmt.Sprintf("did:plc:forged%018d", i)), cfg.ServiceDID, time.Minute, nil, key)
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		w := testRateLimitRequest(h, "203.0.113.7:1234", tok)
+		if w.Code == http.StatusTooManyRequests {
+			limited++
+		} else if w.Code != http.StatusOK {
+			t.Fatalf("request %d gave %d", i, w.Code)
+		}
+	}
+	if limited != 17 {
+		t.Errorf("%d requests were limited, want 17", limited)
+	}
+	// only the requests that got through the IP's budget had their token checked
+	if n := dir.lookups.Load(); n == 0 || n > 3 {
+		t.Errorf("%d DID lookups for 3 requests that got through", n)
+	}
+}
+
+func TestRateLimitAuthenticated(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RateLimit.RequestsPerSecond = 0.001
+	cfg.RateLimit.Burst = 2
+	cfg.RateLimit.Authenticated = RateLimitBudget{RequestsPerSecond: 0.001, Burst: 5}
+
+	key, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatalf("failed to make key: %v", err)
+	}
+	pub, _ := key.PublicKey()
+	useTestDirectory(t, identity.Identity{
+		DID:    testDID,
+		Handle: syntax.HandleInvalid,
+		Keys: map[string]identity.VerificationMethod{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	})
+	h := newTestRateLimiter(t, cfg)
+	tok, err := auth.SignServiceAuth(testDID, cfg.ServiceDID, time.Minute, nil, key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	// valid tokens are counted against the DID, not the IP they come from
+	for i := range 5 {
+		w := testRateLimitRequest(h, "203.0.113.7:1234", tok)
+		if w.Code != http.StatusOK {
+			t.Fatalf("authenticated request %d gave %d", i, w.Code)
+		}
+		if want := "203.0.113.7 " + testDID; w.Body.String() != want {
+			t.Errorf("handler saw %q, want %q", w.Body.String(), want)
+		}
+	}
+	if w := testRateLimitRequest(h, "203.0.113.8:1234", tok); w.Code != http.StatusTooManyRequests {
+		t.Errorf("authenticated request over the DID's budget gave %d, want 429", w.Code)
+	}
+	for i := range 2 {
+		if w := testRateLimitRequest(h, "203.0.113.7:1234", ""); w.Code != http.StatusOK {
+			t.Errorf("unauthenticated request %d gave %d, the IP's budget should be untouched", i, w.Code)
+		}
+	}
+
+	// once the IP is over its budget, tokens aren't even looked at
+	if w := testRateLimitRequest(h, "203.0.113.7:1234", "not.a.token"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("request with a bad token from a limited IP gave %d, want 429", w.Code)
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	cfg := defaultConfig()
+	h := newTestRateLimiter(t, cfg)
+	for _, tc := range []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		{"203.0.113.7:1234", "", "203.0.113.7"},
+		// anyone can send X-Forwarded-For, it only counts from a trusted proxy
+		{"203.0.113.7:1234", "198.51.100.1", "203.0.113.7"},
+		{"127.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		// and then only the hop the proxy added
+		{"127.0.0.1:1234", "198.51.100.1, 203.0.113.9", "203.0.113.9"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/blob/abc", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Body.String(); got != tc.want+" " {
+			t.Errorf("%s with X-Forwarded-For %q is %q, want %q", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/saturn-vi/skywell/api/skywell"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+// user reports (dev.skywell.createReport), and the admin queue for them.
+// reports point at a file, and stay around after it's deleted so the queue keeps its history
+
+const (
+	reportOpen      = "open"
+	reportResolved  = "resolved"
+	reportDismissed = "dismissed"
+)
+
+// same as the lexicon's maxLength
+const reportReasonMaxLength = 20000
+
+// Report is one user's report about a file
+type Report struct {
+	ID         uint      `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"index"`
+	UpdatedAt  time.Time
+	FileID     uint   `gorm:"index"`
+	Uri        string // the file's, in case it goes away
+	Reporter   string `gorm:"index"`
+	ReasonType string
+	Reason     string
+	Status     string `gorm:"index;not null;default:open"`
+	ResolvedBy string
+	ResolvedAt *time.Time
+	Note       string
+}
+
+// createReport records did's report about subject (an at-uri or slug).
+// reporting a file again updates the reporter's open report instead of adding another one
+func createReport(did syntax.DID, subject string, reasonType string, reason string, db *gorm.DB, cfg *Config) (report Report, httpResponse int, err error) {
+	file, slug, stat, err := adminFindFile(subject, db)
+	if err != nil {
+		return report, stat, err
+	}
+	// only files people can actually see, there's nothing to report about the rest
+	if slug == "" {
+		return report, 404, fmt.Errorf("file has no slug")
+	}
+	if _, _, stat, err := fileBySlug(slug, db, cfg); err != nil {
+		return report, stat, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("file_id = ? AND reporter = ? AND status = ?", file.ID, did.String(), reportOpen).First(&report).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			report = Report{
+				FileID:     file.ID,
+				Uri:        file.Uri.String(),
+				Reporter:   did.String(),
+				ReasonType: reasonType,
+				Reason:     reason,
+				Status:     reportOpen,
+			}
+			return tx.Create(&report).Error
+		} else if err != nil {
+			return err
+		}
+		report.ReasonType, report.Reason = reasonType, reason
+		return tx.Model(&report).Updates(map[string]any{"reason_type": reasonType, "reason": reason}).Error
+	})
+	if err != nil {
+		return report, 500, fmt.Errorf("failed to save report: %w", err)
+	}
+	return report, 200, nil
+}
+
+// closeReport resolves or dismisses the open report id, if it's still open
+func closeReport(id uint, status string, admin syntax.DID, note *string, tx *gorm.DB) (report Report, httpResponse int, err error) {
+	if err := tx.Where("id = ?", id).First(&report).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return report, 404, xrpcserver.Errorf("ReportNotFound", "report not found")
+	} else if err != nil {
+		return report, 500, fmt.Errorf("failed to find report: %w", err)
+	}
+	if report.Status != reportOpen {
+		return report, 400, fmt.Errorf("report %d is already %s", id, report.Status)
+	}
+	now := time.Now()
+	report.Status, report.ResolvedBy, report.ResolvedAt = status, admin.String(), &now
+	updates := map[string]any{"status": status, "resolved_by": admin.String(), "resolved_at": &now}
+	if note != nil {
+		report.Note = *note
+		updates["note"] = *note
+	}
+	if err := tx.Model(&report).Updates(updates).Error; err != nil {
+		return report, 500, fmt.Errorf("failed to update report: %w", err)
+	}
+	return report, 200, nil
+}
+
+// resolveFileReports resolves every open report about file, e.g. because it was taken down
+func resolveFileReports(fileID uint, admin syntax.DID, tx *gorm.DB) error {
+	return tx.Model(&Report{}).
+		Where("file_id = ? AND status = ?", fileID, reportOpen).
+		Updates(map[string]any{"status": reportResolved, "resolved_by": admin.String(), "resolved_at": time.Now()}).Error
+}
+
+func generateReportViews(reports []Report, db *gorm.DB) (views []*skywell.AdminDefs_ReportView, err error) {
+	fileIDs := []uint{}
+	for _, r := range reports {
+		fileIDs = append(fileIDs, r.FileID)
+	}
+	takenDown := map[uint]bool{}
+	slugs := map[uint]string{}
+	if len(fileIDs) > 0 {
+		files := []File{}
+		if err := db.Unscoped().Select("id", "taken_down").Where("id IN ?", fileIDs).Find(&files).Error; err != nil {
+			return nil, fmt.Errorf("failed to find reported files: %w", err)
+		}
+		for _, f := range files {
+			takenDown[f.ID] = f.TakenDown
+		}
+		// deleted files lose their key, so they get no slug
+		keys := []FileKey{}
+		if err := db.Where("file IN ?", fileIDs).Find(&keys).Error; err != nil {
+			return nil, fmt.Errorf("failed to find file keys: %w", err)
+		}
+		for _, k := range keys {
+			slugs[k.File] = k.Key
+		}
+	}
+
+	views = []*skywell.AdminDefs_ReportView{}
+	for _, r := range reports {
+		v := &skywell.AdminDefs_ReportView{
+			Id:         int64(r.ID),
+			CreatedAt:  r.CreatedAt.UTC().Format(syntax.AtprotoDatetimeLayout),
+			Reporter:   r.Reporter,
+			Uri:        r.Uri,
+			ReasonType: &r.ReasonType,
+			Status:     &r.Status,
+			Takedown:   takenDown[r.FileID],
+		}
+		if slug, ok := slugs[r.FileID]; ok {
+			v.Slug = &slug
+		}
+		if r.Reason != "" {
+			v.Reason = &r.Reason
+		}
+		if r.ResolvedBy != "" {
+			v.ResolvedBy = &r.ResolvedBy
+		}
+		if r.ResolvedAt != nil {
+			resolvedAt := r.ResolvedAt.UTC().Format(syntax.AtprotoDatetimeLayout)
+			v.ResolvedAt = &resolvedAt
+		}
+		if r.Note != "" {
+			v.Note = &r.Note
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+func initializeReportRoutes(s *xrpcserver.Server, db *gorm.DB, cfg *Config, ctx context.Context) {
+	xrpcserver.Procedure(s, "dev.skywell.createReport", xrpcserver.Opts{Auth: xrpcserver.AuthRequired}, func(req *xrpcserver.Request, in skywell.CreateReport_Input) (*skywell.CreateReport_Output, int, error) {
+		if in.Subject == "" {
+			return nil, 400, fmt.Errorf("required parameter 'subject' missing")
+		}
+		if in.ReasonType == nil || *in.ReasonType == "" {
+			return nil, 400, fmt.Errorf("required parameter 'reasonType' missing")
+		}
+		reason := ""
+		if in.Reason != nil {
+			reason = *in.Reason
+		}
+		if len(reason) > reportReasonMaxLength {
+			return nil, 400, fmt.Errorf("parameter 'reason' is too long")
+		}
+
+		report, stat, err := createReport(req.Caller, in.Subject, *in.ReasonType, reason, db, cfg)
+		if stat == 404 {
+			return nil, 404, xrpcserver.Errorf("FileNotFound", "file not found")
+		} else if err != nil {
+			return nil, stat, fmt.Errorf("failed to create report: %w", err)
+		}
+		req.Logger.Info("Received report", "report_id", report.ID, "uri", report.Uri, "reason_type", report.ReasonType)
+
+		return &skywell.CreateReport_Output{
+			Id:        int64(report.ID),
+			Uri:       report.Uri,
+			CreatedAt: report.CreatedAt.UTC().Format(syntax.AtprotoDatetimeLayout),
+		}, 200, nil
+	})
+}
+
+// initializeReportAdminRoutes adds the report queue to the admin API
+func initializeReportAdminRoutes(s *xrpcserver.Server, db *gorm.DB, cfg *Config, ctx context.Context) {
+	type listReportsParams struct {
+		Status  string `query:"status"`
+		Subject string `query:"subject"`
+		Limit   int    `query:"limit"`
+		Cursor  string `query:"cursor"`
+	}
+
+	// returns AdminListReports_Output
+	xrpcserver.Query(s, "dev.skywell.admin.listReports", adminOpts, func(req *xrpcserver.Request, p listReportsParams) (*skywell.AdminListReports_Output, int, error) {
+		limit, cursor, err := adminPage(p.Limit, p.Cursor)
+		if err != nil {
+			return nil, 400, err
+		}
+		status := p.Status
+		if status == "" {
+			status = reportOpen
+		}
+		query := db.Where("status = ?", status).Order("id DESC").Limit(limit)
+		if cursor > 0 {
+			query = query.Where("id < ?", cursor)
+		}
+		if p.Subject != "" {
+			file, _, stat, err := adminFindFile(p.Subject, db)
+			if err != nil {
+				return nil, stat, err
+			}
+			query = query.Where("file_id = ?", file.ID)
+		}
+		rows := []Report{}
+		if err := query.Find(&rows).Error; err != nil {
+			return nil, 500, fmt.Errorf("failed to list reports: %w", err)
+		}
+
+		views, err := generateReportViews(rows, db)
+		if err != nil {
+			return nil, 500, err
+		}
+		out := skywell.AdminListReports_Output{Reports: views}
+		if len(rows) == limit {
+			c := strconv.FormatUint(uint64(rows[len(rows)-1].ID), 10)
+			out.Cursor = &c
+		}
+		return &out, 200, nil
+	})
+
+	// returns AdminDefs_ReportView
+	xrpcserver.Procedure(s, "dev.skywell.admin.resolveReport", adminOpts, func(req *xrpcserver.Request, in skywell.AdminResolveReport_Input) (*skywell.AdminDefs_ReportView, int, error) {
+		takedown := in.Takedown != nil && *in.Takedown
+
+		var report Report
+		var file File
+		stat := 200
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			report, stat, err = closeReport(uint(in.Id), reportResolved, req.Caller, in.Note, tx)
+			if err != nil {
+				return err
+			}
+			if takedown {
+				if err := tx.Where("id = ?", report.FileID).First(&file).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+					stat = 404
+					return fmt.Errorf("reported file not found")
+				} else if err != nil {
+					stat = 500
+					return fmt.Errorf("failed to find file: %w", err)
+				}
+				if err := setFileTakedown(file, true, req.Caller, tx); err != nil {
+					stat = 500
+					return err
+				}
+			}
+			stat = 500
+			return audit(req.Caller, "dev.skywell.admin.resolveReport", report.Uri, in.Note, in, tx)
+		})
+		if err != nil {
+			return nil, stat, err
+		}
+		if takedown {
+			uncacheFile(file, db)
+		}
+		req.Logger.Info("Resolved report", "report_id", report.ID, "uri", report.Uri, "takedown", takedown)
+
+		views, err := generateReportViews([]Report{report}, db)
+		if err != nil {
+			return nil, 500, err
+		}
+		return views[0], 200, nil
+	})
+
+	// returns AdminDefs_ReportView
+	xrpcserver.Procedure(s, "dev.skywell.admin.dismissReport", adminOpts, func(req *xrpcserver.Request, in skywell.AdminDismissReport_Input) (*skywell.AdminDefs_ReportView, int, error) {
+		var report Report
+		stat := 200
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			report, stat, err = closeReport(uint(in.Id), reportDismissed, req.Caller, in.Note, tx)
+			if err != nil {
+				return err
+			}
+			stat = 500
+			return audit(req.Caller, "dev.skywell.admin.dismissReport", report.Uri, in.Note, in, tx)
+		})
+		if err != nil {
+			return nil, stat, err
+		}
+		req.Logger.Info("Dismissed report", "report_id", report.ID, "uri", report.Uri)
+
+		views, err := generateReportViews([]Report{report}, db)
+		if err != nil {
+			return nil, 500, err
+		}
+		return views[0], 200, nil
+	})
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// every indexed blob goes through the configured scanners in the background, like verify.go.
+// updateRecord marks files pending, the scanner downloads the blob once and hands it to each scanner,
+// and the verdict ends up in File.ScanStatus. flagged files are hidden (or only marked, see scan.action)
+// and /blob won't serve them either way
+
+var scanLogger = slog.With("component", "scan")
+
+const (
+	scanPending   = "pending"
+	scanClean     = "clean"
+	scanFlagged   = "flagged"
+	scanUnscanned = "unscanned" // too big, or the blob couldn't be fetched
+)
+
+const (
+	scanActionHide = "hide"
+	scanActionMark = "mark"
+)
+
+const (
+	scannerClamAV    = "clamav"
+	scannerBlocklist = "blocklist"
+)
+
+const (
+	maxScanAttempts = 3
+	scanBatchSize   = 50
+	scanSweepPeriod = time.Minute
+)
+
+// scanner looks at a blob's contents. found is the name of whatever it found, empty if it's clean.
+// errors mean it couldn't tell, and the blob is tried again later
+type scanner interface {
+	scan(r io.Reader, ctx context.Context) (found string, err error)
+	String() string
+}
+
+// newScanners sets up the scanners named in cfg.Scan.Scanners, in order
+func newScanners(cfg *Config) (scanners []scanner, err error) {
+	for _, name := range cfg.Scan.Scanners {
+		switch name {
+		case scannerClamAV:
+			s, err := newClamAVScanner(cfg.Scan.ClamAVAddress)
+			if err != nil {
+				return nil, err
+			}
+			scanners = append(scanners, s)
+		case scannerBlocklist:
+			s, err := loadHashBlocklist(cfg.Scan.BlocklistFile)
+			if err != nil {
+				return nil, err
+			}
+			scanners = append(scanners, s)
+		default:
+			return nil, fmt.Errorf("unknown scanner %q", name)
+		}
+	}
+	return scanners, nil
+}
+
+// hideFlagged is a scope for file queries that drops flagged files,
+// unless they're only being marked or the owner is the one looking
+func hideFlagged(owner bool, cfg *Config) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if owner || cfg.Scan.Action == scanActionMark {
+			return db
+		}
+		return db.Where("files.scan_status <> ?", scanFlagged)
+	}
+}
+
+var scanWake = make(chan struct{}, 1)
+
+// wakeScanner lets the scanner know there's something new, see wakeVerifier
+func wakeScanner() {
+	select {
+	case scanWake <- struct{}{}:
+	default:
+	}
+}
+
+func runScanner(scanners []scanner, db *gorm.DB, cfg *Config, ctx context.Context) {
+	scanLogger.Info("Starting blob scanner", "scanners", scanners, "workers", cfg.Scan.Workers, "action", cfg.Scan.Action)
+	ticker := time.NewTicker(scanSweepPeriod)
+	defer ticker.Stop()
+	for {
+		scanPendingFiles(scanners, db, cfg, ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-scanWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// scanPendingFiles makes one pass over the pending files
+func scanPendingFiles(scanners []scanner, db *gorm.DB, cfg *Config, ctx context.Context) {
+	var lastID uint
+	for ctx.Err() == nil {
+		files := []File{}
+		err := db.Preload("User").
+			Where("scan_status = ? AND id > ?", scanPending, lastID).
+			Order("id").Limit(scanBatchSize).Find(&files).Error
+		if err != nil {
+			scanLogger.Error("Failed to query pending files", "error", err)
+			return
+		}
+		if len(files) == 0 {
+			return
+		}
+		lastID = files[len(files)-1].ID
+
+		sem := make(chan struct{}, cfg.Scan.Workers)
+		wg := sync.WaitGroup{}
+		for _, f := range files {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				scanFile(f, scanners, db, cfg, ctx)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func scanFile(f File, scanners []scanner, db *gorm.DB, cfg *Config, ctx context.Context) {
+	status, result, err := scanBlob(f, scanners, db, cfg, ctx)
+	updates := map[string]any{}
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		attempts := f.ScanAttempts + 1
+		scanLogger.Warn("Failed to scan blob", "file_id", f.ID, "cid", f.BlobRef.String(), "did", f.User.DID.String(), "attempt", attempts, "error", err)
+		updates["scan_attempts"] = attempts
+		updates["scan_result"] = err.Error()
+		if attempts >= maxScanAttempts {
+			updates["scan_status"] = scanUnscanned
+		}
+	} else {
+		updates["scan_status"] = status
+		updates["scan_result"] = result
+		if status == scanFlagged {
+			scanLogger.Warn("Flagged file", "file_id", f.ID, "uri", f.Uri.String(), "cid", f.BlobRef.String(), "did", f.User.DID.String(), "found", result)
+			uncacheFile(f, db)
+		} else {
+			scanLogger.Debug("Scanned blob", "file_id", f.ID, "cid", f.BlobRef.String(), "status", status)
+		}
+	}
+
+	// only if it's still the same blob (or chunked file), otherwise it's pending again
+	err = db.Model(&File{}).Where("id = ? AND blob_ref = ? AND hash = ?", f.ID, f.BlobRef.String(), f.Hash).Updates(updates).Error
+	if err != nil {
+		scanLogger.Error("Failed to save scan result", "file_id", f.ID, "error", err)
+	}
+}
+
+// scanBlob runs the blob through every scanner, stopping at the first one that finds something
+func scanBlob(f File, scanners []scanner, db *gorm.DB, cfg *Config, ctx context.Context) (status string, result string, err error) {
+	// the same blob shows up in more than one record all the time, no need to scan it again
+	size := f.Size
+	var chunks []FileChunk
+	if f.Hash == "" {
+		prev := File{}
+		err := db.Select("scan_status", "scan_result").
+			Where("scan_status IN ? AND id <> ? AND blob_ref = ? AND hash = ''", []string{scanClean, scanFlagged}, f.ID, f.BlobRef.String()).
+			Limit(1).Find(&prev).Error
+		if err != nil {
+			return "", "", err
+		}
+		if prev.ScanStatus != "" {
+			return prev.ScanStatus, prev.ScanResult, nil
+		}
+	} else {
+		if chunks, err = fileChunks(f.ID, db); err != nil {
+			return "", "", err
+		}
+		size = chunksSize(chunks)
+		// the hash is only what the record says, anyone can copy it.
+		// another chunked file is only the same file if it's made of the same blobs
+		prevs := []File{}
+		err := db.Select("id", "scan_status", "scan_result").
+			Where("scan_status IN ? AND id <> ? AND hash = ?", []string{scanClean, scanFlagged}, f.ID, f.Hash).
+			Limit(scanBatchSize).Find(&prevs).Error
+		if err != nil {
+			return "", "", err
+		}
+		for _, prev := range prevs {
+			prevChunks, err := fileChunks(prev.ID, db)
+			if err != nil {
+				return "", "", err
+			}
+			if sameChunks(prevChunks, chunks) {
+				return prev.ScanStatus, prev.ScanResult, nil
+			}
+		}
+	}
+	if size > cfg.Scan.MaxBytes {
+		return scanUnscanned, "too big to scan", nil
+	}
+
+	tmp, err := os.CreateTemp("", "skywell-scan-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var n int64
+	if f.Hash != "" {
+		// the scanners should see what people download, which is checked against the hash
+		n, err = copyChunkedFile(tmp, f, chunks, &chunkSource{did: f.User.DID, cfg: cfg, ctx: ctx, fetchCtx: ctx})
+		if err == nil {
+			if err := markHashVerified(f, db); err != nil {
+				scanLogger.Error("Failed to mark chunked file verified", "file_id", f.ID, "error", err)
+			}
+		}
+	} else {
+		n, err = downloadBlob(tmp, f, cfg.Scan.MaxBytes+1, cfg, ctx)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if n > cfg.Scan.MaxBytes {
+		// the record lied about the size
+		return scanUnscanned, "too big to scan", nil
+	}
+
+	for _, s := range scanners {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return "", "", err
+		}
+		found, err := s.scan(tmp, ctx)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %w", s, err)
+		}
+		if found != "" {
+			return scanFlagged, s.String() + ": " + found, nil
+		}
+	}
+	return scanClean, "", nil
+}
+
+// downloadBlob copies up to limit bytes of a file's blob into w, from the cache if it's there
+func downloadBlob(w io.Writer, f File, limit int64, cfg *Config, ctx context.Context) (n int64, err error) {
+	if cf := blobCache.open(f.BlobRef.String()); cf != nil {
+		defer cf.Close()
+		return io.Copy(w, io.LimitReader(cf, limit))
+	}
+
+	id, err := cacheDir.LookupDID(ctx, f.User.DID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve DID: %w", err)
+	}
+	pds := id.PDSEndpoint()
+	if pds == "" {
+		return 0, errors.New("DID document has no PDS endpoint")
+	}
+	res, err := fetchBlob(pds, f.User.DID.String(), f.BlobRef.String(), byteRange{}, false, cfg, ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("PDS returned status %d", res.StatusCode)
+	}
+	n, err = io.Copy(w, io.LimitReader(res.Body, limit))
+	if err != nil {
+		return n, fmt.Errorf("failed to download blob: %w", err)
+	}
+	return n, nil
+}
+
+// clamAVScanner streams blobs to clamd with INSTREAM
+type clamAVScanner struct {
+	network string
+	address string
+}
+
+const clamAVChunkSize = 64 << 10
+
+// newClamAVScanner takes unix:///path/to/clamd.sock or tcp://host:port
+func newClamAVScanner(addr string) (*clamAVScanner, error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return &clamAVScanner{"unix", path}, nil
+	}
+	if hostport, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		return &clamAVScanner{"tcp", hostport}, nil
+	}
+	return nil, fmt.Errorf("invalid clamd address %q (want unix:// or tcp://)", addr)
+}
+
+func (s *clamAVScanner) String() string {
+	return scannerClamAV
+}
+
+func (s *clamAVScanner) scan(r io.Reader, ctx context.Context) (found string, err error) {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	}
+
+	// z commands are null terminated, and so is the reply
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamAVChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd hangs up once the stream is over its StreamMaxLength, the reply says so
+				break
+			}
+		}
+		if errors.Is(rerr, io.EOF) || errors.Is(rerr, io.ErrUnexpectedEOF) {
+			break
+		} else if rerr != nil {
+			return "", rerr
+		}
+	}
+	conn.Write([]byte{0, 0, 0, 0})
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return parseClamAVReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamAVReply reads "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+func parseClamAVReply(reply string) (found string, err error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	case reply == "":
+		return "", errors.New("clamd closed the connection without answering")
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// hashBlocklist flags blobs by their sha256
+type hashBlocklist struct {
+	names map[[sha256.Size]byte]string
+}
+
+// loadHashBlocklist reads a file of hex sha256 hashes, one per line, optionally followed by a name.
+// that's the same format sha256sum prints. # starts a comment
+func loadHashBlocklist(path string) (*hashBlocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hash blocklist: %w", err)
+	}
+	defer f.Close()
+
+	bl := &hashBlocklist{names: map[[sha256.Size]byte]string{}}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: not a sha256 hash", path, line)
+		}
+		name := "blocklisted"
+		if len(fields) > 1 {
+			name = strings.TrimPrefix(strings.Join(fields[1:], " "), "*") // sha256sum's binary mode marker
+		}
+		bl.names[[sha256.Size]byte(sum)] = name
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hash blocklist: %w", err)
+	}
+	scanLogger.Info("Loaded hash blocklist", "path", path, "hashes", len(bl.names))
+	return bl, nil
+}
+
+func (bl *hashBlocklist) String() string {
+	return scannerBlocklist
+}
+
+func (bl *hashBlocklist) scan(r io.Reader, ctx context.Context) (found string, err error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return bl.names[[sha256.Size]byte(h.Sum(nil))], nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// eicar is the standard antivirus test file, see https://www.eicar.org/download-anti-malware-testfile/
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// fakeScanner flags anything containing the EICAR test string, so the pipeline can be tested without clamd
+type fakeScanner struct{}
+
+func (fakeScanner) String() string {
+	return "fake"
+}
+
+func (fakeScanner) scan(r io.Reader, ctx context.Context) (found string, err error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Contains(b, eicar) {
+		return "Eicar-Test-Signature", nil
+	}
+	return "", nil
+}
+
+func TestScanFlagsEICAR(t *testing.T) {
+	db, cfg := newTestDB(t)
+	useTestLexicons(t)
+	useTestBlobCache(t)
+	createTestUser(t, db, testDID)
+	// it's only for tests, it can't be configured
+	cfg.Scan.Scanners = []string{"fake"}
+	if _, err := newScanners(cfg); err == nil {
+		t.Error("newScanners accepted the fake scanner")
+	}
+	scanners := []scanner{fakeScanner{}}
+
+	clean := []byte("just some text\n")
+	cacheTestBlob(t, eicar)
+	cacheTestBlob(t, clean)
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa000", testBlobFileRecord("totally fine", eicar)); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	if err := ingestTestRecord(db, "dev.skywell.file", "3kaaaaaaaa001", testBlobFileRecord("actually fine", clean)); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+
+	scanPendingFiles(scanners, db, cfg, context.Background())
+
+	status := map[string]File{}
+	files := []File{}
+	db.Find(&files)
+	for _, f := range files {
+		status[f.Name] = f
+	}
+	if f := status["totally fine"]; f.ScanStatus != scanFlagged || f.ScanResult != "fake: Eicar-Test-Signature" {
+		t.Errorf("EICAR file is %s (%q), want flagged", f.ScanStatus, f.ScanResult)
+	}
+	if f := status["actually fine"]; f.ScanStatus != scanClean {
+		t.Errorf("clean file is %s (%q), want clean", f.ScanStatus, f.ScanResult)
+	}
+
+	// flagged files are hidden from everyone else, including by slug (so /blob won't serve it)
+	_, fvs, _, err := generateFileList("", 25, syntax.DID(testDID), "did:plc:someoneelse", db, cfg)
+	if err != nil {
+		t.Fatalf("generateFileList: %v", err)
+	}
+	if len(*fvs) != 1 || (*fvs)[0].Name != "actually fine" {
+		t.Errorf("someone else sees %d files, want only the clean one", len(*fvs))
+	}
+	fk := FileKey{}
+	db.Where("file = ?", status["totally fine"].ID).First(&fk)
+	if _, _, stat, _ := fileBySlug(fk.Key, db, cfg); stat != 404 {
+		t.Errorf("flagged file by slug gave %d, want 404", stat)
+	}
+
+	// the owner still sees it, and why
+	_, fvs, _, err = generateFileList("", 25, syntax.DID(testDID), syntax.DID(testDID), db, cfg)
+	if err != nil {
+		t.Fatalf("generateFileList: %v", err)
+	}
+	if len(*fvs) != 2 {
+		t.Fatalf("owner sees %d files, want 2", len(*fvs))
+	}
+	for _, fv := range *fvs {
+		if fv.Name == "totally fine" && (fv.ScanStatus == nil || *fv.ScanStatus != scanFlagged || fv.ScanResult == nil) {
+			t.Errorf("owner's view of the flagged file has scanStatus %v, scanResult %v", fv.ScanStatus, fv.ScanResult)
+		}
+	}
+
+	// with mark, it's shown to everyone but still flagged
+	cfg.Scan.Action = scanActionMark
+	_, fvs, _, _ = generateFileList("", 25, syntax.DID(testDID), "did:plc:someoneelse", db, cfg)
+	if len(*fvs) != 2 {
+		t.Errorf("someone else sees %d files with scan.action = mark, want 2", len(*fvs))
+	}
+}
+
+func TestFileViewScanAndVerifyDisabled(t *testing.T) {
+	cfg := defaultConfig()
+	f := File{BlobRef: syntax.CID(testCID), Verification: verifyPending, ScanStatus: scanPending}
+
+	fv, err := fileToView(f, "abc", cfg)
+	if err != nil {
+		t.Fatalf("fileToView: %v", err)
+	}
+	if fv.Verification != nil || fv.ScanStatus != nil {
+		t.Errorf("verification %v and scanStatus %v are set with verification and scanning off", fv.Verification, fv.ScanStatus)
+	}
+
+	// a file flagged before scanning was turned off is still hidden, so it still says so
+	f.ScanStatus = scanFlagged
+	if fv, _ = fileToView(f, "abc", cfg); fv.ScanStatus == nil || *fv.ScanStatus != scanFlagged {
+		t.Errorf("flagged file's scanStatus is %v with scanning off, want flagged", fv.ScanStatus)
+	}
+
+	cfg.Verify.Enabled = true
+	cfg.Scan.Scanners = []string{scannerClamAV}
+	f.ScanStatus = scanPending
+	if fv, _ = fileToView(f, "abc", cfg); fv.Verification == nil || fv.ScanStatus == nil {
+		t.Errorf("verification %v and scanStatus %v aren't set with verification and scanning on", fv.Verification, fv.ScanStatus)
+	}
+}
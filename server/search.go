@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/saturn-vi/skywell/api/skywell"
+
+	"saturnvi/skywell/internal/xrpcserver"
+)
+
+// file search is backed by an FTS5 table (files_fts, rowid = files.id) on sqlite
+// and a generated tsvector column (files.search_vector) on postgres.
+// postgres keeps its column up to date by itself, the FTS5 table is maintained
+// from updateRecord through indexFileSearch and unindexFileSearch.
+// both are created by the "file search" migration.
+// sqlite only has FTS5 when the server's built with -tags sqlite_fts5. without it there's no files_fts,
+// and search falls back to LIKE, which is slower and doesn't rank but still works
+
+const maxSearchOffset = 10000 // past this nobody is paging, they're scraping
+
+func isPostgres(db *gorm.DB) bool {
+	return db.Dialector.Name() == dbDriverPostgres
+}
+
+// sqliteFTS5 is whether this build's sqlite has FTS5
+func sqliteFTS5(db *gorm.DB) bool {
+	var ok bool
+	err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&ok).Error
+	return err == nil && ok
+}
+
+// useFTS is whether file search goes through files_fts,
+// i.e. we're on sqlite with FTS5 and the table is there
+func useFTS(db *gorm.DB) bool {
+	if isPostgres(db) {
+		return false
+	}
+	var ok bool
+	err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5') AND EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'files_fts')").Scan(&ok).Error
+	return err == nil && ok
+}
+
+// syncFileSearch gets files_fts in line with how we were built. it's created and filled the first time
+// we start with FTS5 (e.g. after a build without it), and refilled if files came or went while it couldn't be kept up to date.
+// edits made in that time are only caught if the number of files changed too
+func syncFileSearch(db *gorm.DB) error {
+	if isPostgres(db) {
+		return nil
+	}
+	if !sqliteFTS5(db) {
+		dbLogger.Warn("SQLite was built without FTS5, file search will use slower LIKE matching (build with -tags sqlite_fts5)")
+		return nil
+	}
+	if useFTS(db) {
+		var indexed, files int64
+		if err := db.Raw("SELECT count(*) FROM files_fts").Scan(&indexed).Error; err != nil {
+			return err
+		}
+		if err := db.Model(&File{}).Count(&files).Error; err != nil {
+			return err
+		}
+		if indexed == files {
+			return nil
+		}
+	}
+	dbLogger.Info("Rebuilding file search index")
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := createFileSearchTable(tx); err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM files_fts").Error; err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO files_fts (rowid, name, description) SELECT id, name, description FROM files WHERE deleted_at IS NULL").Error
+	})
+}
+
+func createFileSearchTable(tx *gorm.DB) error {
+	return tx.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5(name, description, tokenize = 'unicode61 remove_diacritics 2')").Error
+}
+
+// indexFileSearch adds or replaces a file's entry in the search index
+func indexFileSearch(file File, db *gorm.DB) error {
+	if !useFTS(db) {
+		return nil
+	}
+	return db.Exec("INSERT OR REPLACE INTO files_fts (rowid, name, description) VALUES (?, ?, ?)", file.ID, file.Name, file.Description).Error
+}
+
+// unindexFileSearch removes files from the search index.
+// ids can be a slice or a subquery
+func unindexFileSearch(ids any, db *gorm.DB) error {
+	if !useFTS(db) {
+		return nil
+	}
+	return db.Exec("DELETE FROM files_fts WHERE rowid IN (?)", ids).Error
+}
+
+// searchWords splits whatever the user typed into words worth searching for
+func searchWords(q string) []string {
+	words := []string{}
+	for _, word := range strings.Fields(q) {
+		if !strings.ContainsFunc(word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) {
+			continue // would tokenize to nothing
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+// ftsQuery turns whatever the user typed into an FTS5 query where every word has to match (as a prefix).
+// each word is quoted so that FTS5 syntax in the input is just text
+func ftsQuery(q string) string {
+	terms := []string{}
+	for _, word := range searchWords(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// searchFiles returns files of active accounts matching q, best matches first.
+// flagged files are left out even for their owner, search has no viewer
+// the cursor is an offset into the results
+func searchFiles(q string, actor syntax.DID, mimeType string, limit int, c string, db *gorm.DB, cfg *Config) (cursor string, fileviews []*skywell.Defs_FileView, httpResponse int, err error) {
+	offset := 0
+	if c != "" {
+		offset, err = strconv.Atoi(c)
+		if err != nil || offset < 0 || offset > maxSearchOffset {
+			return "", nil, 400, xrpcserver.Errorf("InvalidCursor", "invalid 'cursor' parameter")
+		}
+	}
+
+	query := db.Model(&File{}).
+		Scopes(visibleFiles(false, cfg)).
+		Joins("JOIN users ON users.id = files.user_id AND users.deleted_at IS NULL").
+		Where("users.status = '' AND users.taken_down = ?", false)
+
+	switch {
+	case isPostgres(db):
+		query = query.
+			Where("files.search_vector @@ websearch_to_tsquery('simple', ?)", q).
+			Order(clause.Expr{SQL: "ts_rank(files.search_vector, websearch_to_tsquery('simple', ?)) DESC", Vars: []any{q}})
+	case useFTS(db):
+		match := ftsQuery(q)
+		if match == "" {
+			return "", nil, 400, xrpcserver.Errorf("InvalidQuery", "query has no searchable words")
+		}
+		// matches in the name count for more than matches in the description
+		query = query.
+			Joins("JOIN files_fts ON files_fts.rowid = files.id").
+			Where("files_fts MATCH ?", match).
+			Order("bm25(files_fts, 10.0, 1.0)")
+	default:
+		words := searchWords(q)
+		if len(words) == 0 {
+			return "", nil, 400, xrpcserver.Errorf("InvalidQuery", "query has no searchable words")
+		}
+		// every word has to be in the name or description somewhere. sqlite's LIKE ignores (ascii) case
+		for _, w := range words {
+			like := "%" + escapeLike(w) + "%"
+			query = query.Where(`(files.name LIKE ? ESCAPE '\' OR files.description LIKE ? ESCAPE '\')`, like, like)
+		}
+	}
+	query = query.Order("files.indexed_at DESC")
+
+	if actor != "" {
+		query = query.Where("users.did = ?", actor.String())
+	}
+	if mimeType != "" {
+		query = query.Where(`files.mime_type LIKE ? ESCAPE '\'`, escapeLike(strings.ToLower(mimeType))+"%")
+	}
+
+	files := []File{}
+	if err := query.Limit(limit).Offset(offset).Find(&files).Error; err != nil {
+		return "", nil, 500, fmt.Errorf("failed to search files: %w", err)
+	}
+
+	fileviews = []*skywell.Defs_FileView{}
+	if len(files) == 0 {
+		return "", fileviews, 200, nil
+	}
+
+	ids := make([]uint, len(files))
+	for i, f := range files {
+		ids[i] = f.ID
+	}
+	keys := []FileKey{}
+	if err := db.Where("file IN ?", ids).Find(&keys).Error; err != nil {
+		return "", nil, 500, fmt.Errorf("failed to find file keys: %w", err)
+	}
+	slugs := map[uint]string{}
+	for _, k := range keys {
+		slugs[k.File] = k.Key
+	}
+
+	for _, f := range files {
+		slug, ok := slugs[f.ID]
+		if !ok {
+			dbLogger.Debug("No file key found", "file_id", f.ID)
+			continue
+		}
+		fv, err := fileToView(f, slug, cfg)
+		if err != nil {
+			return "", nil, 500, err
+		}
+		fileviews = append(fileviews, fv)
+	}
+	if err := labelFileViews(fileviews, db, cfg); err != nil {
+		return "", nil, 500, err
+	}
+	if err := chunkFileViews(fileviews, db); err != nil {
+		return "", nil, 500, err
+	}
+
+	if len(files) < limit {
+		return "", fileviews, 200, nil
+	}
+	return strconv.Itoa(offset + len(files)), fileviews, 200, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// records say what their blob is (CID, size, MIME type) but nothing stops them from lying.
+// the verifier fetches each new file's blob from its PDS and checks, and the result
+// ends up in File.Verification (and the fileView). files are marked pending by updateRecord,
+// so ones indexed while verification is off (or by a backfill) get picked up later
+
+var verifyLogger = slog.With("component", "verify")
+
+const (
+	verifyPending    = "pending"
+	verifyVerified   = "verified"
+	verifyInvalid    = "invalid"
+	verifyUnverified = "unverified" // couldn't check everything, e.g. too big to hash or the PDS kept failing
+)
+
+const (
+	maxVerifyAttempts = 3
+	verifyBatchSize   = 100
+	verifySweepPeriod = time.Minute
+	sniffLen          = 512 // all http.DetectContentType looks at
+)
+
+var verifyWake = make(chan struct{}, 1)
+
+// wakeVerifier lets the verifier know there's something new without waiting for the next sweep.
+// it never blocks, and does nothing if the verifier isn't running
+func wakeVerifier() {
+	select {
+	case verifyWake <- struct{}{}:
+	default:
+	}
+}
+
+func runVerifier(db *gorm.DB, cfg *Config, ctx context.Context) {
+	verifyLogger.Info("Starting blob verifier", "workers", cfg.Verify.Workers, "max_bytes", cfg.Verify.MaxBytes)
+	ticker := time.NewTicker(verifySweepPeriod)
+	defer ticker.Stop()
+	for {
+		verifyPendingFiles(db, cfg, ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-verifyWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// verifyPendingFiles makes one pass over the pending files,
+// so a PDS that keeps failing only gets one attempt per sweep
+func verifyPendingFiles(db *gorm.DB, cfg *Config, ctx context.Context) {
+	var lastID uint
+	for ctx.Err() == nil {
+		files := []File{}
+		err := db.Preload("User").
+			Where("verification = ? AND id > ?", verifyPending, lastID).
+			Order("id").Limit(verifyBatchSize).Find(&files).Error
+		if err != nil {
+			verifyLogger.Error("Failed to query pending files", "error", err)
+			return
+		}
+		if len(files) == 0 {
+			return
+		}
+		lastID = files[len(files)-1].ID
+
+		sem := make(chan struct{}, cfg.Verify.Workers)
+		wg := sync.WaitGroup{}
+		for _, f := range files {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				verifyFile(f, db, cfg, ctx)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// verifyResult is what checkBlob found out
+type verifyResult struct {
+	status   string
+	detected string // sniffed MIME type, empty if we never saw the contents
+	reason   string // why it isn't verified
+	// a chunked file's chunks put back together into its hash, see checkChunkedFile
+	hashVerified bool
+}
+
+func verifyFile(f File, db *gorm.DB, cfg *Config, ctx context.Context) {
+	var res verifyResult
+	var err error
+	if f.Hash != "" {
+		res, err = checkChunkedFile(f, db, cfg, ctx)
+	} else {
+		res, err = checkBlob(f, cfg, ctx)
+	}
+	updates := map[string]any{}
+	if err != nil {
+		if ctx.Err() != nil {
+			return // shutting down, try again next time
+		}
+		attempts := f.VerifyAttempts + 1
+		verifyLogger.Warn("Failed to check blob", "file_id", f.ID, "cid", f.BlobRef.String(), "did", f.User.DID.String(), "attempt", attempts, "error", err)
+		updates["verify_attempts"] = attempts
+		updates["verify_error"] = err.Error()
+		if attempts >= maxVerifyAttempts {
+			updates["verification"] = verifyUnverified
+		}
+	} else {
+		updates["verification"] = res.status
+		updates["detected_mime_type"] = res.detected
+		updates["verify_error"] = res.reason
+		if res.hashVerified {
+			updates["hash_verified"] = true
+		}
+		if res.status == verifyInvalid {
+			verifyLogger.Info("Blob doesn't match its record", "file_id", f.ID, "uri", f.Uri.String(), "cid", f.BlobRef.String(), "reason", res.reason)
+		} else {
+			verifyLogger.Debug("Checked blob", "file_id", f.ID, "cid", f.BlobRef.String(), "status", res.status, "detected_mime_type", res.detected)
+		}
+	}
+
+	// the cid check skips files whose record changed while we were looking,
+	// they've been set back to pending and will get checked again
+	err = db.Model(&File{}).Where("id = ? AND cid = ?", f.ID, f.Cid.String()).Updates(updates).Error
+	if err != nil {
+		verifyLogger.Error("Failed to save verification", "file_id", f.ID, "error", err)
+	}
+}
+
+// checkBlob compares a file's blob with what its record claims.
+// err is only set when the blob couldn't be checked at all (and might be later)
+func checkBlob(f File, cfg *Config, ctx context.Context) (res verifyResult, err error) {
+	_, digest, err := blobDigest(f.BlobRef.String())
+	if err != nil {
+		return verifyResult{status: verifyInvalid, reason: err.Error()}, nil
+	}
+
+	// the cache only has blobs that matched their CID, so the size and type are all that's left
+	if cf := blobCache.open(f.BlobRef.String()); cf != nil {
+		defer cf.Close()
+		fi, err := cf.Stat()
+		if err != nil {
+			return res, err
+		}
+		head := make([]byte, sniffLen)
+		n, err := io.ReadFull(cf, head)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return res, err
+		}
+		return compareBlob(f, fi.Size(), http.DetectContentType(head[:n]), true), nil
+	}
+
+	id, err := cacheDir.LookupDID(ctx, f.User.DID)
+	if err != nil {
+		return res, fmt.Errorf("failed to resolve DID: %w", err)
+	}
+	pds := id.PDSEndpoint()
+	if pds == "" {
+		return res, errors.New("DID document has no PDS endpoint")
+	}
+
+	if f.Size > cfg.Verify.MaxBytes {
+		return checkBlobHead(f, pds, cfg, ctx)
+	}
+
+	resp, err := fetchBlob(pds, f.User.DID.String(), f.BlobRef.String(), byteRange{}, false, cfg, ctx)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("PDS returned status %d", resp.StatusCode)
+	}
+
+	// one byte past the claimed size is enough to know it's wrong
+	h := sha256.New()
+	head := &bytes.Buffer{}
+	n, err := io.Copy(io.MultiWriter(h, &prefixWriter{head, sniffLen}), io.LimitReader(resp.Body, f.Size+1))
+	if err != nil {
+		return res, fmt.Errorf("failed to download blob: %w", err)
+	}
+	res = compareBlob(f, n, http.DetectContentType(head.Bytes()), n <= f.Size)
+	if res.status == verifyVerified && !bytes.Equal(h.Sum(nil), digest) {
+		return verifyResult{status: verifyInvalid, detected: res.detected, reason: "contents don't match the blob CID"}, nil
+	}
+	return res, nil
+}
+
+// checkChunkedFile checks every chunk of a chunked file against its CID and size,
+// and all of them together against the record's hash
+func checkChunkedFile(f File, db *gorm.DB, cfg *Config, ctx context.Context) (res verifyResult, err error) {
+	chunks, err := fileChunks(f.ID, db)
+	if err != nil {
+		return res, err
+	}
+	digests := make([][]byte, len(chunks))
+	for i, c := range chunks {
+		if _, digests[i], err = blobDigest(c.BlobRef.String()); err != nil {
+			return verifyResult{status: verifyInvalid, reason: fmt.Sprintf("chunk %d: %v", c.Position, err)}, nil
+		}
+	}
+
+	size := chunksSize(chunks)
+	if size > cfg.Verify.MaxBytes {
+		// the first chunk is the blobRef, which is still worth checking on its own
+		res, err = checkBlob(f, cfg, ctx)
+		if err == nil && res.status == verifyVerified {
+			res = verifyResult{status: verifyUnverified, detected: res.detected, reason: "too big to check against the hash"}
+		}
+		return res, err
+	}
+
+	src := &chunkSource{did: f.User.DID, cfg: cfg, ctx: ctx, fetchCtx: ctx}
+	whole := sha256.New()
+	head := &bytes.Buffer{}
+	for i, c := range chunks {
+		h := sha256.New()
+		_, err := src.copyChunk(io.MultiWriter(h, whole, &prefixWriter{head, sniffLen}), c, byteRange{0, c.Size - 1})
+		if errors.Is(err, io.EOF) {
+			return verifyResult{status: verifyInvalid, reason: fmt.Sprintf("chunk %d is smaller than the record claims", c.Position)}, nil
+		} else if err != nil {
+			return res, fmt.Errorf("chunk %d: %w", c.Position, err)
+		}
+		// a chunk bigger than claimed got cut short, so it won't match either
+		if !bytes.Equal(h.Sum(nil), digests[i]) {
+			return verifyResult{status: verifyInvalid, reason: fmt.Sprintf("chunk %d doesn't match its CID", c.Position)}, nil
+		}
+	}
+	detected := http.DetectContentType(head.Bytes())
+	if hex.EncodeToString(whole.Sum(nil)) != f.Hash {
+		detected, _, _ = mime.ParseMediaType(detected)
+		return verifyResult{status: verifyInvalid, detected: detected, reason: "chunks don't match the file's hash"}, nil
+	}
+	// the sizes were checked chunk by chunk, the type is all that's left
+	res = compareBlob(File{Size: size, MimeType: f.MimeType}, size, detected, true)
+	res.hashVerified = true
+	return res, nil
+}
+
+// checkBlobHead checks what it can of a blob that's too big to download, from its first few bytes
+func checkBlobHead(f File, pds string, cfg *Config, ctx context.Context) (res verifyResult, err error) {
+	resp, err := fetchBlob(pds, f.User.DID.String(), f.BlobRef.String(), byteRange{0, sniffLen - 1}, true, cfg, ctx)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	size := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// bytes 0-511/<size>
+		if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+			if size, err = strconv.ParseInt(total, 10, 64); err != nil {
+				size = -1
+			}
+		}
+	case http.StatusOK:
+		size = resp.ContentLength
+	default:
+		return res, fmt.Errorf("PDS returned status %d", resp.StatusCode)
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return res, fmt.Errorf("failed to download blob: %w", err)
+	}
+	if size < 0 {
+		size = f.Size // the PDS didn't say, so there's nothing to compare
+	}
+	res = compareBlob(f, size, http.DetectContentType(head[:n]), true)
+	if res.status == verifyVerified {
+		res = verifyResult{status: verifyUnverified, detected: res.detected, reason: "too big to check against the CID"}
+	}
+	return res, nil
+}
+
+// compareBlob checks the blob's size and sniffed type against the record's claims.
+// complete is false when the size is only known to be bigger than claimed
+func compareBlob(f File, size int64, detected string, complete bool) verifyResult {
+	detected, _, _ = mime.ParseMediaType(detected)
+	switch {
+	case !complete || size != f.Size:
+		return verifyResult{status: verifyInvalid, detected: detected, reason: fmt.Sprintf("blob is %s bytes, record claims %d", sizeString(size, complete), f.Size)}
+	case !mimeTypeMatches(f.MimeType, detected):
+		return verifyResult{status: verifyInvalid, detected: detected, reason: fmt.Sprintf("blob looks like %s, record claims %s", detected, f.MimeType)}
+	}
+	return verifyResult{status: verifyVerified, detected: detected}
+}
+
+func sizeString(size int64, complete bool) string {
+	if complete {
+		return strconv.FormatInt(size, 10)
+	}
+	return "more than " + strconv.FormatInt(size-1, 10)
+}
+
+// mimeTypeMatches is deliberately forgiving. http.DetectContentType only knows a few dozen formats,
+// and plenty of real ones (docx, epub, svg, json...) sniff as something generic,
+// so it only fails when the blob is clearly something else
+func mimeTypeMatches(claimed string, detected string) bool {
+	if c, _, err := mime.ParseMediaType(claimed); err == nil {
+		claimed = c
+	}
+	claimed = strings.ToLower(strings.TrimSpace(claimed))
+	if claimed == "" || claimed == detected || detected == "application/octet-stream" {
+		return true
+	}
+	claimedTop, claimedSub, _ := strings.Cut(claimed, "/")
+	detectedTop, _, _ := strings.Cut(detected, "/")
+
+	switch detected {
+	case "text/plain":
+		// anything textual
+		return claimedTop == "text" || claimedTop == "application" ||
+			strings.HasSuffix(claimedSub, "+xml") || strings.HasSuffix(claimedSub, "+json")
+	case "text/xml", "text/html":
+		return claimedTop == "text" || strings.Contains(claimedSub, "xml") || strings.Contains(claimedSub, "html")
+	}
+	switch detectedTop {
+	case "application":
+		// containers, e.g. zip for docx or ogg for audio
+		return claimedTop == "application" || claimedTop == "audio" || claimedTop == "video"
+	case "audio", "video":
+		// webm and friends can be either
+		return claimedTop == "audio" || claimedTop == "video"
+	}
+	return detectedTop == claimedTop
+}
+
+// prefixWriter keeps the first n bytes written to it and drops the rest
+type prefixWriter struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if left := w.n - w.buf.Len(); left > 0 {
+		w.buf.Write(p[:min(left, len(p))])
+	}
+	return len(p), nil
+}